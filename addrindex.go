@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"log"
+)
+
+const addrIndexBucket = "addrindex"
+
+const (
+	addrIndexFunding  = 0
+	addrIndexSpending = 1
+)
+
+var errNoAddrIndex = errors.New("address index is not enabled, run 'reindex -addrindex' first")
+
+type AddressTx struct {
+	TxID     []byte
+	Height   int
+	Received int
+	Spent    int
+}
+
+func outpointIndexKey(txid []byte, vout int) []byte {
+	key := append([]byte{'o'}, txid...)
+	return binary.BigEndian.AppendUint32(key, uint32(vout))
+}
+
+func addressPrefix(pubKeyHash []byte) []byte {
+	return append([]byte{'h', uint8(len(pubKeyHash))}, pubKeyHash...)
+}
+
+func historyKey(pubKeyHash []byte, height, txPos int, txid []byte, kind uint8, idx int) []byte {
+	key := append(addressPrefix(pubKeyHash), heightKey(height)...)
+	key = binary.BigEndian.AppendUint32(key, uint32(txPos))
+	key = append(key, txid...)
+	key = append(key, kind)
+	return binary.BigEndian.AppendUint32(key, uint32(idx))
+}
+
+func indexBlockAddresses(tx *bbolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(addrIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	for txPos, btx := range block.Transactions {
+		if !btx.IsCoinbase() {
+			for inIdx, in := range btx.Vin {
+				data := b.Get(outpointIndexKey(in.Txid, in.Vout))
+				if data == nil {
+					return fmt.Errorf("addrindex has no output %x:%d", in.Txid, in.Vout)
+				}
+				d := &decoder{data: data}
+				pubKeyHash := d.readBytes()
+				value := d.readInt64()
+				if err := d.finish(); err != nil {
+					return err
+				}
+				if len(pubKeyHash) == 0 {
+					continue
+				}
+
+				e := &encoder{}
+				e.writeBytes(in.Txid)
+				e.writeInt32(int32(in.Vout))
+				e.writeInt64(value)
+				key := historyKey(pubKeyHash, block.Height, txPos, btx.ID, addrIndexSpending, inIdx)
+				if err := b.Put(key, e.Bytes()); err != nil {
+					return err
+				}
+			}
+		}
+
+		for outIdx, out := range btx.Vout {
+			pubKeyHash := scriptAddressHash(out.ScriptPubKey)
+			e := &encoder{}
+			e.writeBytes(pubKeyHash)
+			e.writeInt64(int64(out.Value))
+			if err := b.Put(outpointIndexKey(btx.ID, outIdx), e.Bytes()); err != nil {
+				return err
+			}
+			if len(pubKeyHash) == 0 {
+				continue
+			}
+
+			e = &encoder{}
+			e.writeInt64(int64(out.Value))
+			key := historyKey(pubKeyHash, block.Height, txPos, btx.ID, addrIndexFunding, outIdx)
+			if err := b.Put(key, e.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func unindexBlockAddresses(tx *bbolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(addrIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	for txPos := len(block.Transactions) - 1; txPos >= 0; txPos-- {
+		btx := block.Transactions[txPos]
+		for outIdx, out := range btx.Vout {
+			if pubKeyHash := scriptAddressHash(out.ScriptPubKey); len(pubKeyHash) > 0 {
+				if err := b.Delete(historyKey(pubKeyHash, block.Height, txPos, btx.ID, addrIndexFunding, outIdx)); err != nil {
+					return err
+				}
+			}
+			if err := b.Delete(outpointIndexKey(btx.ID, outIdx)); err != nil {
+				return err
+			}
+		}
+
+		if btx.IsCoinbase() {
+			continue
+		}
+		for inIdx, in := range btx.Vin {
+			data := b.Get(outpointIndexKey(in.Txid, in.Vout))
+			if data == nil {
+				return fmt.Errorf("addrindex has no output %x:%d", in.Txid, in.Vout)
+			}
+			pubKeyHash := (&decoder{data: data}).readBytes()
+			if len(pubKeyHash) == 0 {
+				continue
+			}
+			if err := b.Delete(historyKey(pubKeyHash, block.Height, txPos, btx.ID, addrIndexSpending, inIdx)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (bc *Blockchain) HasAddrIndex() bool {
+	enabled := false
+	err := bc.db.View(func(tx *bbolt.Tx) error {
+		enabled = tx.Bucket([]byte(addrIndexBucket)) != nil
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return enabled
+}
+
+func (bc *Blockchain) ReIndexAddresses() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	err := bc.db.Update(func(tx *bbolt.Tx) error {
+		err := tx.DeleteBucket([]byte(addrIndexBucket))
+		if err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket([]byte(addrIndexBucket)); err != nil {
+			return err
+		}
+
+		heights := tx.Bucket([]byte(heightBucket))
+		blocks := tx.Bucket([]byte(blocksBucket))
+		return heights.ForEach(func(_, hash []byte) error {
+			block, err := decodeBlock(blocks.Get(hash))
+			if err != nil {
+				return err
+			}
+			return indexBlockAddresses(tx, block)
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// GetAddressHistory 返回主链上与公钥哈希有关的交易和余额
+func (bc *Blockchain) GetAddressHistory(pubKeyHash []byte) ([]AddressTx, int, error) {
+	var history []AddressTx
+	balance := 0
+
+	err := bc.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(addrIndexBucket))
+		if b == nil {
+			return errNoAddrIndex
+		}
+
+		prefix := addressPrefix(pubKeyHash)
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			rest := k[len(prefix):]
+			if len(rest) != 8+4+32+1+4 {
+				return fmt.Errorf("bad addrindex key %x", k)
+			}
+			height := int(binary.BigEndian.Uint64(rest[:8]))
+			txid := rest[12:44]
+			kind := rest[44]
+
+			d := &decoder{data: v}
+			if kind == addrIndexSpending {
+				d.readBytes()
+				d.readInt32()
+			}
+			value := int(d.readInt64())
+			if err := d.finish(); err != nil {
+				return err
+			}
+
+			if n := len(history); n == 0 || !bytes.Equal(history[n-1].TxID, txid) {
+				history = append(history, AddressTx{TxID: append([]byte{}, txid...), Height: height})
+			}
+			entry := &history[len(history)-1]
+			if kind == addrIndexSpending {
+				entry.Spent += value
+				balance -= value
+			} else {
+				entry.Received += value
+				balance += value
+			}
+		}
+		return nil
+	})
+	return history, balance, err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func testPayment(w *Wallet, prev *Transaction, to string, amount, fee int) *Transaction {
+	outputs := []TXOutput{*NewTXOutput(amount, to), *NewTXOutput(prev.Vout[0].Value-amount-fee, string(w.GetAddress()))}
+	tx := &Transaction{nil, encodingVersion, []TXInput{{prev.ID, 0, nil, SequenceFinal}}, outputs, 0}
+	tx.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(prev.ID): *prev})
+	tx.ID = tx.Hash()
+	return tx
+}
+
+func scanAddressHistory(t *testing.T, bc *Blockchain, pubKeyHash []byte) ([]AddressTx, int) {
+	var history []AddressTx
+	outputs := make(map[string]TXOutput)
+	for height := 0; height <= bc.GetBestHeight(); height++ {
+		block, err := bc.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tx := range block.Transactions {
+			entry := AddressTx{TxID: tx.ID, Height: height}
+			if !tx.IsCoinbase() {
+				for _, in := range tx.Vin {
+					prevOut := outputs[outpointKey(in.Txid, in.Vout)]
+					if bytes.Equal(scriptAddressHash(prevOut.ScriptPubKey), pubKeyHash) {
+						entry.Spent += prevOut.Value
+					}
+				}
+			}
+			for i, out := range tx.Vout {
+				outputs[outpointKey(tx.ID, i)] = out
+				if bytes.Equal(scriptAddressHash(out.ScriptPubKey), pubKeyHash) {
+					entry.Received += out.Value
+				}
+			}
+			if entry.Received != 0 || entry.Spent != 0 {
+				history = append(history, entry)
+			}
+		}
+	}
+
+	balance := 0
+	UTXOSet{bc}.forEach(func(txid []byte, vout int, entry UTXOEntry) {
+		if bytes.Equal(scriptAddressHash(entry.Output.ScriptPubKey), pubKeyHash) {
+			balance += entry.Output.Value
+		}
+	})
+	return history, balance
+}
+
+func checkAddressIndex(t *testing.T, bc *Blockchain, step string, wallets ...*Wallet) {
+	for _, w := range wallets {
+		pubKeyHash := HashPubKey(w.PublicKey)
+		history, balance, err := bc.GetAddressHistory(pubKeyHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantHistory, wantBalance := scanAddressHistory(t, bc, pubKeyHash)
+		if !reflect.DeepEqual(history, wantHistory) {
+			t.Errorf("%s: history of %s is %+v, want %+v", step, w.GetAddress(), history, wantHistory)
+		}
+		if balance != wantBalance {
+			t.Errorf("%s: balance of %s is %d, want %d", step, w.GetAddress(), balance, wantBalance)
+		}
+	}
+}
+
+func TestAddressIndexReorg(t *testing.T) {
+	bc, a := newTestChain(t, "addrindex-reorg")
+	defer bc.Close()
+	bc.ReIndexAddresses()
+	b := newTestWallet()
+	addressA, addressB := string(a.GetAddress()), string(b.GetAddress())
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coin := genesis.Transactions[0]
+	checkAddressIndex(t, bc, "genesis", a, b)
+
+	payment := testPayment(a, coin, addressB, 10, 1)
+	a1 := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(addressA, "a", 1, 0), payment})
+	a2 := mineTestBlock(bc, a1, []*Transaction{NewCoinBaseTX(addressB, "a", 2, 0), testPayment(b, payment, addressA, 4, 1)})
+	a3 := mineTestBlock(bc, a2, []*Transaction{NewCoinBaseTX(addressA, "a", 3, 0)})
+
+	b1 := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(addressB, "b", 1, 0), testPayment(a, coin, addressA, 20, 2)})
+	b2 := mineTestBlock(bc, b1, []*Transaction{NewCoinBaseTX(addressB, "b", 2, 0)})
+
+	steps := []struct {
+		name  string
+		block *Block
+		tip   *Block
+	}{
+		{"connect a1", a1, a1},
+		{"store b1", b1, a1},
+		{"reorganize to b2", b2, b2},
+		{"store a2", a2, b2},
+		{"reorganize back to a3", a3, a3},
+	}
+	for _, step := range steps {
+		if _, err := bc.AddBlock(step.block); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if !bytes.Equal(bc.getTip(), step.tip.HeaderHash) {
+			t.Fatalf("%s: tip %x, want %x", step.name, bc.getTip(), step.tip.HeaderHash)
+		}
+		checkAddressIndex(t, bc, step.name, a, b)
+	}
+
+	bc.ReIndexAddresses()
+	checkAddressIndex(t, bc, "reindex", a, b)
+}
@@ -22,7 +22,10 @@ func Base58Encode(input []byte) []byte {
 		result = append(result, b58Alphabet[mod.Int64()])
 	}
 
-	if input[0] == 0x00 {
+	for _, b := range input {
+		if b != 0x00 {
+			break
+		}
 		result = append(result, b58Alphabet[0])
 	}
 
@@ -37,15 +40,16 @@ func Base58Decode(input []byte) []byte {
 
 	for _, b := range input {
 		charIndex := bytes.IndexByte(b58Alphabet, b)
+		if charIndex < 0 {
+			return nil
+		}
 		result.Mul(result, big.NewInt(58))
 		result.Add(result, big.NewInt(int64(charIndex)))
 	}
 
-	decoded := result.Bytes()
-
-	if input[0] == b58Alphabet[0] {
-		decoded = append([]byte{0x00}, decoded...)
+	zeros := 0
+	for zeros < len(input) && input[zeros] == b58Alphabet[0] {
+		zeros++
 	}
-
-	return decoded
+	return append(make([]byte, zeros), result.Bytes()...)
 }
@@ -2,40 +2,62 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
-	"encoding/gob"
+	"encoding/binary"
+	"fmt"
 	"log"
-	"strconv"
+	"runtime"
 	"time"
 )
 
-type Block struct {
-	Timestamp           int64
+// BlockHeader 是区块中参与工作量证明的部分，可以脱离交易单独传递和校验
+type BlockHeader struct {
+	Version             uint8
 	PrevBlockHeaderHash []byte
-	HeaderHash          []byte
 	Root                []byte
-	Transactions        []*Transaction
+	Timestamp           int64
+	Bits                uint32
 	Nonce               int
-	Height              int
 }
 
-func (b *Block) SetHash() {
-	timestamp := []byte(strconv.FormatInt(b.Timestamp, 10))
-	headers := bytes.Join([][]byte{b.PrevBlockHeaderHash, b.Root, timestamp}, []byte{})
-	hash := sha256.Sum256(headers)
-	b.HeaderHash = hash[:]
+// Hash 是区块头规范编码的 SHA-256，版本 0 的区块头沿用 gob 时期的算法
+func (h *BlockHeader) Hash() []byte {
+	data := h.Serialize()
+	if h.Version == 0 {
+		data = bytes.Join([][]byte{
+			h.PrevBlockHeaderHash,
+			h.Root,
+			IntToHex(h.Timestamp),
+			IntToHex(int64(h.Bits)),
+			IntToHex(int64(h.Nonce)),
+		}, []byte{})
+	}
+	hash := sha256.Sum256(data)
+	return hash[:]
 }
 
-func (b *Block) Serialize() []byte {
-	var result bytes.Buffer
-	encoder := gob.NewEncoder(&result)
+func (h *BlockHeader) Serialize() []byte {
+	return encodeBlockHeader(h)
+}
 
-	err := encoder.Encode(b)
+func DeserializeBlockHeader(data []byte) *BlockHeader {
+	header, err := decodeBlockHeader(data)
 	if err != nil {
 		log.Panic(err)
 	}
+	return header
+}
 
-	return result.Bytes()
+type Block struct {
+	BlockHeader
+	HeaderHash   []byte
+	Transactions []*Transaction
+	Height       int
+}
+
+func (b *Block) Serialize() []byte {
+	return encodeBlock(b)
 }
 
 func (b *Block) HashTransactions() []byte {
@@ -49,33 +71,70 @@ func (b *Block) HashTransactions() []byte {
 }
 
 func DeserializeBlock(data []byte) *Block {
-	var block Block
+	block, err := decodeBlock(data)
+	if err != nil {
+		log.Panic(err)
+	}
+	return block
+}
+
+func NewBlock(prevBlockHeaderHash []byte, height int, bits uint32, timestamp int64, transactions []*Transaction) *Block {
+	block := NewBlockTemplate(prevBlockHeaderHash, height, bits, timestamp, transactions)
 
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&block)
+	fmt.Printf("Mining a new block\n")
+	err := block.Mine(context.Background(), runtime.NumCPU())
 	if err != nil {
 		log.Panic(err)
 	}
-	return &block
+	fmt.Printf("%x\n\n", block.HeaderHash)
+	return block
 }
 
-func NewBlock(prevBlockHeaderHash []byte, transactions []*Transaction) *Block {
-	block := &Block{
-		Timestamp:           time.Now().Unix(),
-		PrevBlockHeaderHash: prevBlockHeaderHash,
-		Transactions:        transactions,
-		HeaderHash:          []byte{},
-		Nonce:               0,
+// Mine 搜索满足难度的 nonce，nonce 空间用尽时更新 coinbase 中的 extranonce
+func (b *Block) Mine(ctx context.Context, workers int) error {
+	coinbase := b.Transactions[0]
+	_, data, err := coinbaseData(coinbase.Vin[0].ScriptSig)
+	if err != nil {
+		return err
 	}
-	//block.SetHash()
-	pow := NewPoW(block)
-	nonce, hash := pow.Run()
 
-	block.HeaderHash = hash
-	block.Nonce = nonce
+	for extraNonce := uint64(1); ; extraNonce++ {
+		nonce, hash, err := NewPoW(&b.BlockHeader).Run(ctx, workers)
+		if err == nil {
+			b.Nonce = nonce
+			b.HeaderHash = hash
+			return nil
+		}
+		if err != errNonceExhausted {
+			return err
+		}
+
+		var extra [8]byte
+		binary.BigEndian.PutUint64(extra[:], extraNonce)
+		coinbase.Vin[0].ScriptSig = coinbaseScript(b.Height, append(append([]byte{}, data...), extra[:]...))
+		coinbase.ID = coinbase.Hash()
+		b.Root = b.HashTransactions()
+		b.Timestamp = max(b.Timestamp, time.Now().Unix())
+	}
+}
+
+func NewBlockTemplate(prevBlockHeaderHash []byte, height int, bits uint32, timestamp int64, transactions []*Transaction) *Block {
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:             encodingVersion,
+			PrevBlockHeaderHash: prevBlockHeaderHash,
+			Timestamp:           timestamp,
+			Bits:                bits,
+			Nonce:               0,
+		},
+		Transactions: transactions,
+		HeaderHash:   []byte{},
+		Height:       height,
+	}
+	block.Root = block.HashTransactions()
 	return block
 }
 
 func NewGenesisBlock(coinBase *Transaction) *Block {
-	return NewBlock([]byte{}, []*Transaction{coinBase})
+	return NewBlock([]byte{}, 0, params.GenesisBits, time.Now().Unix(), []*Transaction{coinBase})
 }
@@ -3,21 +3,36 @@ package main
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"go.etcd.io/bbolt"
 	"log"
 	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
 const dbFile = "ozycoin_%s.db"
 const blocksBucket = "blocks"
+const heightBucket = "heights"
+const dbVersionKey = "v"
 const genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
 
+// dbOpenTimeout 内拿不到数据库文件锁时报告数据库被占用，而不是一直阻塞
+const dbOpenTimeout = 2 * time.Second
+
+var errDatabaseInUse = errors.New("database is in use by another process; if the node is starting, retry once it accepts RPC connections")
+
+// Blockchain 可以被多个连接并发使用，mu 串行化修改主链的操作，读操作依赖 bbolt 的事务隔离
 type Blockchain struct {
-	tip []byte
-	db  *bbolt.DB
+	mu   sync.Mutex
+	db   *bbolt.DB
+	utxo *utxoCache
+}
+
+func newBlockchain(db *bbolt.DB) *Blockchain {
+	return &Blockchain{db: db, utxo: newUTXOCache()}
 }
 
 func doExists(path string) bool {
@@ -33,24 +48,44 @@ func NewBlockChain(nodeId string) *Blockchain {
 		log.Println("No existing blockchain found. Creating a new first")
 		os.Exit(1)
 	}
-	var tip []byte
-	db, err := bbolt.Open(path, 0600, nil)
+	db, err := openChainDB(path)
+	if errors.Is(err, errDatabaseInUse) {
+		log.Println(err)
+		os.Exit(1)
+	}
 	if err != nil {
 		log.Panic(err)
 	}
 
-	err = db.View(func(tx *bbolt.Tx) error {
+	err = db.Update(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
+		if v := b.Get([]byte(dbVersionKey)); len(v) != 1 || v[0] != encodingVersion {
+			return errLegacyDatabase
+		}
 
-		return nil
+		return createChainBuckets(tx)
 	})
 
+	if err == errLegacyDatabase {
+		log.Printf("%s uses an old encoding. Run 'migrate' first\n", path)
+		os.Exit(1)
+	}
 	if err != nil {
 		log.Panic(err)
 	}
 
-	return &Blockchain{tip, db}
+	bc := newBlockchain(db)
+	UTXOSet{bc}.Recover()
+	bc.recoverReorg()
+	return bc
+}
+
+func openChainDB(path string) (*bbolt.DB, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: dbOpenTimeout})
+	if err == bbolt.ErrTimeout {
+		return nil, fmt.Errorf("%s: %w", path, errDatabaseInUse)
+	}
+	return db, err
 }
 
 func CreateBlockChain(nodeId, address string) *Blockchain {
@@ -60,9 +95,7 @@ func CreateBlockChain(nodeId, address string) *Blockchain {
 		os.Exit(1)
 	}
 
-	var tip []byte
-
-	genesis := NewGenesisBlock(NewCoinBaseTX(address, genesisCoinbaseData))
+	genesis := NewGenesisBlock(NewCoinBaseTX(address, genesisCoinbaseData, 0, 0))
 
 	db, err := bbolt.Open(path, 0600, nil)
 	if err != nil {
@@ -77,17 +110,35 @@ func CreateBlockChain(nodeId, address string) *Blockchain {
 			log.Panic(err)
 		}
 
+		err = createChainBuckets(tx)
+		if err != nil {
+			log.Panic(err)
+		}
+
 		err = b.Put(genesis.HeaderHash, genesis.Serialize())
 		if err != nil {
 			log.Panic(err)
 		}
 
+		err = tx.Bucket([]byte(chainWorkBucket)).Put(genesis.HeaderHash, NewPoW(&genesis.BlockHeader).Work().Bytes())
+		if err != nil {
+			log.Panic(err)
+		}
+
+		err = tx.Bucket([]byte(heightBucket)).Put(heightKey(0), genesis.HeaderHash)
+		if err != nil {
+			log.Panic(err)
+		}
+
 		err = b.Put([]byte("l"), genesis.HeaderHash)
 		if err != nil {
 			log.Panic(err)
 		}
 
-		tip = genesis.HeaderHash
+		err = b.Put([]byte(dbVersionKey), []byte{encodingVersion})
+		if err != nil {
+			log.Panic(err)
+		}
 
 		return nil
 	})
@@ -96,49 +147,41 @@ func CreateBlockChain(nodeId, address string) *Blockchain {
 		log.Panic(err)
 	}
 
-	return &Blockchain{tip, db}
+	return newBlockchain(db)
 }
 
-func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
-	var tip []byte
+func (bc *Blockchain) Close() error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
 
+	bc.FlushUTXO()
+	return bc.db.Close()
+}
+
+func (bc *Blockchain) MineBlock(transactions []*Transaction) (*Block, error) {
 	for _, tx := range transactions {
 		if bc.VerifyTransaction(tx) == false {
-			log.Panic("Transaction is not valid")
+			return nil, fmt.Errorf("transaction %x is not valid", tx.ID)
 		}
 	}
 
-	err := bc.db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
-
-		return nil
-	})
-
-	block := NewBlock(tip, transactions)
-
-	err = bc.db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-
-		err := b.Put(block.HeaderHash, block.Serialize())
-		if err != nil {
-			log.Panic(err)
-		}
-
-		err = b.Put([]byte("l"), block.HeaderHash)
-		if err != nil {
-			log.Panic(err)
-		}
-
-		bc.tip = block.HeaderHash
+	lastBlock, err := bc.findBlock(bc.getTip())
+	if err != nil {
+		return nil, err
+	}
 
-		return nil
-	})
+	block := NewBlock(lastBlock.HeaderHash, lastBlock.Height+1, bc.CalcNextBits(lastBlock), bc.NextBlockTime(lastBlock), transactions)
 
-	if err != nil {
-		log.Panic(err)
+	if err := bc.ValidateBlock(block); err != nil {
+		return nil, err
 	}
-	return block
+	if _, err := bc.AddBlock(block); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(bc.getTip(), block.HeaderHash) {
+		return nil, fmt.Errorf("mined block %x is stale", block.HeaderHash)
+	}
+	return block, nil
 }
 
 func (bc *Blockchain) GetBestHeight() int {
@@ -157,52 +200,121 @@ func (bc *Blockchain) GetBestHeight() int {
 	return lastBlock.Height
 }
 
-func (bc *Blockchain) AddBlock(block *Block) {
-	err := bc.db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		blockInDB := b.Get(block.HeaderHash)
-		if blockInDB != nil {
-			return nil
-		}
+// AddBlock 按累计工作量选择主链，返回重组时被断开区块中的交易
+func (bc *Blockchain) AddBlock(block *Block) ([]*Transaction, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
 
-		blockData := block.Serialize()
-		err := b.Put(block.HeaderHash, blockData)
-		if err != nil {
-			log.Panic(err)
-		}
+	if _, err := bc.findBlock(block.HeaderHash); err == nil {
+		return nil, nil
+	}
+	if err := checkTransactions(block); err != nil {
+		return nil, err
+	}
 
-		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeserializeBlock(lastBlockData)
-		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("l"), block.HeaderHash)
+	tip := bc.getTip()
+	if bytes.Equal(block.PrevBlockHeaderHash, tip) {
+		if err := bc.checkBlockConnect(block); err != nil {
+			return nil, err
+		}
+		err := bc.updateChainstate(func(tx *bbolt.Tx) error {
+			err := bc.storeBlock(tx, block)
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
-			bc.tip = block.HeaderHash
+			return bc.connectBlock(tx, block)
+		})
+		if err != nil {
+			log.Panic(err)
 		}
-		return nil
+		return nil, nil
+	}
+
+	err := bc.db.Update(func(tx *bbolt.Tx) error {
+		return bc.storeBlock(tx, block)
 	})
 	if err != nil {
 		log.Panic(err)
 	}
+
+	if bc.GetChainWork(block.HeaderHash).Cmp(bc.GetChainWork(tip)) <= 0 {
+		fmt.Printf("Block %x stored on a side branch\n", block.HeaderHash)
+		return nil, nil
+	}
+
+	return bc.reorganize(block)
 }
 
-func (bc *Blockchain) GetBlockHashes() [][]byte {
-	var blocks [][]byte
+// BlockLocator 返回最近 10 个主链区块的哈希，之后步长逐次加倍，最后是创世区块
+func (bc *Blockchain) BlockLocator() [][]byte {
+	var locator [][]byte
+
+	step := 1
+	for height := bc.GetBestHeight(); height > 0; height -= step {
+		hash, err := bc.GetBlockHashByHeight(height)
+		if err != nil {
+			break
+		}
+		locator = append(locator, hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
 
-	iterator := bc.Iterator()
+	genesis, err := bc.GetBlockHashByHeight(0)
+	if err != nil {
+		log.Panic(err)
+	}
+	return append(locator, genesis)
+}
 
-	for {
-		block := iterator.Next()
+func (bc *Blockchain) GetHeadersAfter(locator [][]byte, stop []byte, limit int) []*BlockHeader {
+	start := 0
+	for _, hash := range locator {
+		block, err := bc.findBlock(hash)
+		if err != nil {
+			continue
+		}
+		mainHash, err := bc.GetBlockHashByHeight(block.Height)
+		if err == nil && bytes.Equal(mainHash, hash) {
+			start = block.Height + 1
+			break
+		}
+	}
 
-		blocks = append(blocks, block.HeaderHash)
-		if len(block.PrevBlockHeaderHash) == 0 {
+	var headers []*BlockHeader
+	for height := start; len(headers) < limit; height++ {
+		block, err := bc.GetBlockByHeight(height)
+		if err != nil {
+			break
+		}
+		headers = append(headers, &block.BlockHeader)
+		if bytes.Equal(block.HeaderHash, stop) {
 			break
 		}
 	}
+	return headers
+}
+
+func (bc *Blockchain) GetBlockHashByHeight(height int) ([]byte, error) {
+	var hash []byte
+	err := bc.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket([]byte(heightBucket)).Get(heightKey(height))
+		if v == nil {
+			return fmt.Errorf("no block at height %d", height)
+		}
+		hash = append([]byte{}, v...)
+		return nil
+	})
+	return hash, err
+}
 
-	return blocks
+func (bc *Blockchain) GetBlockByHeight(height int) (*Block, error) {
+	hash, err := bc.GetBlockHashByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	return bc.findBlock(hash)
 }
 
 func (bc *Blockchain) GetBlock(id []byte) Block {
@@ -219,96 +331,104 @@ func (bc *Blockchain) GetBlock(id []byte) Block {
 	return block
 }
 
+func (bc *Blockchain) GetBlockHeader(hash []byte) (*BlockHeader, error) {
+	block, err := bc.findBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &block.BlockHeader, nil
+}
+
 func (bc *Blockchain) Iterator() *BlockchainIterator {
-	return &BlockchainIterator{bc.tip, bc.db}
+	return &BlockchainIterator{bc.getTip(), bc.db}
 }
 
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
-	iterator := bc.Iterator()
+	tx, _, err := bc.FindTransactionLocation(ID)
+	return tx, err
+}
 
-	for {
-		block := iterator.Next()
-		for _, tx := range block.Transactions {
-			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
-			}
-		}
-		if len(block.PrevBlockHeaderHash) == 0 {
-			break
+func (bc *Blockchain) spentOutputs(tx *Transaction) ([]TXOutput, error) {
+	set := UTXOSet{bc}
+	prevOuts := make([]TXOutput, len(tx.Vin))
+	for i, in := range tx.Vin {
+		out, ok := set.FindOutput(in.Txid, in.Vout)
+		if !ok {
+			return nil, fmt.Errorf("output %x:%d is missing or spent", in.Txid, in.Vout)
 		}
+		prevOuts[i] = out
 	}
-	return Transaction{}, errors.New("transaction not found")
+	return prevOuts, nil
 }
 
 func (bc *Blockchain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
-
-	for _, in := range tx.Vin {
-		prevTX, err := bc.FindTransaction(in.Txid)
-		if err != nil {
-			log.Panic(err)
-		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	prevOuts, err := bc.spentOutputs(tx)
+	if err != nil {
+		log.Panic(err)
 	}
 
-	tx.Sign(privateKey, prevTXs)
+	tx.signOutputs(privateKey, prevOuts)
 }
 
 func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
-	prevTXs := make(map[string]Transaction)
+	if tx.IsCoinbase() {
+		return true
+	}
 
-	for _, in := range tx.Vin {
-		prevTX, err := bc.FindTransaction(in.Txid)
-		if err != nil {
-			log.Panic(err)
-		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	prevOuts, err := bc.spentOutputs(tx)
+	if err != nil {
+		return false
 	}
 
-	return tx.Verify(prevTXs)
+	return tx.VerifyScripts(prevOuts) == nil
 }
 
-func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
-	UTXO := make(map[string]TXOutputs)
-	spentTXOs := make(map[string][]int)
-	iterator := bc.Iterator()
-
-	for {
-		block := iterator.Next()
-
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-
-		Outputs:
-			for outIdx, out := range tx.Vout {
-				// 检查当前输出是否在下个交易被花掉
-				if spentTXOs[txID] != nil {
-					for _, spentOutIdx := range spentTXOs[txID] {
-						if spentOutIdx == outIdx {
-							continue Outputs
-						}
-					}
-				}
-
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
-			}
+func (bc *Blockchain) CalcFee(tx *Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
 
-			if !tx.IsCoinbase() {
-				// 统计已经花掉的钱
-				for _, in := range tx.Vin {
-					inTxID := hex.EncodeToString(in.Txid)
-					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
-				}
-			}
-		}
+	prevOuts, err := bc.spentOutputs(tx)
+	if err != nil {
+		return 0, err
+	}
+	fee := 0
+	for _, out := range prevOuts {
+		fee += out.Value
+	}
+	for _, out := range tx.Vout {
+		fee -= out.Value
+	}
+	return fee, nil
+}
 
-		if len(block.PrevBlockHeaderHash) == 0 {
+// MedianTimePast 返回 block 及其之前共 MedianTimeSpan 个区块时间戳的中位数
+func (bc *Blockchain) MedianTimePast(block *Block) int64 {
+	return medianTimePast(block, bc.findBlock)
+}
+
+func (bc *Blockchain) NextBlockTime(parent *Block) int64 {
+	return max(time.Now().Unix(), bc.MedianTimePast(parent)+1)
+}
+
+func medianTimePast(block *Block, lookup blockLookup) int64 {
+	var timestamps []int64
+
+	for cur := block; len(timestamps) < params.MedianTimeSpan; {
+		timestamps = append(timestamps, cur.Timestamp)
+		parent, err := lookup(cur.PrevBlockHeaderHash)
+		if err != nil {
 			break
 		}
+		cur = parent
 	}
-	return UTXO
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+func heightKey(height int) []byte {
+	return IntToHex(int64(height))
 }
 
 type BlockchainIterator struct {
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestOpenChainDBInUse(t *testing.T) {
+	bc, _ := newTestChain(t, "inuse")
+	path := fmt.Sprintf(dbFile, "inuse")
+
+	if _, err := openChainDB(path); !errors.Is(err, errDatabaseInUse) {
+		t.Fatalf("got %v, want %v", err, errDatabaseInUse)
+	}
+
+	if err := bc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openChainDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"runtime"
+	"strings"
+	"time"
 )
 
 type CLI struct {
@@ -21,23 +24,87 @@ func (cli *CLI) Run() {
 
 	startNodeCmd := flag.NewFlagSet("start", flag.ExitOnError)
 	minerAddress := startNodeCmd.String("m", "", "miner address")
+	emptyInterval := startNodeCmd.Int("empty", 0, "Mine an empty block when no block was found for this many seconds")
+	minerThreads := startNodeCmd.Int("threads", runtime.NumCPU(), "Number of mining goroutines")
+	rpcPortData := startNodeCmd.Int("rpcport", 0, "JSON-RPC port, defaults to the node port plus 10000")
+	rpcUser := startNodeCmd.String("rpcuser", "", "JSON-RPC user name, the cookie file is always accepted")
+	rpcPassword := startNodeCmd.String("rpcpassword", "", "JSON-RPC password")
 
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 
 	createBlockCmd := flag.NewFlagSet("create", flag.ExitOnError)
 	addressData := createBlockCmd.String("a", "", "your wallet address")
+	createTxIndex := createBlockCmd.Bool("txindex", false, "Maintain a transaction index")
+	createAddrIndex := createBlockCmd.Bool("addrindex", false, "Maintain an address index")
 
 	sendCmd := flag.NewFlagSet("add", flag.ExitOnError)
 	fromData := sendCmd.String("f", "", "Source wallet address")
 	toData := sendCmd.String("t", "", "Destination wallet address")
 	amountData := sendCmd.Int("a", 0, "Amount to send")
+	feeData := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	feeRateData := sendCmd.Int("feerate", 0, "Fee per 1000 bytes, overrides -fee when higher")
 	mineData := sendCmd.Bool("m", false, "Mine immediately on the same node")
+	lockTimeData := sendCmd.String("locktime", "", "Lock the payment until a block height, Unix time or date (2006-01-02)")
+	lockBlocksData := sendCmd.Int("lockblocks", 0, "Lock the payment until this many blocks after it is confirmed")
 
 	balanceCmd := flag.NewFlagSet("balance", flag.ExitOnError)
 	balanceData := balanceCmd.String("a", "", "Balance of wallet address")
 
 	printChainCmd := flag.NewFlagSet("print", flag.ExitOnError)
+	printFromData := printChainCmd.Int("from", 0, "Lowest block height to print")
+	printToData := printChainCmd.Int("to", -1, "Highest block height to print, defaults to the tip")
 	listAddressesCmd := flag.NewFlagSet("list", flag.ExitOnError)
+	supplyCmd := flag.NewFlagSet("supply", flag.ExitOnError)
+	migrateCmd := flag.NewFlagSet("migrate", flag.ExitOnError)
+	reindexCmd := flag.NewFlagSet("reindex", flag.ExitOnError)
+	reindexTxIndex := reindexCmd.Bool("txindex", false, "Build the transaction index if it does not exist yet")
+	reindexAddrIndex := reindexCmd.Bool("addrindex", false, "Build the address index if it does not exist yet")
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
+	historyData := historyCmd.String("a", "", "Address to list transactions for")
+	getTxCmd := flag.NewFlagSet("gettx", flag.ExitOnError)
+	getTxID := getTxCmd.String("id", "", "Transaction ID")
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	getPubKeyData := getPubKeyCmd.String("a", "", "Wallet address")
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	multisigRequired := createMultisigCmd.Int("m", 0, "Number of signatures required")
+	multisigKeys := createMultisigCmd.String("keys", "", "Comma separated hex public keys")
+	spendMultisigCmd := flag.NewFlagSet("spendmultisig", flag.ExitOnError)
+	spendMultisigFrom := spendMultisigCmd.String("f", "", "Multisig address to spend from")
+	spendMultisigTo := spendMultisigCmd.String("t", "", "Destination address")
+	spendMultisigAmount := spendMultisigCmd.Int("a", 0, "Amount to send")
+	spendMultisigFee := spendMultisigCmd.Int("fee", 0, "Fee paid to the miner")
+	signMultisigCmd := flag.NewFlagSet("signmultisig", flag.ExitOnError)
+	signMultisigTx := signMultisigCmd.String("tx", "", "Hex encoded transaction")
+	sendMultisigCmd := flag.NewFlagSet("sendmultisig", flag.ExitOnError)
+	sendMultisigTx := sendMultisigCmd.String("tx", "", "Hex encoded transaction")
+	createPSBTCmd := flag.NewFlagSet("createpsbt", flag.ExitOnError)
+	createPSBTFrom := createPSBTCmd.String("f", "", "Address to spend from, its private key is not needed")
+	createPSBTTo := createPSBTCmd.String("t", "", "Destination address")
+	createPSBTAmount := createPSBTCmd.Int("a", 0, "Amount to send")
+	createPSBTFee := createPSBTCmd.Int("fee", 0, "Fee paid to the miner")
+	createPSBTLockTime := createPSBTCmd.String("locktime", "", "Lock the payment until a block height, Unix time or date (2006-01-02)")
+	createPSBTLockBlocks := createPSBTCmd.Int("lockblocks", 0, "Lock the payment until this many blocks after it is confirmed")
+	signPSBTCmd := flag.NewFlagSet("signpsbt", flag.ExitOnError)
+	signPSBTData := signPSBTCmd.String("psbt", "", "Hex encoded partially signed transaction")
+	combinePSBTCmd := flag.NewFlagSet("combinepsbt", flag.ExitOnError)
+	combinePSBTData := combinePSBTCmd.String("psbt", "", "Comma separated hex encoded partially signed transactions")
+	finalizePSBTCmd := flag.NewFlagSet("finalizepsbt", flag.ExitOnError)
+	finalizePSBTData := finalizePSBTCmd.String("psbt", "", "Hex encoded partially signed transaction")
+	finalizePSBTSend := finalizePSBTCmd.Bool("send", false, "Broadcast the finalized transaction")
+	createRawCmd := flag.NewFlagSet("createraw", flag.ExitOnError)
+	createRawIn := createRawCmd.String("in", "", "Comma separated inputs TXID:VOUT[:SEQUENCE]")
+	createRawOut := createRawCmd.String("out", "", "Comma separated outputs ADDRESS:AMOUNT")
+	createRawLockTime := createRawCmd.String("locktime", "", "Transaction lock time: block height, Unix time or date (2006-01-02)")
+	decodeRawCmd := flag.NewFlagSet("decoderaw", flag.ExitOnError)
+	decodeRawTx := decodeRawCmd.String("tx", "", "Hex encoded transaction")
+	decodeRawJSON := decodeRawCmd.Bool("json", false, "Print JSON instead of text")
+	signRawCmd := flag.NewFlagSet("signraw", flag.ExitOnError)
+	signRawTx := signRawCmd.String("tx", "", "Hex encoded transaction")
+	sendRawCmd := flag.NewFlagSet("sendraw", flag.ExitOnError)
+	sendRawTx := sendRawCmd.String("tx", "", "Hex encoded transaction")
+	benchmarkCmd := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	benchmarkThreads := benchmarkCmd.Int("threads", runtime.NumCPU(), "Number of hashing goroutines")
+	benchmarkSeconds := benchmarkCmd.Int("seconds", 10, "How long to hash")
 
 	switch os.Args[1] {
 	case "start":
@@ -75,6 +142,101 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "supply":
+		err := supplyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "migrate":
+		err := migrateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "reindex":
+		err := reindexCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "history":
+		err := historyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gettx":
+		err := getTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpubkey":
+		err := getPubKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig":
+		err := createMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "spendmultisig":
+		err := spendMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signmultisig":
+		err := signMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "sendmultisig":
+		err := sendMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createpsbt":
+		err := createPSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signpsbt":
+		err := signPSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "combinepsbt":
+		err := combinePSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "finalizepsbt":
+		err := finalizePSBTCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createraw":
+		err := createRawCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "decoderaw":
+		err := decodeRawCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signraw":
+		err := signRawCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "sendraw":
+		err := sendRawCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "benchmark":
+		err := benchmarkCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		os.Exit(1)
@@ -86,7 +248,14 @@ func (cli *CLI) Run() {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.startNode(nodeID, *minerAddress)
+		cli.startNode(nodeID, ServerOptions{
+			MinerAddress:  *minerAddress,
+			MinerThreads:  *minerThreads,
+			EmptyInterval: time.Duration(*emptyInterval) * time.Second,
+			RPCPort:       *rpcPortData,
+			RPCUser:       *rpcUser,
+			RPCPassword:   *rpcPassword,
+		})
 	}
 
 	if createWalletCmd.Parsed() {
@@ -98,15 +267,18 @@ func (cli *CLI) Run() {
 			createBlockCmd.Usage()
 			os.Exit(1)
 		}
-		cli.createBlockChain(nodeID, *addressData)
+		cli.createBlockChain(nodeID, *addressData, *createTxIndex, *createAddrIndex)
 	}
 
 	if sendCmd.Parsed() {
-		if *fromData == "" || *toData == "" || *amountData <= 0 {
+		lockTime, err := parseLockTime(*lockTimeData)
+		if *fromData == "" || *toData == "" || *amountData <= 0 || *feeData < 0 || *feeRateData < 0 ||
+			err != nil || *lockBlocksData < 0 || *lockBlocksData > sequenceLockTimeMask {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
-		cli.send(nodeID, *fromData, *toData, *amountData, *mineData)
+		lock := TimeLock{lockTime, uint32(*lockBlocksData)}
+		cli.send(nodeID, *fromData, *toData, *amountData, *feeData, *feeRateData, lock, *mineData)
 	}
 
 	if balanceCmd.Parsed() {
@@ -117,26 +289,170 @@ func (cli *CLI) Run() {
 		cli.getBalance(nodeID, *balanceData)
 	}
 	if printChainCmd.Parsed() {
-		cli.printChain(nodeID)
+		cli.printChain(nodeID, *printFromData, *printToData)
 	}
 	if listAddressesCmd.Parsed() {
 		cli.listAddresses(nodeID)
 	}
+	if supplyCmd.Parsed() {
+		cli.getSupply(nodeID)
+	}
+	if migrateCmd.Parsed() {
+		cli.migrate(nodeID)
+	}
+	if reindexCmd.Parsed() {
+		cli.reindex(nodeID, *reindexTxIndex, *reindexAddrIndex)
+	}
+	if historyCmd.Parsed() {
+		if *historyData == "" {
+			historyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.history(nodeID, *historyData)
+	}
+	if getTxCmd.Parsed() {
+		if *getTxID == "" {
+			getTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getTx(nodeID, *getTxID)
+	}
+	if getPubKeyCmd.Parsed() {
+		if *getPubKeyData == "" {
+			getPubKeyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getPubKey(nodeID, *getPubKeyData)
+	}
+	if createMultisigCmd.Parsed() {
+		if *multisigRequired <= 0 || *multisigKeys == "" {
+			createMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createMultisig(nodeID, *multisigRequired, strings.Split(*multisigKeys, ","))
+	}
+	if spendMultisigCmd.Parsed() {
+		if *spendMultisigFrom == "" || *spendMultisigTo == "" || *spendMultisigAmount <= 0 || *spendMultisigFee < 0 {
+			spendMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.spendMultisig(nodeID, *spendMultisigFrom, *spendMultisigTo, *spendMultisigAmount, *spendMultisigFee)
+	}
+	if signMultisigCmd.Parsed() {
+		if *signMultisigTx == "" {
+			signMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signMultisig(nodeID, *signMultisigTx)
+	}
+	if sendMultisigCmd.Parsed() {
+		if *sendMultisigTx == "" {
+			sendMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.sendMultisig(nodeID, *sendMultisigTx)
+	}
+	if createPSBTCmd.Parsed() {
+		lockTime, err := parseLockTime(*createPSBTLockTime)
+		if *createPSBTFrom == "" || *createPSBTTo == "" || *createPSBTAmount <= 0 || *createPSBTFee < 0 ||
+			err != nil || *createPSBTLockBlocks < 0 || *createPSBTLockBlocks > sequenceLockTimeMask {
+			createPSBTCmd.Usage()
+			os.Exit(1)
+		}
+		lock := TimeLock{lockTime, uint32(*createPSBTLockBlocks)}
+		cli.createPSBT(nodeID, *createPSBTFrom, *createPSBTTo, *createPSBTAmount, *createPSBTFee, lock)
+	}
+	if signPSBTCmd.Parsed() {
+		if *signPSBTData == "" {
+			signPSBTCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signPSBT(nodeID, *signPSBTData)
+	}
+	if combinePSBTCmd.Parsed() {
+		if *combinePSBTData == "" {
+			combinePSBTCmd.Usage()
+			os.Exit(1)
+		}
+		cli.combinePSBT(strings.Split(*combinePSBTData, ","))
+	}
+	if finalizePSBTCmd.Parsed() {
+		if *finalizePSBTData == "" {
+			finalizePSBTCmd.Usage()
+			os.Exit(1)
+		}
+		cli.finalizePSBT(nodeID, *finalizePSBTData, *finalizePSBTSend)
+	}
+	if createRawCmd.Parsed() {
+		lockTime, err := parseLockTime(*createRawLockTime)
+		if *createRawIn == "" || *createRawOut == "" || err != nil {
+			createRawCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createRaw(strings.Split(*createRawIn, ","), strings.Split(*createRawOut, ","), lockTime)
+	}
+	if decodeRawCmd.Parsed() {
+		if *decodeRawTx == "" {
+			decodeRawCmd.Usage()
+			os.Exit(1)
+		}
+		cli.decodeRaw(*decodeRawTx, *decodeRawJSON)
+	}
+	if signRawCmd.Parsed() {
+		if *signRawTx == "" {
+			signRawCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signRaw(nodeID, *signRawTx)
+	}
+	if sendRawCmd.Parsed() {
+		if *sendRawTx == "" {
+			sendRawCmd.Usage()
+			os.Exit(1)
+		}
+		cli.sendRaw(nodeID, *sendRawTx)
+	}
+	if benchmarkCmd.Parsed() {
+		cli.benchmark(*benchmarkThreads, *benchmarkSeconds)
+	}
 }
 
 const usage = `
 Usage:
-  start -m MINERADDRESS  			- start a new node
-  create -a ADDRESS    			  	- create the new blockchain
+  start [-m MINERADDRESS [-threads N] [-empty SECONDS]]	- start a new node, mining to MINERADDRESS with N goroutines, optionally mining empty blocks
+        [-rpcport PORT] [-rpcuser USER -rpcpassword PASS]	- serve JSON-RPC on localhost:PORT, authenticated by the cookie file or USER/PASS
+  create -a ADDRESS [-txindex] [-addrindex]	- create the new blockchain, optionally with transaction and address indexes
   createwallet  	   			  	- create the new wallet address
   list 	   			  				- list all wallet address
-  send -f FROM -t TO -a AMOUNT		- Send AMOUNT of coins from FROM address to TO
+  send -f FROM -t TO -a AMOUNT [-fee FEE | -feerate RATE]	- Send AMOUNT of coins from FROM address to TO
+       [-locktime HEIGHT|TIME|DATE | -lockblocks N]	- TO can spend the payment only after the given time, or N blocks after it confirms
   balance -a ADDRESS    			- balance of the address
-  print               			  	- print all the blocks of the blockchain
+  print [-from N] [-to M]		  	- print the blocks of the blockchain, optionally only heights N to M
+  supply               			  	- show the circulating supply at the current tip
+  migrate              			  	- re-encode a database written by an older version
+  reindex [-txindex] [-addrindex]	- rebuild the UTXO set and the enabled indexes, the flags enable an index
+  history -a ADDRESS   			  	- list the transactions of an address, needs the address index
+  gettx -id TXID       			  	- show a transaction with its block and confirmations
+  getpubkey -a ADDRESS 			  	- print the public key of a wallet address
+  createmultisig -m M -keys KEY1,KEY2,...	- create an address that needs M of the given public keys to spend
+  spendmultisig -f FROM -t TO -a AMOUNT [-fee FEE]	- build an unsigned transaction spending from multisig address FROM
+  signmultisig -tx HEX 			  	- add the signatures this wallet can make to a multisig transaction
+  sendmultisig -tx HEX 			  	- broadcast a multisig transaction once it has enough signatures
+  createpsbt -f FROM -t TO -a AMOUNT [-fee FEE]	- build a partially signed transaction without the private keys of FROM
+       [-locktime HEIGHT|TIME|DATE | -lockblocks N]	- lock the payment like send does
+  signpsbt -psbt HEX   			  	- add the signatures this wallet can make, needs no blockchain
+  combinepsbt -psbt HEX1,HEX2,...	- merge the signatures of copies signed separately
+  finalizepsbt -psbt HEX [-send]	- print the signed raw transaction, and broadcast it with -send
+  createraw -in TXID:VOUT[:SEQ],... -out ADDRESS:AMOUNT,...	- build an unsigned transaction from exact inputs and outputs
+       [-locktime HEIGHT|TIME|DATE]	- the difference between inputs and outputs is the fee
+  decoderaw -tx HEX [-json]		- print a hex transaction as text or JSON
+  signraw -tx HEX      			  	- sign the inputs this wallet has keys for
+  sendraw -tx HEX      			  	- submit a transaction and print whether the mempool accepts it and why not
+  benchmark [-threads N] [-seconds S]	- measure the proof-of-work hash rate
 `
 
 func (cli *CLI) printUsage() {
-	fmt.Println(usage)
+	fmt.Print(usage)
 }
 
 func (cli *CLI) validateArgs() {
@@ -1,53 +1,114 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"go.etcd.io/bbolt"
 	"log"
+	"math/big"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
-func (cli *CLI) printChain(nodeId string) {
-	bc := NewBlockChain(nodeId)
-	iterator := bc.Iterator()
+func (cli *CLI) printChain(nodeId string, from, to int) {
+	var bestHeight int
+	var getBlock func(height int) (*Block, error)
+
+	if rpc := connectRPC(nodeId); rpc != nil {
+		var info blockchainInfo
+		if err := rpc.Call(&info, "getblockchaininfo"); err != nil {
+			log.Panic(err)
+		}
+		bestHeight = info.Blocks
+		getBlock = func(height int) (*Block, error) {
+			var hash, data string
+			if err := rpc.Call(&hash, "getblockhash", height); err != nil {
+				return nil, err
+			}
+			if err := rpc.Call(&data, "getblock", hash, false); err != nil {
+				return nil, err
+			}
+			encoded, err := hex.DecodeString(data)
+			if err != nil {
+				return nil, err
+			}
+			return decodeBlock(encoded)
+		}
+	} else {
+		bc := NewBlockChain(nodeId)
+		defer func(bc *Blockchain) {
+			err := bc.Close()
+			if err != nil {
+				log.Panic(err)
+			}
+		}(bc)
+		bestHeight = bc.GetBestHeight()
+		getBlock = bc.GetBlockByHeight
+	}
+
+	if to < 0 || to > bestHeight {
+		to = bestHeight
+	}
+	if from < 0 {
+		from = 0
+	}
 
-	for {
-		block := iterator.Next()
+	for height := to; height >= from; height-- {
+		block, err := getBlock(height)
+		if err != nil {
+			log.Panic(err)
+		}
 
 		fmt.Printf("============ Block %x ============\n", block.HeaderHash)
+		fmt.Printf("Height: %d\n", block.Height)
 		fmt.Printf("Prev. block: %x\n", block.PrevBlockHeaderHash)
-		pow := NewPoW(block)
+		fmt.Printf("Merkle root: %x\n", block.Root)
+		fmt.Printf("Bits: %08x\n", block.Bits)
+		pow := NewPoW(&block.BlockHeader)
 		fmt.Printf("PoW: %s\n\n", strconv.FormatBool(pow.Verify()))
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
 		}
 		fmt.Printf("\n\n")
+	}
+}
 
-		if len(block.PrevBlockHeaderHash) == 0 {
-			break
-		}
+// requireOffline 在节点运行时退出，数据库被节点独占
+func requireOffline(nodeId string) {
+	if connectRPC(nodeId) != nil {
+		log.Panicf("Node %s is running, stop it first", nodeId)
 	}
 }
 
-func (cli *CLI) createBlockChain(nodeId, address string) {
+func (cli *CLI) createBlockChain(nodeId, address string, txIndex, addrIndex bool) {
 	if !ValidateAddress(address) {
 		log.Panic("Address is not valid")
 	}
+	requireOffline(nodeId)
 	bc := CreateBlockChain(nodeId, address)
-	defer func(db *bbolt.DB) {
-		err := db.Close()
+	defer func(bc *Blockchain) {
+		err := bc.Close()
 		if err != nil {
 			log.Panic(err)
 		}
-	}(bc.db)
+	}(bc)
 
 	set := UTXOSet{bc}
 	set.ReIndex()
+	if txIndex {
+		bc.ReIndexTx()
+	}
+	if addrIndex {
+		bc.ReIndexAddresses()
+	}
 
 	fmt.Println("Done!")
 }
 
-func (cli *CLI) send(nodeId, from, to string, amount int, mineNow bool) {
+func (cli *CLI) send(nodeId, from, to string, amount, fee, feeRate int, lock TimeLock, mineNow bool) {
 	if !ValidateAddress(from) {
 		log.Panic("Sender Address is not valid")
 	}
@@ -55,25 +116,48 @@ func (cli *CLI) send(nodeId, from, to string, amount int, mineNow bool) {
 		log.Panic("Recipient Address is not valid")
 	}
 
+	if rpc := connectRPC(nodeId); rpc != nil {
+		var txid string
+		if err := rpc.Call(&txid, "sendtoaddress", from, to, amount, fee, feeRate, lock.LockTime, lock.Blocks); err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Transaction %s\n", txid)
+		if mineNow {
+			if err := rpc.Call(nil, "generate", from); err != nil {
+				log.Panic(err)
+			}
+		}
+		fmt.Println("Paid Successfully!")
+		return
+	}
+
+	if !mineNow {
+		log.Panic(errNodeNotRunning)
+	}
+
 	bc := NewBlockChain(nodeId)
 	set := UTXOSet{bc}
-	defer func(db *bbolt.DB) {
-		err := db.Close()
+	defer func(bc *Blockchain) {
+		err := bc.Close()
 		if err != nil {
 			log.Panic(err)
 		}
-	}(bc.db)
+	}(bc)
 
-	tx := NewUTXOTransaction(nodeId, from, to, amount, &set)
+	tx, err := CreateTransactionFeeRate(nodeId, from, to, amount, fee, feeRate, lock, &set, nil)
+	if err != nil {
+		log.Panic(err)
+	}
 
-	if mineNow {
-		cbTx := NewCoinBaseTX(from, "")
-		txs := []*Transaction{cbTx, tx}
+	fees, err := bc.CalcFee(tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	cbTx := NewCoinBaseTX(from, "", bc.GetBestHeight()+1, fees)
+	txs := []*Transaction{cbTx, tx}
 
-		newBlock := bc.MineBlock(txs)
-		set.Update(newBlock)
-	} else {
-		sendTx(knownNodes[0], tx)
+	if _, err := bc.MineBlock(txs); err != nil {
+		log.Panic(err)
 	}
 
 	fmt.Println("Paid Successfully!")
@@ -83,24 +167,61 @@ func (cli *CLI) getBalance(nodeId, address string) {
 	if !ValidateAddress(address) {
 		log.Panic("Address is not valid")
 	}
+
+	if rpc := connectRPC(nodeId); rpc != nil {
+		var balance int
+		if err := rpc.Call(&balance, "getbalance", address); err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Balance of '%s': %d\n", address, balance)
+		return
+	}
+
 	bc := NewBlockChain(nodeId)
 	set := UTXOSet{bc}
-	defer func(db *bbolt.DB) {
-		err := db.Close()
+	defer func(bc *Blockchain) {
+		err := bc.Close()
 		if err != nil {
 			log.Panic(err)
 		}
-	}(bc.db)
+	}(bc)
 
-	publicKeyHash := GetPublicKeyHash(address)
-	UTXOs := set.FindUTXO(publicKeyHash)
-	balance := 0
-	for _, utxo := range UTXOs {
-		balance += utxo.Value
-	}
+	balance := set.GetBalance(GetPublicKeyHash(address))
 	fmt.Printf("Balance of '%s': %d\n", address, balance)
 }
 
+func (cli *CLI) history(nodeId, address string) {
+	if !ValidateAddress(address) {
+		log.Panic("Address is not valid")
+	}
+
+	var history addressHistory
+	if rpc := connectRPC(nodeId); rpc != nil {
+		if err := rpc.Call(&history, "getaddresshistory", address); err != nil {
+			log.Panic(err)
+		}
+	} else {
+		bc := NewBlockChain(nodeId)
+		defer func(bc *Blockchain) {
+			err := bc.Close()
+			if err != nil {
+				log.Panic(err)
+			}
+		}(bc)
+
+		txs, balance, err := bc.GetAddressHistory(GetPublicKeyHash(address))
+		if err != nil {
+			log.Panic(err)
+		}
+		history = newAddressHistory(txs, balance)
+	}
+
+	for _, tx := range history.Transactions {
+		fmt.Printf("%6d  %s  %+d\n", tx.Height, tx.TxID, tx.Received-tx.Spent)
+	}
+	fmt.Printf("%d transactions, balance %d\n", len(history.Transactions), history.Balance)
+}
+
 func (cli *CLI) listAddresses(nodeId string) {
 	wallets, err := NewWallets(nodeId)
 	if err != nil {
@@ -110,6 +231,9 @@ func (cli *CLI) listAddresses(nodeId string) {
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
+	for address := range wallets.Scripts {
+		fmt.Println(address)
+	}
 }
 
 func (cli *CLI) createWallet(nodeId string) {
@@ -123,14 +247,525 @@ func (cli *CLI) createWallet(nodeId string) {
 	fmt.Println("Your wallet address is", address)
 }
 
-func (cli *CLI) startNode(nodeId, minerAddress string) {
+func (cli *CLI) getPubKey(nodeId, address string) {
+	wallets, err := NewWallets(nodeId)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panicf("Address %s is not in the wallet", address)
+	}
+	fmt.Println(hex.EncodeToString(wallet.PublicKey))
+}
+
+func (cli *CLI) createMultisig(nodeId string, m int, keys []string) {
+	var pubKeys [][]byte
+	for _, key := range keys {
+		pubKey, err := hex.DecodeString(strings.TrimSpace(key))
+		if err != nil {
+			log.Panicf("Public key %q is not hex", key)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+	redeemScript, err := NewMultisigScript(m, pubKeys)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	wallets, _ := NewWallets(nodeId)
+	address := wallets.AddScript(redeemScript)
+	if err := wallets.SaveToFile(nodeId); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Address: %s\n", address)
+	fmt.Printf("Redeem script: %x\n", redeemScript)
+}
+
+func (cli *CLI) spendMultisig(nodeId, from, to string, amount, fee int) {
+	wallets, _ := NewWallets(nodeId)
+	redeemScript, ok := wallets.Scripts[from]
+	if !ok {
+		log.Panicf("Address %s is not in the wallet, add it with createmultisig", from)
+	}
+
+	tx, err := NewMultisigSpend(redeemScript, to, amount, fee, listSpendable(nodeId, from))
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println(hex.EncodeToString(tx.Serialize()))
+}
+
+func (cli *CLI) signMultisig(nodeId, txHex string) {
+	tx, err := decodeTransactionHex(txHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets, err := NewWallets(nodeId)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	added, err := SignMultisig(tx, wallets)
+	if err != nil {
+		log.Panic(err)
+	}
+	signed, required, err := MultisigStatus(tx)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Println(hex.EncodeToString(tx.Serialize()))
+	fmt.Printf("Added %d signatures, %d of %d present\n", added, signed, required)
+}
+
+func (cli *CLI) sendMultisig(nodeId, txHex string) {
+	tx, err := decodeTransactionHex(txHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := FinalizeMultisig(tx); err != nil {
+		log.Panic(err)
+	}
+
+	broadcastTx(nodeId, tx)
+	fmt.Printf("Transaction %x\n", tx.ID)
+}
+
+func listSpendable(nodeId, address string) []UnspentOutput {
+	if rpc := connectRPC(nodeId); rpc != nil {
+		var result []unspentInfo
+		if err := rpc.Call(&result, "listunspent", address); err != nil {
+			log.Panic(err)
+		}
+		var unspent []UnspentOutput
+		for _, out := range result {
+			txid, err := hex.DecodeString(out.TxID)
+			if err != nil {
+				log.Panic(err)
+			}
+			script, err := hex.DecodeString(out.ScriptPubKey)
+			if err != nil {
+				log.Panic(err)
+			}
+			entry := UTXOEntry{TXOutput{out.Value, script}, out.Height, out.Coinbase}
+			unspent = append(unspent, UnspentOutput{txid, out.Vout, entry})
+		}
+		return unspent
+	}
+
+	bc := NewBlockChain(nodeId)
+	defer func(bc *Blockchain) {
+		err := bc.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(bc)
+	return UTXOSet{bc}.FindSpendableUnspent(AddressScript(address), nil)
+}
+
+func findPrevTransactions(nodeId string, tx *Transaction) map[string]Transaction {
+	prevTXs := make(map[string]Transaction)
+	if rpc := connectRPC(nodeId); rpc != nil {
+		for _, in := range tx.Vin {
+			txid := hex.EncodeToString(in.Txid)
+			var txHex string
+			if err := rpc.Call(&txHex, "getrawtransaction", txid); err != nil {
+				log.Panic(err)
+			}
+			prevTx, err := decodeTransactionHex(txHex)
+			if err != nil {
+				log.Panic(err)
+			}
+			prevTXs[txid] = *prevTx
+		}
+		return prevTXs
+	}
+
+	bc := NewBlockChain(nodeId)
+	defer func(bc *Blockchain) {
+		err := bc.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(bc)
+	for _, in := range tx.Vin {
+		prevTx, err := bc.FindTransaction(in.Txid)
+		if err != nil {
+			log.Panic(err)
+		}
+		prevTXs[hex.EncodeToString(in.Txid)] = prevTx
+	}
+	return prevTXs
+}
+
+func broadcastTx(nodeId string, tx *Transaction) {
+	rpc := connectRPC(nodeId)
+	if rpc == nil {
+		log.Panic(errNodeNotRunning)
+	}
+	if err := rpc.Call(nil, "sendrawtransaction", hex.EncodeToString(tx.Serialize())); err != nil {
+		log.Panic(err)
+	}
+}
+
+func (cli *CLI) createPSBT(nodeId, from, to string, amount, fee int, lock TimeLock) {
+	if !ValidateAddress(from) {
+		log.Panic("Sender Address is not valid")
+	}
+	wallets, _ := NewWallets(nodeId)
+
+	unspent := listSpendable(nodeId, from)
+	tx, err := NewUnsignedTransaction(from, to, amount, fee, lock, unspent)
+	if err != nil {
+		log.Panic(err)
+	}
+	psbt, err := NewPartialTransaction(tx, findPrevTransactions(nodeId, tx), wallets.Scripts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Println(hex.EncodeToString(psbt.Serialize()))
+	fmt.Printf("Transaction %x, %d inputs, fee %d\n", psbt.Tx.ID, len(psbt.Inputs), psbt.Fee())
+}
+
+func printPSBT(psbt *PartialTransaction) {
+	fmt.Println(hex.EncodeToString(psbt.Serialize()))
+	if _, err := psbt.Finalize(); err != nil {
+		fmt.Printf("Incomplete: %v\n", err)
+	} else {
+		fmt.Println("Complete")
+	}
+}
+
+func describePSBT(psbt *PartialTransaction) {
+	fmt.Printf("Transaction %x\n", psbt.Tx.ID)
+	for i, out := range psbt.Tx.Vout {
+		to := ScriptAddress(out.ScriptPubKey)
+		if to == "" {
+			to = DisassembleScript(out.ScriptPubKey)
+		}
+		fmt.Printf("Output %d: %d to %s\n", i, out.Value, to)
+	}
+	fmt.Printf("Fee: %d\n", psbt.Fee())
+}
+
+func (cli *CLI) signPSBT(nodeId, psbtHex string) {
+	psbt, err := decodePartialTransactionHex(psbtHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	describePSBT(psbt)
+	wallets, err := NewWallets(nodeId)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	added, err := psbt.Sign(wallets)
+	if err != nil {
+		log.Panic(err)
+	}
+	printPSBT(psbt)
+	fmt.Printf("Added %d signatures\n", added)
+}
+
+func (cli *CLI) combinePSBT(psbtHexes []string) {
+	var combined *PartialTransaction
+	for _, psbtHex := range psbtHexes {
+		psbt, err := decodePartialTransactionHex(strings.TrimSpace(psbtHex))
+		if err != nil {
+			log.Panic(err)
+		}
+		if combined == nil {
+			combined = psbt
+		} else if err := combined.Combine(psbt); err != nil {
+			log.Panic(err)
+		}
+	}
+	printPSBT(combined)
+}
+
+func (cli *CLI) finalizePSBT(nodeId, psbtHex string, send bool) {
+	psbt, err := decodePartialTransactionHex(psbtHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	tx, err := psbt.Finalize()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Println(hex.EncodeToString(tx.Serialize()))
+	if send {
+		broadcastTx(nodeId, tx)
+	}
+	fmt.Printf("Transaction %x\n", tx.ID)
+}
+
+func (cli *CLI) createRaw(inputs, outputs []string, lockTime uint32) {
+	sequence := uint32(SequenceFinal)
+	if lockTime != 0 {
+		sequence = sequenceLockTimeOnly
+	}
+
+	var vin []TXInput
+	for _, s := range inputs {
+		in, err := parseRawInput(s, sequence)
+		if err != nil {
+			log.Panic(err)
+		}
+		vin = append(vin, in)
+	}
+	var vout []TXOutput
+	for _, s := range outputs {
+		out, err := parseRawOutput(s)
+		if err != nil {
+			log.Panic(err)
+		}
+		vout = append(vout, out)
+	}
+
+	tx, err := NewRawTransaction(vin, vout, lockTime)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println(hex.EncodeToString(tx.Serialize()))
+}
+
+func (cli *CLI) decodeRaw(txHex string, asJSON bool) {
+	tx, err := decodeTransactionHex(txHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	if asJSON {
+		fmt.Println(newTxJSON(tx).JSON())
+	} else {
+		fmt.Println(newTxJSON(tx))
+	}
+}
+
+func lookupSpentOutputs(nodeId string, tx *Transaction) []TXOutput {
+	var prevOuts []TXOutput
+	if rpc := connectRPC(nodeId); rpc != nil {
+		for _, in := range tx.Vin {
+			var out *unspentInfo
+			if err := rpc.Call(&out, "gettxout", hex.EncodeToString(in.Txid), in.Vout); err != nil {
+				log.Panic(err)
+			}
+			if out == nil {
+				log.Panicf("Output %x:%d is spent or unknown", in.Txid, in.Vout)
+			}
+			script, err := hex.DecodeString(out.ScriptPubKey)
+			if err != nil {
+				log.Panic(err)
+			}
+			prevOuts = append(prevOuts, TXOutput{out.Value, script})
+		}
+		return prevOuts
+	}
+
+	bc := NewBlockChain(nodeId)
+	defer func(bc *Blockchain) {
+		err := bc.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(bc)
+	for _, in := range tx.Vin {
+		entry, ok := UTXOSet{bc}.GetEntry(in.Txid, in.Vout)
+		if !ok {
+			log.Panicf("Output %x:%d is spent or unknown", in.Txid, in.Vout)
+		}
+		prevOuts = append(prevOuts, entry.Output)
+	}
+	return prevOuts
+}
+
+func (cli *CLI) signRaw(nodeId, txHex string) {
+	tx, err := decodeTransactionHex(txHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets, err := NewWallets(nodeId)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	prevOuts := lookupSpentOutputs(nodeId, tx)
+	signed := SignRawTransaction(tx, prevOuts, wallets)
+
+	fmt.Println(hex.EncodeToString(tx.Serialize()))
+	if err := verifyRawTransaction(tx, prevOuts); err != nil {
+		fmt.Printf("Incomplete: %v\n", err)
+	} else {
+		fmt.Println("Complete")
+	}
+	fmt.Printf("Signed %d inputs\n", signed)
+}
+
+func (cli *CLI) sendRaw(nodeId, txHex string) {
+	tx, err := decodeTransactionHex(txHex)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if rpc := connectRPC(nodeId); rpc != nil {
+		var txid string
+		err = rpc.Call(&txid, "sendrawtransaction", txHex)
+		var rpcErr *rpcError
+		if errors.As(err, &rpcErr) && rpcErr.Code == rpcErrTxRejected {
+			err = errors.New(rpcErr.Message)
+		}
+	} else {
+		bc := NewBlockChain(nodeId)
+		err = NewMempool(bc).Add(tx)
+		if closeErr := bc.Close(); closeErr != nil {
+			log.Panic(closeErr)
+		}
+		if err == nil {
+			fmt.Printf("Not broadcast: transaction %x passes the mempool rules, but %v\n", tx.ID, errNodeNotRunning)
+			os.Exit(1)
+		}
+	}
+
+	if err != nil {
+		fmt.Printf("Rejected: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Accepted: transaction %x\n", tx.ID)
+}
+
+func (cli *CLI) startNode(nodeId string, opts ServerOptions) {
 	fmt.Printf("Starting Node %s...\n", nodeId)
-	if len(minerAddress) > 0 {
-		if !ValidateAddress(minerAddress) {
+	if len(opts.MinerAddress) > 0 {
+		if !ValidateAddress(opts.MinerAddress) {
 			log.Panic("Address is not valid")
 		} else {
-			log.Println("Mining is on, address to receive rewards: ", minerAddress)
+			log.Println("Mining is on, address to receive rewards: ", opts.MinerAddress)
+		}
+	}
+	StartServer(nodeId, opts)
+}
+
+func (cli *CLI) getSupply(nodeId string) {
+	var height, supply int
+	if rpc := connectRPC(nodeId); rpc != nil {
+		var info blockchainInfo
+		if err := rpc.Call(&info, "getblockchaininfo"); err != nil {
+			log.Panic(err)
+		}
+		height, supply = info.Blocks, info.Supply
+	} else {
+		bc := NewBlockChain(nodeId)
+		height, supply = bc.GetBestHeight(), UTXOSet{bc}.TotalValue()
+		if err := bc.Close(); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	fmt.Printf("Height:             %d\n", height)
+	fmt.Printf("Circulating supply: %d\n", supply)
+	fmt.Printf("Issued by schedule: %d\n", IssuedSupply(height+1))
+	fmt.Printf("Next block subsidy: %d\n", BlockSubsidy(height+1))
+	fmt.Printf("Max supply:         %d\n", params.MaxSupply)
+}
+
+func (cli *CLI) migrate(nodeId string) {
+	requireOffline(nodeId)
+	err := MigrateBlockChain(nodeId)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println("Done!")
+}
+
+func (cli *CLI) reindex(nodeId string, txIndex, addrIndex bool) {
+	requireOffline(nodeId)
+	bc := NewBlockChain(nodeId)
+	defer func(bc *Blockchain) {
+		err := bc.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(bc)
+
+	UTXOSet{bc}.ReIndex()
+	fmt.Println("Rebuilt the UTXO set")
+	if txIndex || bc.HasTxIndex() {
+		bc.ReIndexTx()
+		fmt.Println("Rebuilt the transaction index")
+	}
+	if addrIndex || bc.HasAddrIndex() {
+		bc.ReIndexAddresses()
+		fmt.Println("Rebuilt the address index")
+	}
+	fmt.Println("Done!")
+}
+
+func (cli *CLI) getTx(nodeId, txidHex string) {
+	var info txInfo
+	if rpc := connectRPC(nodeId); rpc != nil {
+		if err := rpc.Call(&info, "getrawtransaction", txidHex, true); err != nil {
+			log.Panic(err)
+		}
+	} else {
+		txid, err := hex.DecodeString(txidHex)
+		if err != nil {
+			log.Panic(err)
+		}
+		bc := NewBlockChain(nodeId)
+		defer func(bc *Blockchain) {
+			err := bc.Close()
+			if err != nil {
+				log.Panic(err)
+			}
+		}(bc)
+
+		tx, loc, err := bc.FindTransactionLocation(txid)
+		if err != nil {
+			log.Panic(err)
 		}
+		info = txInfo{txidHex, hex.EncodeToString(tx.Serialize()), hex.EncodeToString(loc.BlockHash), loc.Height, bc.GetBestHeight() - loc.Height + 1}
+	}
+
+	data, err := hex.DecodeString(info.Hex)
+	if err != nil {
+		log.Panic(err)
+	}
+	tx, err := decodeTransaction(data)
+	if err != nil {
+		log.Panic(err)
 	}
-	StartServer(nodeId, minerAddress)
+	fmt.Println(tx)
+	if info.BlockHash == "" {
+		fmt.Println("In mempool, not confirmed")
+	} else {
+		fmt.Printf("Block: %s (height %d)\n", info.BlockHash, info.Height)
+		fmt.Printf("Confirmations: %d\n", info.Confirmations)
+	}
+}
+
+func (cli *CLI) benchmark(workers, seconds int) {
+	header := &BlockHeader{
+		Version:             encodingVersion,
+		PrevBlockHeaderHash: make([]byte, 32),
+		Root:                make([]byte, 32),
+		Timestamp:           time.Now().Unix(),
+		Bits:                BigToCompact(big.NewInt(1)),
+	}
+	pow := NewPoW(header)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(seconds)*time.Second)
+	defer cancel()
+
+	fmt.Printf("Hashing for %d seconds with %d goroutines...\n", seconds, workers)
+	start := time.Now()
+	_, _, err := pow.Run(ctx, workers)
+	elapsed := time.Since(start).Seconds()
+	if err != nil && err != context.DeadlineExceeded {
+		fmt.Println(err)
+	}
+
+	fmt.Printf("%d hashes in %.1fs: %.0f H/s\n", pow.Hashes(), elapsed, float64(pow.Hashes())/elapsed)
 }
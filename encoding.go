@@ -0,0 +1,553 @@
+package main
+
+// 区块与交易的规范二进制编码，交易 ID、区块哈希、Merkle 叶子、数据库和网络消息都使用它。
+// 整数为大端序定长整数，bytes 为 uint32 长度加原始字节，列表为 uint32 个数加各元素。
+//
+//	交易      uint8 版本, 输入列表 {bytes 前一笔交易 ID, int32 输出索引, bytes ScriptSig, uint32 Sequence},
+//	          输出列表 {int64 金额, bytes ScriptPubKey}, uint32 LockTime；交易 ID 为编码的 SHA-256
+//	区块头    uint8 版本, bytes 父区块哈希, bytes Merkle 根, int64 时间戳, uint32 难度, int64 nonce
+//	区块      uint8 版本, bytes 区块头, int64 高度, 交易列表 {bytes 交易}
+//	UTXO      uint8 版本, int64 高度, uint8 coinbase, int64 金额, bytes ScriptPubKey
+//	undo      uint8 版本, 输出列表 {int64 高度, uint8 coinbase, int64 金额, bytes ScriptPubKey}
+//
+// 版本 2 的交易没有 Sequence 和 LockTime，版本 1 用签名、公钥和公钥哈希代替脚本，
+// 版本 0 由 gob 时期的数据库迁移而来并保存原来的交易 ID，只能在本地读取，不能从网络接收。
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const encodingVersion = 3
+
+const minEncodingVersion = 0
+
+var errShortData = errors.New("unexpected end of data")
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) writeUint8(v uint8) {
+	e.buf.WriteByte(v)
+}
+
+func (e *encoder) writeUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) writeInt32(v int32) {
+	e.writeUint32(uint32(v))
+}
+
+func (e *encoder) writeInt64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) writeBytes(v []byte) {
+	e.writeUint32(uint32(len(v)))
+	e.buf.Write(v)
+}
+
+func (e *encoder) Bytes() []byte {
+	return e.buf.Bytes()
+}
+
+// decoder 遇到第一个错误后后续读取都返回零值，最后统一检查 err
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = errShortData
+		return nil
+	}
+	v := d.data[:n]
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) readUint8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) readUint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) readInt32() int32 {
+	return int32(d.readUint32())
+}
+
+func (d *decoder) readInt64() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (d *decoder) readBytes() []byte {
+	n := d.readUint32()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(n) > uint64(len(d.data)) {
+		d.err = errShortData
+		return nil
+	}
+	return append([]byte{}, d.next(int(n))...)
+}
+
+// readCount 在分配前拒绝伪造的超大个数，每个元素至少占 minSize 字节
+func (d *decoder) readCount(minSize int) int {
+	n := d.readUint32()
+	if d.err != nil {
+		return 0
+	}
+	if uint64(n)*uint64(minSize) > uint64(len(d.data)) {
+		d.err = errShortData
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) readVersion(what string) {
+	if v := d.readUint8(); d.err == nil && v != encodingVersion {
+		d.err = fmt.Errorf("unsupported %s encoding version %d", what, v)
+	}
+}
+
+func (d *decoder) readBlockVersion(what string) uint8 {
+	v := d.readUint8()
+	if d.err == nil && (v < minEncodingVersion || v > encodingVersion) {
+		d.err = fmt.Errorf("unsupported %s encoding version %d", what, v)
+	}
+	return v
+}
+
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = fmt.Errorf("%d trailing bytes", len(d.data))
+	}
+	return d.err
+}
+
+func encodeOutput(e *encoder, out TXOutput) {
+	e.writeInt64(int64(out.Value))
+	e.writeBytes(out.ScriptPubKey)
+}
+
+func decodeOutput(d *decoder) TXOutput {
+	value := d.readInt64()
+	scriptPubKey := d.readBytes()
+	return TXOutput{int(value), scriptPubKey}
+}
+
+func encodeTransaction(tx *Transaction) []byte {
+	if tx.Version <= 1 {
+		return encodeTransactionV1(tx)
+	}
+
+	legacy := tx.Version == 2
+	e := &encoder{}
+	if legacy {
+		e.writeUint8(2)
+	} else {
+		e.writeUint8(encodingVersion)
+	}
+
+	e.writeUint32(uint32(len(tx.Vin)))
+	for _, in := range tx.Vin {
+		e.writeBytes(in.Txid)
+		e.writeInt32(int32(in.Vout))
+		e.writeBytes(in.ScriptSig)
+		if !legacy {
+			e.writeUint32(in.Sequence)
+		}
+	}
+
+	e.writeUint32(uint32(len(tx.Vout)))
+	for _, out := range tx.Vout {
+		encodeOutput(e, out)
+	}
+	if !legacy {
+		e.writeUint32(tx.LockTime)
+	}
+
+	return e.Bytes()
+}
+
+func encodeTransactionV1(tx *Transaction) []byte {
+	e := &encoder{}
+	e.writeUint8(tx.Version)
+	if tx.Version == 0 {
+		e.writeBytes(tx.ID)
+	}
+
+	e.writeUint32(uint32(len(tx.Vin)))
+	for _, in := range tx.Vin {
+		e.writeBytes(in.Txid)
+		e.writeInt32(int32(in.Vout))
+		signature, pubKey := in.ScriptSig, []byte(nil)
+		if pushes, err := scriptPushes(in.ScriptSig); err == nil && len(pushes) == 2 {
+			signature, pubKey = pushes[0], pushes[1]
+		}
+		e.writeBytes(signature)
+		e.writeBytes(pubKey)
+	}
+
+	e.writeUint32(uint32(len(tx.Vout)))
+	for _, out := range tx.Vout {
+		e.writeInt64(int64(out.Value))
+		pubKeyHash, ok := ExtractPubKeyHash(out.ScriptPubKey)
+		if !ok {
+			pubKeyHash = out.ScriptPubKey
+		}
+		e.writeBytes(pubKeyHash)
+	}
+
+	return e.Bytes()
+}
+
+func decodeTransaction(data []byte) (Transaction, error) {
+	var tx Transaction
+	d := &decoder{data: data}
+	tx.Version = d.readBlockVersion("transaction")
+	if tx.Version == 0 {
+		tx.ID = d.readBytes()
+	}
+
+	minInputSize := 16
+	if tx.Version == 2 {
+		minInputSize = 12
+	}
+	inputs := d.readCount(minInputSize)
+	for i := 0; i < inputs; i++ {
+		in := TXInput{Sequence: SequenceFinal}
+		in.Txid = d.readBytes()
+		in.Vout = int(d.readInt32())
+		if tx.Version <= 1 {
+			signature := d.readBytes()
+			in.ScriptSig = NewP2PKHScriptSig(signature, d.readBytes())
+		} else {
+			in.ScriptSig = d.readBytes()
+		}
+		if tx.Version == encodingVersion {
+			in.Sequence = d.readUint32()
+		}
+		tx.Vin = append(tx.Vin, in)
+	}
+
+	outputs := d.readCount(12)
+	for i := 0; i < outputs; i++ {
+		if tx.Version <= 1 {
+			value := d.readInt64()
+			tx.Vout = append(tx.Vout, TXOutput{int(value), NewP2PKHScript(d.readBytes())})
+		} else {
+			tx.Vout = append(tx.Vout, decodeOutput(d))
+		}
+	}
+	if tx.Version == encodingVersion {
+		tx.LockTime = d.readUint32()
+	}
+
+	if err := d.finish(); err != nil {
+		return Transaction{}, fmt.Errorf("decode transaction: %w", err)
+	}
+	if tx.Version != encodingVersion && !bytes.Equal(encodeTransaction(&tx), data) {
+		return Transaction{}, fmt.Errorf("decode transaction: non-canonical version %d encoding", tx.Version)
+	}
+	if tx.Version != 0 {
+		hash := sha256.Sum256(data)
+		tx.ID = hash[:]
+	}
+	return tx, nil
+}
+
+func encodeBlockHeader(h *BlockHeader) []byte {
+	e := &encoder{}
+	e.writeUint8(h.Version)
+	e.writeBytes(h.PrevBlockHeaderHash)
+	e.writeBytes(h.Root)
+	e.writeInt64(h.Timestamp)
+	e.writeUint32(h.Bits)
+	e.writeInt64(int64(h.Nonce))
+	return e.Bytes()
+}
+
+func decodeBlockHeader(data []byte) (*BlockHeader, error) {
+	var h BlockHeader
+	d := &decoder{data: data}
+	h.Version = d.readBlockVersion("block header")
+	h.PrevBlockHeaderHash = d.readBytes()
+	h.Root = d.readBytes()
+	h.Timestamp = d.readInt64()
+	h.Bits = d.readUint32()
+	h.Nonce = int(d.readInt64())
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("decode block header: %w", err)
+	}
+	return &h, nil
+}
+
+func encodeBlock(b *Block) []byte {
+	e := &encoder{}
+	e.writeUint8(encodingVersion)
+	e.writeBytes(b.BlockHeader.Serialize())
+	e.writeInt64(int64(b.Height))
+
+	e.writeUint32(uint32(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		e.writeBytes(tx.Serialize())
+	}
+
+	return e.Bytes()
+}
+
+func decodeBlock(data []byte) (*Block, error) {
+	var block Block
+	d := &decoder{data: data}
+	d.readBlockVersion("block")
+
+	headerData := d.readBytes()
+	block.Height = int(d.readInt64())
+
+	count := d.readCount(4)
+	for i := 0; i < count && d.err == nil; i++ {
+		tx, err := decodeTransaction(d.readBytes())
+		if err != nil && d.err == nil {
+			d.err = err
+		}
+		block.Transactions = append(block.Transactions, &tx)
+	}
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("decode block: %w", err)
+	}
+
+	header, err := decodeBlockHeader(headerData)
+	if err != nil {
+		return nil, err
+	}
+	block.BlockHeader = *header
+	block.HeaderHash = header.Hash()
+
+	return &block, nil
+}
+
+func blockTxOffsets(b *Block) []int {
+	offset := 1 + 4 + len(b.BlockHeader.Serialize()) + 8 + 4
+	offsets := make([]int, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		offsets[i] = offset
+		offset += 4 + len(tx.Serialize())
+	}
+	return offsets
+}
+
+func decodeTransactionAt(blockData []byte, offset int) (Transaction, error) {
+	if offset < 0 || offset > len(blockData) {
+		return Transaction{}, fmt.Errorf("decode transaction: offset %d out of range", offset)
+	}
+	d := &decoder{data: blockData[offset:]}
+	data := d.readBytes()
+	if d.err != nil {
+		return Transaction{}, fmt.Errorf("decode transaction: %w", d.err)
+	}
+	return decodeTransaction(data)
+}
+
+func encodeEntry(e *encoder, entry UTXOEntry) {
+	e.writeInt64(int64(entry.Height))
+	coinbase := uint8(0)
+	if entry.Coinbase {
+		coinbase = 1
+	}
+	e.writeUint8(coinbase)
+	encodeOutput(e, entry.Output)
+}
+
+func decodeEntry(d *decoder) UTXOEntry {
+	var entry UTXOEntry
+	entry.Height = int(d.readInt64())
+	entry.Coinbase = d.readUint8() != 0
+	entry.Output = decodeOutput(d)
+	return entry
+}
+
+func encodeUTXOEntry(entry UTXOEntry) []byte {
+	e := &encoder{}
+	e.writeUint8(encodingVersion)
+	encodeEntry(e, entry)
+	return e.Bytes()
+}
+
+func decodeUTXOEntry(data []byte) (UTXOEntry, error) {
+	d := &decoder{data: data}
+	d.readVersion("utxo entry")
+	entry := decodeEntry(d)
+	if err := d.finish(); err != nil {
+		return UTXOEntry{}, fmt.Errorf("decode utxo entry: %w", err)
+	}
+	return entry, nil
+}
+
+func encodeBlockUndo(u *BlockUndo) []byte {
+	e := &encoder{}
+	e.writeUint8(encodingVersion)
+	e.writeUint32(uint32(len(u.Spent)))
+	for _, entry := range u.Spent {
+		encodeEntry(e, entry)
+	}
+	return e.Bytes()
+}
+
+func decodeBlockUndo(data []byte) (*BlockUndo, error) {
+	var undo BlockUndo
+	d := &decoder{data: data}
+	d.readVersion("block undo")
+	count := d.readCount(21)
+	for i := 0; i < count; i++ {
+		undo.Spent = append(undo.Spent, decodeEntry(d))
+	}
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("decode block undo: %w", err)
+	}
+	return &undo, nil
+}
+
+type messagePayload interface {
+	encode(e *encoder)
+	decode(d *decoder)
+}
+
+func encodeMessage(m messagePayload) []byte {
+	e := &encoder{}
+	m.encode(e)
+	return e.Bytes()
+}
+
+func decodeMessage(data []byte, m messagePayload) error {
+	d := &decoder{data: data}
+	m.decode(d)
+	if err := d.finish(); err != nil {
+		return fmt.Errorf("decode %T message: %w", m, err)
+	}
+	return nil
+}
+
+func encodeHashes(e *encoder, hashes [][]byte) {
+	e.writeUint32(uint32(len(hashes)))
+	for _, hash := range hashes {
+		e.writeBytes(hash)
+	}
+}
+
+func decodeHashes(d *decoder) [][]byte {
+	var hashes [][]byte
+	count := d.readCount(4)
+	for i := 0; i < count; i++ {
+		hashes = append(hashes, d.readBytes())
+	}
+	return hashes
+}
+
+func (m *version) encode(e *encoder) {
+	e.writeUint32(uint32(m.Version))
+	e.writeInt64(int64(m.BestHeight))
+	e.writeBytes([]byte(m.AddrFrom))
+}
+
+func (m *version) decode(d *decoder) {
+	m.Version = int(d.readUint32())
+	m.BestHeight = int(d.readInt64())
+	m.AddrFrom = string(d.readBytes())
+}
+
+func (m *inv) encode(e *encoder) {
+	e.writeBytes([]byte(m.Type))
+	encodeHashes(e, m.Items)
+}
+
+func (m *inv) decode(d *decoder) {
+	m.Type = string(d.readBytes())
+	m.Items = decodeHashes(d)
+}
+
+func (m *getdata) encode(e *encoder) {
+	e.writeBytes([]byte(m.Type))
+	e.writeBytes(m.ID)
+}
+
+func (m *getdata) decode(d *decoder) {
+	m.Type = string(d.readBytes())
+	m.ID = d.readBytes()
+}
+
+func (m *block) encode(e *encoder) {
+	e.writeBytes(m.Block)
+}
+
+func (m *block) decode(d *decoder) {
+	m.Block = d.readBytes()
+}
+
+func (m *tx) encode(e *encoder) {
+	e.writeBytes(m.Transaction)
+}
+
+func (m *tx) decode(d *decoder) {
+	m.Transaction = d.readBytes()
+}
+
+func (m *addr) encode(e *encoder) {
+	e.writeUint32(uint32(len(m.AddrList)))
+	for _, address := range m.AddrList {
+		e.writeBytes([]byte(address))
+	}
+}
+
+func (m *addr) decode(d *decoder) {
+	count := d.readCount(4)
+	for i := 0; i < count; i++ {
+		m.AddrList = append(m.AddrList, string(d.readBytes()))
+	}
+}
+
+func (m *getheaders) encode(e *encoder) {
+	encodeHashes(e, m.Locator)
+	e.writeBytes(m.StopHash)
+}
+
+func (m *getheaders) decode(d *decoder) {
+	m.Locator = decodeHashes(d)
+	m.StopHash = d.readBytes()
+}
+
+func (m *headers) encode(e *encoder) {
+	encodeHashes(e, m.Headers)
+}
+
+func (m *headers) decode(d *decoder) {
+	m.Headers = decodeHashes(d)
+}
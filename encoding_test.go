@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"reflect"
+	"testing"
+)
+
+type legacyInputV1 struct {
+	txid      []byte
+	vout      int32
+	signature []byte
+	pubKey    []byte
+}
+
+func encodeV1(inputs []legacyInputV1, values []int64, pubKeyHashes [][]byte) []byte {
+	e := &encoder{}
+	e.writeUint8(1)
+	e.writeUint32(uint32(len(inputs)))
+	for _, in := range inputs {
+		e.writeBytes(in.txid)
+		e.writeInt32(in.vout)
+		e.writeBytes(in.signature)
+		e.writeBytes(in.pubKey)
+	}
+	e.writeUint32(uint32(len(values)))
+	for i, value := range values {
+		e.writeInt64(value)
+		e.writeBytes(pubKeyHashes[i])
+	}
+	return e.Bytes()
+}
+
+func TestTransactionVersion1(t *testing.T) {
+	pubKeyHash := bytes.Repeat([]byte{0xab}, 20)
+	prevTxid := bytes.Repeat([]byte{0x01}, 32)
+	signature := bytes.Repeat([]byte{0x02}, 64)
+	pubKey := bytes.Repeat([]byte{0x03}, 64)
+
+	data := encodeV1([]legacyInputV1{{prevTxid, 1, signature, pubKey}, {prevTxid, 2, nil, nil}},
+		[]int64{7}, [][]byte{pubKeyHash})
+	tx, err := decodeTransaction(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Version != 1 || tx.LockTime != 0 || tx.Vin[0].Sequence != SequenceFinal {
+		t.Fatalf("version %d, lock time %d, sequence %x", tx.Version, tx.LockTime, tx.Vin[0].Sequence)
+	}
+	if !bytes.Equal(tx.Vin[0].ScriptSig, NewP2PKHScriptSig(signature, pubKey)) {
+		t.Fatalf("ScriptSig %x", tx.Vin[0].ScriptSig)
+	}
+	if !bytes.Equal(tx.Vout[0].ScriptPubKey, NewP2PKHScript(pubKeyHash)) {
+		t.Fatalf("ScriptPubKey %x", tx.Vout[0].ScriptPubKey)
+	}
+
+	hash := sha256.Sum256(data)
+	if !bytes.Equal(tx.ID, hash[:]) || !bytes.Equal(tx.Hash(), hash[:]) || !bytes.Equal(tx.Serialize(), data) {
+		t.Fatal("version 1 transaction does not re-encode to its original bytes")
+	}
+
+	trimmed := encodeV1([]legacyInputV1{{prevTxid, 1, nil, pubKeyHash}, {prevTxid, 2, nil, nil}},
+		[]int64{7}, [][]byte{pubKeyHash})
+	want := sha256.Sum256(trimmed)
+	if got := tx.SignatureHash(0, NewP2PKHScript(pubKeyHash)); !bytes.Equal(got, want[:]) {
+		t.Fatalf("signature hash %x, want %x", got, want)
+	}
+
+	if _, err := decodeTransaction(encodeV1(nil, []int64{7}, [][]byte{{1, 2}})); err == nil {
+		t.Fatal("version 1 output with a short public key hash decoded")
+	}
+}
+
+func TestTransactionVersion2(t *testing.T) {
+	pubKeyHash := bytes.Repeat([]byte{0xab}, 20)
+	scriptSig := NewP2PKHScriptSig(bytes.Repeat([]byte{0x02}, 64), bytes.Repeat([]byte{0x03}, 64))
+
+	e := &encoder{}
+	e.writeUint8(2)
+	e.writeUint32(1)
+	e.writeBytes(bytes.Repeat([]byte{0x01}, 32))
+	e.writeInt32(0)
+	e.writeBytes(scriptSig)
+	e.writeUint32(1)
+	e.writeInt64(7)
+	e.writeBytes(NewP2PKHScript(pubKeyHash))
+	data := e.Bytes()
+
+	tx, err := decodeTransaction(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Version != 2 || tx.LockTime != 0 || tx.Vin[0].Sequence != SequenceFinal {
+		t.Fatalf("version %d, lock time %d, sequence %x", tx.Version, tx.LockTime, tx.Vin[0].Sequence)
+	}
+	if !bytes.Equal(tx.Vin[0].ScriptSig, scriptSig) {
+		t.Fatalf("ScriptSig %x", tx.Vin[0].ScriptSig)
+	}
+
+	hash := sha256.Sum256(data)
+	if !bytes.Equal(tx.ID, hash[:]) || !bytes.Equal(tx.Serialize(), data) {
+		t.Fatal("version 2 transaction does not re-encode to its original bytes")
+	}
+
+	if _, err := decodeTransaction(data[:len(data)-1]); err == nil {
+		t.Fatal("truncated version 2 transaction decoded")
+	}
+}
+
+func TestBlockHeaderVersions(t *testing.T) {
+	for version := uint8(minEncodingVersion); version <= encodingVersion; version++ {
+		h := BlockHeader{version, []byte{1}, []byte{2}, 3, 4, 5}
+		got, err := decodeBlockHeader(h.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Version != version || !bytes.Equal(got.Hash(), h.Hash()) {
+			t.Fatalf("version %d header decoded as version %d", version, got.Version)
+		}
+	}
+	h := BlockHeader{encodingVersion + 1, nil, nil, 0, 0, 0}
+	if _, err := decodeBlockHeader(h.Serialize()); err == nil {
+		t.Fatal("future header version decoded")
+	}
+}
+
+func TestMessageEncoding(t *testing.T) {
+	hashes := [][]byte{bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)}
+	messages := []struct {
+		encoded messagePayload
+		decoded messagePayload
+	}{
+		{&version{nodeVersion, 7, "localhost:3000"}, &version{}},
+		{&inv{BLOCK, hashes}, &inv{}},
+		{&getdata{TX, hashes[0]}, &getdata{}},
+		{&block{[]byte{1, 2, 3}}, &block{}},
+		{&tx{[]byte{4, 5}}, &tx{}},
+		{&addr{[]string{"localhost:3000", "localhost:3001"}}, &addr{}},
+		{&getheaders{hashes, hashes[1]}, &getheaders{}},
+		{&headers{hashes}, &headers{}},
+	}
+	for _, m := range messages {
+		data := encodeMessage(m.encoded)
+		if err := decodeMessage(data, m.decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m.decoded, m.encoded) {
+			t.Errorf("%T decoded as %+v, want %+v", m.encoded, m.decoded, m.encoded)
+		}
+		if err := decodeMessage(append(data, 0), m.decoded); err == nil {
+			t.Errorf("%T with a trailing byte decoded", m.encoded)
+		}
+	}
+
+	e := &encoder{}
+	e.writeBytes([]byte(BLOCK))
+	e.writeUint32(1 << 30)
+	if err := decodeMessage(e.Bytes(), &inv{}); err == nil {
+		t.Error("inv with a forged item count decoded")
+	}
+}
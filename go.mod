@@ -3,7 +3,8 @@ module github.com/ozygod/ozycoin
 go 1.24.0
 
 require (
-	go.etcd.io/bbolt v1.4.0 // indirect
-	golang.org/x/crypto v0.35.0 // indirect
-	golang.org/x/sys v0.30.0 // indirect
+	go.etcd.io/bbolt v1.4.0
+	golang.org/x/crypto v0.35.0
 )
+
+require golang.org/x/sys v0.30.0 // indirect
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const maxMempoolTxs = 5000
+const maxMempoolBytes = 5 * 1024 * 1024
+
+type TxError struct {
+	Reason RejectReason
+	Detail string
+}
+
+func (e *TxError) Error() string {
+	return fmt.Sprintf("transaction rejected (%s): %s", e.Reason, e.Detail)
+}
+
+func rejectTx(reason RejectReason, format string, args ...interface{}) error {
+	return &TxError{reason, fmt.Sprintf(format, args...)}
+}
+
+type mempoolEntry struct {
+	tx      *Transaction
+	fee     int
+	size    int
+	feeRate int
+	seq     int // 加入顺序，父交易总是先于子交易
+}
+
+// Mempool 保存已校验、尚未确认的交易，输入可以来自 UTXO 集或内存池中的其他交易
+type Mempool struct {
+	mu    sync.Mutex
+	bc    *Blockchain
+	txs   map[string]*mempoolEntry
+	spent map[string]string // 输出 "txid:vout" -> 花费它的交易
+	size  int
+	seq   int
+}
+
+func NewMempool(bc *Blockchain) *Mempool {
+	return &Mempool{
+		bc:    bc,
+		txs:   make(map[string]*mempoolEntry),
+		spent: make(map[string]string),
+	}
+}
+
+func outpointKey(txid []byte, vout int) string {
+	return fmt.Sprintf("%x:%d", txid, vout)
+}
+
+// Add 校验交易并加入内存池，已满时淘汰费率更低的交易
+func (mp *Mempool) Add(tx *Transaction) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	entry, err := mp.check(tx)
+	if err != nil {
+		return err
+	}
+	if err := mp.makeRoom(entry); err != nil {
+		return err
+	}
+
+	id := hex.EncodeToString(tx.ID)
+	mp.seq++
+	entry.seq = mp.seq
+	mp.txs[id] = entry
+	mp.size += entry.size
+	for _, in := range tx.Vin {
+		mp.spent[outpointKey(in.Txid, in.Vout)] = id
+	}
+	return nil
+}
+
+func (mp *Mempool) check(tx *Transaction) (*mempoolEntry, error) {
+	set := UTXOSet{mp.bc}
+	ctx := mp.bc.nextLockContext()
+
+	if tx.IsCoinbase() {
+		return nil, rejectTx(RejectBadCoinbase, "coinbase %x outside a block", tx.ID)
+	}
+	if tx.Version != encodingVersion {
+		return nil, rejectTx(RejectMalformed, "transaction %x uses obsolete encoding version %d", tx.ID, tx.Version)
+	}
+	if len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+		return nil, rejectTx(RejectMalformed, "transaction %x has no inputs or outputs", tx.ID)
+	}
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return nil, rejectTx(RejectMalformed, "transaction %x has wrong id", tx.ID)
+	}
+	if _, ok := mp.txs[hex.EncodeToString(tx.ID)]; ok {
+		return nil, rejectTx(RejectDuplicate, "transaction %x already in mempool", tx.ID)
+	}
+	for i := range tx.Vout {
+		if _, ok := set.FindOutput(tx.ID, i); ok {
+			return nil, rejectTx(RejectDuplicate, "transaction %x already confirmed", tx.ID)
+		}
+	}
+
+	if !tx.IsFinal(ctx) {
+		return nil, rejectTx(RejectNonFinal, "transaction %x is locked until %d", tx.ID, tx.LockTime)
+	}
+
+	prevOuts := make([]TXOutput, len(tx.Vin))
+	coinHeights := make([]int, len(tx.Vin))
+	seen := make(map[string]bool)
+	inputSum := 0
+	var err error
+	for i, in := range tx.Vin {
+		txID := hex.EncodeToString(in.Txid)
+		outpoint := outpointKey(in.Txid, in.Vout)
+		if seen[outpoint] {
+			return nil, rejectTx(RejectDoubleSpend, "output %s spent twice in transaction", outpoint)
+		}
+		seen[outpoint] = true
+		if spender, ok := mp.spent[outpoint]; ok {
+			return nil, rejectTx(RejectDoubleSpend, "output %s already spent by %s", outpoint, spender)
+		}
+
+		coinHeights[i] = ctx.height
+		if parent, ok := mp.txs[txID]; ok {
+			if in.Vout < 0 || in.Vout >= len(parent.tx.Vout) {
+				return nil, rejectTx(RejectMissingInput, "output %s does not exist", outpoint)
+			}
+			prevOuts[i] = parent.tx.Vout[in.Vout]
+		} else {
+			entry, ok := set.GetEntry(in.Txid, in.Vout)
+			if !ok {
+				return nil, rejectTx(RejectMissingInput, "output %s is missing or spent", outpoint)
+			}
+			coinHeights[i] = entry.Height
+			prevOuts[i] = entry.Output
+		}
+		if inputSum, err = checkMoneyRange(inputSum, prevOuts[i].Value); err != nil {
+			return nil, rejectTx(RejectMalformed, "transaction %x input: %v", tx.ID, err)
+		}
+	}
+
+	if err := tx.checkLocks(ctx, coinHeights); err != nil {
+		return nil, rejectTx(RejectNonFinal, "transaction %x: %v", tx.ID, err)
+	}
+	if err := tx.VerifyScripts(prevOuts); err != nil {
+		return nil, rejectTx(RejectBadSignature, "transaction %x: %v", tx.ID, err)
+	}
+
+	outputSum := 0
+	for _, out := range tx.Vout {
+		if outputSum, err = checkMoneyRange(outputSum, out.Value); err != nil {
+			return nil, rejectTx(RejectMalformed, "transaction %x output: %v", tx.ID, err)
+		}
+	}
+	if outputSum > inputSum {
+		return nil, rejectTx(RejectMalformed, "transaction %x spends more than its inputs", tx.ID)
+	}
+
+	fee := inputSum - outputSum
+	size := len(tx.Serialize())
+	return &mempoolEntry{tx: tx, fee: fee, size: size, feeRate: FeeRate(fee, size)}, nil
+}
+
+func (mp *Mempool) makeRoom(entry *mempoolEntry) error {
+	if len(mp.txs)+1 <= maxMempoolTxs && mp.size+entry.size <= maxMempoolBytes {
+		return nil
+	}
+
+	ancestors := mp.ancestors(entry.tx)
+	var candidates []*mempoolEntry
+	for id, e := range mp.txs {
+		if e.feeRate < entry.feeRate && !ancestors[id] {
+			candidates = append(candidates, e)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].feeRate < candidates[j].feeRate })
+
+	evict := make(map[string]bool)
+	count, size := len(mp.txs), mp.size
+	for _, e := range candidates {
+		if count+1 <= maxMempoolTxs && size+entry.size <= maxMempoolBytes {
+			break
+		}
+		for _, id := range mp.descendants(e.tx) {
+			if ancestors[id] {
+				return rejectTx(RejectMempoolFull, "mempool is full")
+			}
+			if !evict[id] {
+				evict[id] = true
+				count--
+				size -= mp.txs[id].size
+			}
+		}
+	}
+	if count+1 > maxMempoolTxs || size+entry.size > maxMempoolBytes {
+		return rejectTx(RejectMempoolFull, "mempool is full and fee rate %d is too low", entry.feeRate)
+	}
+
+	for id := range evict {
+		fmt.Printf("Evicting transaction %s from mempool\n", id)
+		mp.remove(id)
+	}
+	return nil
+}
+
+func (mp *Mempool) ancestors(tx *Transaction) map[string]bool {
+	result := make(map[string]bool)
+	queue := []*Transaction{tx}
+	for len(queue) > 0 {
+		for _, in := range queue[0].Vin {
+			id := hex.EncodeToString(in.Txid)
+			if parent, ok := mp.txs[id]; ok && !result[id] {
+				result[id] = true
+				queue = append(queue, parent.tx)
+			}
+		}
+		queue = queue[1:]
+	}
+	return result
+}
+
+func (mp *Mempool) descendants(tx *Transaction) []string {
+	result := []string{hex.EncodeToString(tx.ID)}
+	seen := map[string]bool{result[0]: true}
+	for i := 0; i < len(result); i++ {
+		entry := mp.txs[result[i]]
+		for vout := range entry.tx.Vout {
+			child, ok := mp.spent[outpointKey(entry.tx.ID, vout)]
+			if ok && !seen[child] {
+				seen[child] = true
+				result = append(result, child)
+			}
+		}
+	}
+	return result
+}
+
+func (mp *Mempool) remove(id string) {
+	entry, ok := mp.txs[id]
+	if !ok {
+		return
+	}
+	for _, in := range entry.tx.Vin {
+		delete(mp.spent, outpointKey(in.Txid, in.Vout))
+	}
+	mp.size -= entry.size
+	delete(mp.txs, id)
+}
+
+func (mp *Mempool) Get(id []byte) (*Transaction, bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	entry, ok := mp.txs[hex.EncodeToString(id)]
+	if !ok {
+		return nil, false
+	}
+	return entry.tx, true
+}
+
+func (mp *Mempool) IsSpent(txid []byte, vout int) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	_, ok := mp.spent[outpointKey(txid, vout)]
+	return ok
+}
+
+func (mp *Mempool) Has(id []byte) bool {
+	_, ok := mp.Get(id)
+	return ok
+}
+
+func (mp *Mempool) Count() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return len(mp.txs)
+}
+
+func (mp *Mempool) Size() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.size
+}
+
+func (mp *Mempool) Transactions() []*Transaction {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.sorted()
+}
+
+func (mp *Mempool) sorted() []*Transaction {
+	var entries []*mempoolEntry
+	for _, entry := range mp.txs {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+
+	var txs []*Transaction
+	for _, entry := range entries {
+		txs = append(txs, entry.tx)
+	}
+	return txs
+}
+
+func (mp *Mempool) Sequence() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.seq
+}
+
+// BlockTemplate 按费率从高到低挑选交易，父交易总是排在子交易之前
+func (mp *Mempool) BlockTemplate(maxBytes int) ([]*Transaction, int) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	var entries []*mempoolEntry
+	for _, entry := range mp.txs {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].feeRate != entries[j].feeRate {
+			return entries[i].feeRate > entries[j].feeRate
+		}
+		return entries[i].seq < entries[j].seq
+	})
+
+	var txs []*Transaction
+	included := make(map[string]bool)
+	fees, size := 0, 0
+	for progress := true; progress; {
+		progress = false
+		for _, entry := range entries {
+			id := hex.EncodeToString(entry.tx.ID)
+			if included[id] || size+entry.size > maxBytes {
+				continue
+			}
+			ready := true
+			for _, in := range entry.tx.Vin {
+				parent := hex.EncodeToString(in.Txid)
+				if _, inPool := mp.txs[parent]; inPool && !included[parent] {
+					ready = false
+					break
+				}
+			}
+			if !ready {
+				continue
+			}
+
+			included[id] = true
+			txs = append(txs, entry.tx)
+			fees += entry.fee
+			size += entry.size
+			progress = true
+		}
+	}
+	return txs, fees
+}
+
+// RemoveForBlock 删除区块确认的交易以及与之冲突的交易
+func (mp *Mempool) RemoveForBlock(block *Block) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for _, tx := range block.Transactions {
+		mp.remove(hex.EncodeToString(tx.ID))
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Vin {
+			conflict, ok := mp.spent[outpointKey(in.Txid, in.Vout)]
+			if !ok {
+				continue
+			}
+			for _, id := range mp.descendants(mp.txs[conflict].tx) {
+				fmt.Printf("Removing conflicting transaction %s from mempool\n", id)
+				mp.remove(id)
+			}
+		}
+	}
+}
+
+// Revalidate 在重组后先放回被断开区块中的交易，再重新加入原有交易
+func (mp *Mempool) Revalidate(restored []*Transaction) {
+	mp.mu.Lock()
+	var pending []*Transaction
+	seen := make(map[string]bool)
+	for _, tx := range append(restored, mp.sorted()...) {
+		if id := hex.EncodeToString(tx.ID); !seen[id] {
+			seen[id] = true
+			pending = append(pending, tx)
+		}
+	}
+	mp.txs = make(map[string]*mempoolEntry)
+	mp.spent = make(map[string]string)
+	mp.size = 0
+	mp.mu.Unlock()
+
+	for added := true; added; {
+		added = false
+		var failed []*Transaction
+		for _, tx := range pending {
+			if mp.Add(tx) == nil {
+				added = true
+			} else {
+				failed = append(failed, tx)
+			}
+		}
+		pending = failed
+	}
+
+	if len(pending) > 0 {
+		fmt.Printf("Dropped %d transactions from mempool after reorganization\n", len(pending))
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"log"
+	"os"
+	"slices"
+)
+
+var errLegacyDatabase = errors.New("database uses a legacy encoding")
+
+// legacyTargetBits 是 gob 时期固定的难度位数
+const legacyTargetBits = 24
+
+// 以下类型对应 gob 编码的区块与交易结构，仅用于读取旧数据库
+
+type legacyTXInput struct {
+	Txid      []byte
+	Vout      int
+	Signature []byte
+	PubKey    []byte
+}
+
+type legacyTXOutput struct {
+	Value      int
+	PubKeyHash []byte
+}
+
+type legacyTransaction struct {
+	ID   []byte
+	Vin  []legacyTXInput
+	Vout []legacyTXOutput
+}
+
+type legacyBlock struct {
+	Timestamp           int64
+	PrevBlockHeaderHash []byte
+	HeaderHash          []byte
+	Root                []byte
+	Transactions        []*legacyTransaction
+	Bits                uint32
+	Nonce               int
+	Height              int
+}
+
+// MigrateBlockChain 将 gob 编码或编码版本 1、2 的数据库转换为当前的规范编码，原文件保留为 .legacy
+func MigrateBlockChain(nodeId string) error {
+	path := fmt.Sprintf(dbFile, nodeId)
+	if !doExists(path) {
+		return fmt.Errorf("%s not found", path)
+	}
+
+	version, err := readDatabaseVersion(path)
+	if err != nil {
+		return err
+	}
+
+	var blocks []*Block
+	if version == 0 {
+		blocks, err = readLegacyChain(path)
+	} else {
+		blocks, err = readChain(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	newPath := path + ".migrating"
+	_ = os.Remove(newPath)
+	db, err := bbolt.Open(newPath, 0600, nil)
+	if err != nil {
+		return err
+	}
+
+	err = storeChain(db, blocks)
+	closeErr := db.Close()
+	if err != nil {
+		_ = os.Remove(newPath)
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	err = os.Rename(path, path+".legacy")
+	if err != nil {
+		return err
+	}
+	return os.Rename(newPath, path)
+}
+
+func readDatabaseVersion(path string) (uint8, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var version uint8
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		if b == nil {
+			return fmt.Errorf("%s has no %s bucket", path, blocksBucket)
+		}
+		if v := b.Get([]byte(dbVersionKey)); len(v) == 1 {
+			version = v[0]
+		}
+		return nil
+	})
+	if err == nil && version >= encodingVersion {
+		err = fmt.Errorf("%s already uses encoding version %d", path, version)
+	}
+	return version, err
+}
+
+func readChain(path string) ([]*Block, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var chain []*Block
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		for hash := b.Get([]byte("l")); len(hash) > 0; {
+			data := b.Get(hash)
+			if data == nil {
+				return fmt.Errorf("block %x not found", hash)
+			}
+			block, err := decodeBlock(data)
+			if err != nil {
+				return fmt.Errorf("decode block %x: %w", hash, err)
+			}
+			chain = append(chain, block)
+			hash = block.PrevBlockHeaderHash
+		}
+		return nil
+	})
+	slices.Reverse(chain)
+	return chain, err
+}
+
+func readLegacyChain(path string) ([]*Block, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var chain []*legacyBlock
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		for hash := b.Get([]byte("l")); len(hash) > 0; {
+			data := b.Get(hash)
+			if data == nil {
+				return fmt.Errorf("block %x not found", hash)
+			}
+			lb, err := decodeLegacyBlock(data)
+			if err != nil {
+				return fmt.Errorf("decode block %x: %w", hash, err)
+			}
+			chain = append(chain, lb)
+			hash = lb.PrevBlockHeaderHash
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Reverse(chain)
+
+	var blocks []*Block
+	for height, lb := range chain {
+		if lb.Height != 0 && lb.Height != height {
+			return nil, fmt.Errorf("block %x claims height %d at height %d", lb.HeaderHash, lb.Height, height)
+		}
+		block, err := convertLegacyBlock(lb, height)
+		if err != nil {
+			return nil, fmt.Errorf("convert block %x: %w", lb.HeaderHash, err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func decodeLegacyBlock(data []byte) (*legacyBlock, error) {
+	var block legacyBlock
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&block)
+	return &block, err
+}
+
+func convertLegacyBlock(lb *legacyBlock, height int) (*Block, error) {
+	bits, root := lb.Bits, lb.Root
+	if bits == 0 {
+		bits = legacyTargetBits
+	}
+	if len(root) == 0 {
+		var txs [][]byte
+		for _, ltx := range lb.Transactions {
+			txs = append(txs, ltx.serialize())
+		}
+		root = NewMerkleTree(txs).root.Data
+	}
+
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:             0,
+			PrevBlockHeaderHash: lb.PrevBlockHeaderHash,
+			Root:                root,
+			Timestamp:           lb.Timestamp,
+			Bits:                bits,
+			Nonce:               lb.Nonce,
+		},
+		HeaderHash: lb.HeaderHash,
+		Height:     height,
+	}
+	for _, ltx := range lb.Transactions {
+		tx := &Transaction{ID: ltx.ID, Version: 0}
+		for _, in := range ltx.Vin {
+			tx.Vin = append(tx.Vin, TXInput{in.Txid, in.Vout, NewP2PKHScriptSig(in.Signature, in.PubKey), SequenceFinal})
+		}
+		for _, out := range ltx.Vout {
+			tx.Vout = append(tx.Vout, TXOutput{out.Value, NewP2PKHScript(out.PubKeyHash)})
+		}
+		block.Transactions = append(block.Transactions, tx)
+	}
+
+	if !bytes.Equal(block.BlockHeader.Hash(), lb.HeaderHash) {
+		return nil, fmt.Errorf("header hash does not match its contents")
+	}
+	if _, err := decodeBlock(block.Serialize()); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func (ltx *legacyTransaction) serialize() []byte {
+	type TXInput legacyTXInput
+	type TXOutput legacyTXOutput
+	type Transaction struct {
+		ID   []byte
+		Vin  []TXInput
+		Vout []TXOutput
+	}
+
+	tx := Transaction{ID: ltx.ID}
+	for _, in := range ltx.Vin {
+		tx.Vin = append(tx.Vin, TXInput(in))
+	}
+	for _, out := range ltx.Vout {
+		tx.Vout = append(tx.Vout, TXOutput(out))
+	}
+
+	var encoded bytes.Buffer
+	err := gob.NewEncoder(&encoded).Encode(&tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	return encoded.Bytes()
+}
+
+func storeChain(db *bbolt.DB, chain []*Block) error {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucket([]byte(blocksBucket))
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(dbVersionKey), []byte{encodingVersion})
+		if err != nil {
+			return err
+		}
+		return createChainBuckets(tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	bc := newBlockchain(db)
+	for _, block := range chain {
+		fmt.Printf("Migrating block %d/%d\n", block.Height+1, len(chain))
+		err = bc.updateChainstate(func(tx *bbolt.Tx) error {
+			err := bc.storeBlock(tx, block)
+			if err != nil {
+				return err
+			}
+			return bc.connectBlock(tx, block)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	bc.FlushUTXO()
+	return nil
+}
+
+func decodeLegacyBlockUndo(data []byte) *BlockUndo {
+	var undo BlockUndo
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&undo)
+	if err != nil {
+		log.Panic(err)
+	}
+	return &undo
+}
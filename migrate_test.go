@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"go.etcd.io/bbolt"
+	"math/big"
+	"testing"
+)
+
+func legacyTestBlock() *legacyBlock {
+	pubKeyHash := bytes.Repeat([]byte{0xab}, 20)
+	coinbase := &legacyTransaction{
+		bytes.Repeat([]byte{0x01}, 32),
+		[]legacyTXInput{{[]byte{}, -1, IntToHex(1), []byte("data")}},
+		[]legacyTXOutput{{50, pubKeyHash}},
+	}
+	spend := &legacyTransaction{
+		bytes.Repeat([]byte{0x02}, 32),
+		[]legacyTXInput{{bytes.Repeat([]byte{0x03}, 32), 0, bytes.Repeat([]byte{0x04}, 64), bytes.Repeat([]byte{0x05}, 64)}},
+		[]legacyTXOutput{{7, pubKeyHash}, {3, pubKeyHash}},
+	}
+
+	lb := &legacyBlock{
+		Timestamp:           1700000000,
+		PrevBlockHeaderHash: bytes.Repeat([]byte{0x06}, 32),
+		Root:                bytes.Repeat([]byte{0x07}, 32),
+		Transactions:        []*legacyTransaction{coinbase, spend},
+		Bits:                0x1f00ffff,
+		Nonce:               42,
+		Height:              1,
+	}
+	hash := sha256.Sum256(bytes.Join([][]byte{
+		lb.PrevBlockHeaderHash, lb.Root, IntToHex(lb.Timestamp), IntToHex(int64(lb.Bits)), IntToHex(int64(lb.Nonce)),
+	}, []byte{}))
+	lb.HeaderHash = hash[:]
+	return lb
+}
+
+func TestConvertLegacyBlock(t *testing.T) {
+	lb := legacyTestBlock()
+	block, err := convertLegacyBlock(lb, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodeBlock(block.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Version != 0 || !bytes.Equal(decoded.HeaderHash, lb.HeaderHash) || !bytes.Equal(decoded.Root, lb.Root) {
+		t.Fatalf("version %d block %x, want %x", decoded.Version, decoded.HeaderHash, lb.HeaderHash)
+	}
+	for i, tx := range decoded.Transactions {
+		ltx := lb.Transactions[i]
+		if tx.Version != 0 || !bytes.Equal(tx.ID, ltx.ID) {
+			t.Fatalf("transaction %d: version %d id %x, want %x", i, tx.Version, tx.ID, ltx.ID)
+		}
+		if !bytes.Equal(tx.Vin[0].ScriptSig, NewP2PKHScriptSig(ltx.Vin[0].Signature, ltx.Vin[0].PubKey)) {
+			t.Fatalf("transaction %d ScriptSig %x", i, tx.Vin[0].ScriptSig)
+		}
+	}
+	height, data, err := coinbaseData(decoded.Transactions[0].Vin[0].ScriptSig)
+	if err != nil || !bytes.Equal(height, IntToHex(1)) || string(data) != "data" {
+		t.Fatalf("coinbase height %x data %q: %v", height, data, err)
+	}
+
+	again, err := convertLegacyBlock(legacyTestBlock(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Serialize(), block.Serialize()) {
+		t.Fatal("converting the same block twice gave different encodings")
+	}
+
+	lb.Nonce++
+	if _, err := convertLegacyBlock(lb, 1); err == nil {
+		t.Fatal("block with a header hash that does not match its contents converted")
+	}
+}
+
+func baselineTestBlock(prev []byte, nonce int) *legacyBlock {
+	coinbase := &legacyTransaction{
+		bytes.Repeat([]byte{byte(nonce)}, 32),
+		[]legacyTXInput{{[]byte{}, -1, nil, []byte("data")}},
+		[]legacyTXOutput{{50, bytes.Repeat([]byte{0xab}, 20)}},
+	}
+	lb := &legacyBlock{
+		Timestamp:           1600000000,
+		PrevBlockHeaderHash: prev,
+		Transactions:        []*legacyTransaction{coinbase},
+		Nonce:               nonce,
+	}
+	root := NewMerkleTree([][]byte{coinbase.serialize()}).root.Data
+	hash := sha256.Sum256(bytes.Join([][]byte{
+		lb.PrevBlockHeaderHash, root, IntToHex(lb.Timestamp), IntToHex(legacyTargetBits), IntToHex(int64(lb.Nonce)),
+	}, []byte{}))
+	lb.HeaderHash = hash[:]
+	return lb
+}
+
+func TestReadBaselineChain(t *testing.T) {
+	genesis := baselineTestBlock([]byte{}, 1)
+	next := baselineTestBlock(genesis.HeaderHash, 2)
+
+	path := "baseline.db"
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucket([]byte(blocksBucket))
+		if err != nil {
+			return err
+		}
+		for _, lb := range []*legacyBlock{genesis, next} {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(lb); err != nil {
+				return err
+			}
+			if err := b.Put(lb.HeaderHash, buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte("l"), next.HeaderHash)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := readLegacyChain(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("read %d blocks, want 2", len(chain))
+	}
+	want := BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-legacyTargetBits))
+	for height, block := range chain {
+		if block.Height != height || block.Bits != legacyTargetBits || block.compactBits() != want {
+			t.Fatalf("block %d: height %d bits %08x", height, block.Height, block.Bits)
+		}
+	}
+	if !bytes.Equal(chain[1].PrevBlockHeaderHash, chain[0].HeaderHash) || !bytes.Equal(chain[1].HeaderHash, next.HeaderHash) {
+		t.Fatalf("block 1 %x, want %x", chain[1].HeaderHash, next.HeaderHash)
+	}
+	if next := calcNextBits(chain[1], func([]byte) (*Block, error) { return chain[0], nil }); next != want {
+		t.Fatalf("next bits %08x, want %08x", next, want)
+	}
+}
+
+func TestCheckHeaderRejectsVersion0(t *testing.T) {
+	block, err := convertLegacyBlock(legacyTestBlock(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := &Block{BlockHeader: block.BlockHeader, Height: 0}
+	err = checkHeader(block, parent, func([]byte) (*Block, error) { return parent, nil })
+	if blockErr, ok := err.(*BlockError); !ok || blockErr.Reason != RejectMalformed {
+		t.Fatalf("version 0 header: %v", err)
+	}
+}
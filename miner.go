@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const maxBlockTemplateBytes = 1024 * 1024
+const minerRestartTxs = 10
+const staleCheckInterval = 200 * time.Millisecond
+
+// Miner 在后台挖矿，主链末端变化或内存池有明显变化时重新构建模板
+type Miner struct {
+	node          *Node
+	address       string
+	workers       int
+	emptyInterval time.Duration // 大于 0 时，内存池为空也会在上一个区块之后这么久挖出空区块
+	wake          chan struct{}
+}
+
+func NewMiner(node *Node, address string, workers int, emptyInterval time.Duration) *Miner {
+	return &Miner{node, address, workers, emptyInterval, make(chan struct{}, 1)}
+}
+
+func (m *Miner) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Miner) run() {
+	for {
+		m.waitForWork()
+
+		block, seq := m.newTemplate()
+		if !m.solve(block, seq) {
+			fmt.Println("Block template is stale, rebuilding")
+			continue
+		}
+
+		if err := m.publish(block); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func (m *Miner) publish(block *Block) error {
+	if err := m.connect(block); err != nil {
+		return err
+	}
+	fmt.Printf("New block mined at height %d with %d transactions\n", block.Height, len(block.Transactions)-1)
+
+	for _, node := range m.node.getKnownNodes() {
+		if node == m.node.address {
+			continue
+		}
+		if peer, ok := m.node.dial(node); ok {
+			m.node.sendInv(peer, BLOCK, [][]byte{block.HeaderHash})
+		}
+	}
+	return nil
+}
+
+// processBlock 遇到数据库错误会 panic，用 defer 解锁
+func (m *Miner) connect(block *Block) error {
+	m.node.mu.Lock()
+	defer m.node.mu.Unlock()
+	return m.node.processBlock(block)
+}
+
+func (m *Miner) waitForWork() {
+	for m.node.mempool.Count() == 0 {
+		if m.emptyInterval <= 0 {
+			<-m.wake
+			continue
+		}
+
+		tip, err := m.node.bc.findBlock(m.node.bc.getTip())
+		if err != nil {
+			log.Panic(err)
+		}
+		wait := time.Until(time.Unix(tip.Timestamp, 0).Add(m.emptyInterval))
+		if wait <= 0 {
+			return
+		}
+		select {
+		case <-m.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (m *Miner) newTemplate() (*Block, int) {
+	bc := m.node.bc
+	seq := m.node.mempool.Sequence()
+
+	parent, err := bc.findBlock(bc.getTip())
+	if err != nil {
+		log.Panic(err)
+	}
+	txs, fees := m.node.mempool.BlockTemplate(maxBlockTemplateBytes)
+	cbTx := NewCoinBaseTX(m.address, "", parent.Height+1, fees)
+	txs = append([]*Transaction{cbTx}, txs...)
+
+	return NewBlockTemplate(parent.HeaderHash, parent.Height+1, bc.CalcNextBits(parent), bc.NextBlockTime(parent), txs), seq
+}
+
+func (m *Miner) stale(block *Block, seq int) bool {
+	if !bytes.Equal(m.node.bc.getTip(), block.PrevBlockHeaderHash) {
+		return true
+	}
+	changes := m.node.mempool.Sequence() - seq
+	return changes >= minerRestartTxs || (changes > 0 && len(block.Transactions) == 1)
+}
+
+func (m *Miner) solve(block *Block, seq int) bool {
+	ctx, cancel := context.WithCancel(m.node.ctx)
+	defer cancel()
+
+	go func() {
+		ticker := time.NewTicker(staleCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if m.stale(block, seq) {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	fmt.Printf("Mining a new block at height %d with %d transactions\n", block.Height, len(block.Transactions)-1)
+	return block.Mine(ctx, m.workers) == nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMineTemplate(t *testing.T) {
+	bc, w := newTestChain(t, "miner")
+	defer bc.Close()
+	address := string(w.GetAddress())
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coinbases := []*Transaction{genesis.Transactions[0]}
+	for height := 1; height <= 4; height++ {
+		coinbase := NewCoinBaseTX(address, "", height, 0)
+		if _, err := bc.MineBlock([]*Transaction{coinbase}); err != nil {
+			t.Fatal(err)
+		}
+		coinbases = append(coinbases, coinbase)
+	}
+
+	n := NewNode("miner-node", bc)
+	for _, coinbase := range coinbases {
+		if err := n.mempool.Add(testSpend(w, coinbase, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewMiner(n, address, 2, 0)
+	block, seq := m.newTemplate()
+	if len(block.Transactions) != len(coinbases)+1 {
+		t.Fatalf("template has %d transactions, want %d", len(block.Transactions), len(coinbases)+1)
+	}
+	if !m.solve(block, seq) {
+		t.Fatal("template went stale")
+	}
+	if err := m.connect(block); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bc.getTip(), block.HeaderHash) {
+		t.Fatalf("tip %x, want %x", bc.getTip(), block.HeaderHash)
+	}
+	if n.mempool.Count() != 0 {
+		t.Errorf("%d transactions left in the mempool", n.mempool.Count())
+	}
+
+	n.stop()
+	if block, seq := m.newTemplate(); m.solve(block, seq) {
+		t.Error("mined a block after the node stopped")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+func NewMultisigSpend(redeemScript []byte, to string, amount, fee int, unspent []UnspentOutput) (*Transaction, error) {
+	if _, _, ok := parseMultisigScript(redeemScript); !ok {
+		return nil, errors.New("not a multisig redeem script")
+	}
+
+	tx, err := NewUnsignedTransaction(NewScriptHashAddress(redeemScript), to, amount, fee, TimeLock{}, unspent)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tx.Vin {
+		tx.Vin[i].ScriptSig = pushData(nil, redeemScript)
+	}
+	tx.ID = tx.Hash()
+	return tx, nil
+}
+
+type multisigInput struct {
+	redeemScript []byte
+	m            int
+	pubKeys      [][]byte
+	signatures   [][]byte
+	hash         []byte
+}
+
+func parseMultisigInput(tx *Transaction, inIdx int) (*multisigInput, error) {
+	pushes, err := scriptPushes(tx.Vin[inIdx].ScriptSig)
+	if err != nil {
+		return nil, fmt.Errorf("input %d: %w", inIdx, err)
+	}
+	if len(pushes) == 0 {
+		return nil, fmt.Errorf("input %d has no redeem script", inIdx)
+	}
+
+	in := &multisigInput{redeemScript: pushes[len(pushes)-1]}
+	var ok bool
+	in.m, in.pubKeys, ok = parseMultisigScript(in.redeemScript)
+	if !ok {
+		return nil, fmt.Errorf("input %d does not spend a multisig output", inIdx)
+	}
+	in.signatures = make([][]byte, len(in.pubKeys))
+	in.hash = tx.SignatureHash(inIdx, NewP2SHScript(in.redeemScript))
+
+	for _, signature := range pushes[:len(pushes)-1] {
+		for k, pubKey := range in.pubKeys {
+			if in.signatures[k] == nil && checkSignature(signature, pubKey, in.hash) {
+				in.signatures[k] = signature
+				break
+			}
+		}
+	}
+	return in, nil
+}
+
+func (in *multisigInput) count() int {
+	n := 0
+	for _, signature := range in.signatures {
+		if signature != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func multisigScriptSig(redeemScript []byte, signatures [][]byte, m int) ([]byte, int) {
+	var script []byte
+	n := 0
+	for _, signature := range signatures {
+		if signature != nil && n < m {
+			script = pushData(script, signature)
+			n++
+		}
+	}
+	return pushData(script, redeemScript), n
+}
+
+// SignMultisig 按公钥在赎回脚本中的顺序插入新签名，返回新增的签名个数
+func SignMultisig(tx *Transaction, wallets *Wallets) (int, error) {
+	added := 0
+	for inIdx := range tx.Vin {
+		in, err := parseMultisigInput(tx, inIdx)
+		if err != nil {
+			return 0, err
+		}
+		for k, pubKey := range in.pubKeys {
+			if in.signatures[k] != nil {
+				continue
+			}
+			if wallet := findWalletByPubKey(wallets, pubKey); wallet != nil {
+				in.signatures[k] = signHash(wallet.PrivateKey, in.hash)
+				added++
+			}
+		}
+		tx.Vin[inIdx].ScriptSig, _ = multisigScriptSig(in.redeemScript, in.signatures, len(in.pubKeys))
+	}
+	tx.ID = tx.Hash()
+	return added, nil
+}
+
+func MultisigStatus(tx *Transaction) (int, int, error) {
+	signed, required := -1, 0
+	for inIdx := range tx.Vin {
+		in, err := parseMultisigInput(tx, inIdx)
+		if err != nil {
+			return 0, 0, err
+		}
+		if signed < 0 || in.count() < signed {
+			signed = in.count()
+		}
+		required = max(required, in.m)
+	}
+	return max(signed, 0), required, nil
+}
+
+// FinalizeMultisig 检查每个输入都有 m 个签名，并只保留 m 个
+func FinalizeMultisig(tx *Transaction) error {
+	for inIdx := range tx.Vin {
+		in, err := parseMultisigInput(tx, inIdx)
+		if err != nil {
+			return err
+		}
+		scriptSig, n := multisigScriptSig(in.redeemScript, in.signatures, in.m)
+		if n < in.m {
+			return fmt.Errorf("input %d has %d of %d signatures", inIdx, n, in.m)
+		}
+		tx.Vin[inIdx].ScriptSig = scriptSig
+	}
+	tx.ID = tx.Hash()
+	return nil
+}
+
+func decodeTransactionHex(txHex string) (*Transaction, error) {
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, fmt.Errorf("transaction is not hex: %w", err)
+	}
+	tx, err := decodeTransaction(data)
+	if err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
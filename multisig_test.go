@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestMultisigSpend(t *testing.T) {
+	bc, w := newTestChain(t, "multisig")
+	defer bc.Close()
+	address := string(w.GetAddress())
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signers := []*Wallet{newTestWallet(), newTestWallet(), newTestWallet()}
+	redeemScript, err := NewMultisigScript(2, [][]byte{signers[0].PublicKey, signers[1].PublicKey, signers[2].PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	multisigAddress := NewScriptHashAddress(redeemScript)
+	if !ValidateAddress(multisigAddress) {
+		t.Fatalf("multisig address %s is not valid", multisigAddress)
+	}
+	if !bytes.Equal(AddressScript(multisigAddress), NewP2SHScript(redeemScript)) {
+		t.Fatal("multisig address does not pay to the redeem script")
+	}
+
+	funding := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(multisigAddress, "", 1, 0)})
+	if _, err := bc.AddBlock(funding); err != nil {
+		t.Fatal(err)
+	}
+	unspent := UTXOSet{bc}.FindSpendableUnspent(AddressScript(multisigAddress), nil)
+	tx, err := NewMultisigSpend(redeemScript, address, 10, 1, unspent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMultisigSpend(NewP2PKHScript(HashPubKey(w.PublicKey)), address, 10, 1, unspent); err == nil {
+		t.Fatal("spend built from a non-multisig redeem script")
+	}
+
+	sign := func(tx *Transaction, signer *Wallet, want int) *Transaction {
+		tx, err := decodeTransactionHex(hex.EncodeToString(tx.Serialize()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		added, err := SignMultisig(tx, testWallets(signer))
+		if err != nil || added != want {
+			t.Fatalf("added %d signatures, %v, want %d", added, err, want)
+		}
+		return tx
+	}
+	tx = sign(tx, signers[2], 1)
+	tx = sign(tx, signers[2], 0)
+	if signed, required, err := MultisigStatus(tx); err != nil || signed != 1 || required != 2 {
+		t.Fatalf("status %d of %d, %v", signed, required, err)
+	}
+	if err := FinalizeMultisig(tx); err == nil {
+		t.Fatal("transaction with one signature finalized")
+	}
+	if reason, _ := txRejectReason(NewMempool(bc).Add(tx)); reason != RejectBadSignature {
+		t.Fatalf("got %s, want %s", reason, RejectBadSignature)
+	}
+
+	tx = sign(sign(tx, signers[0], 1), signers[1], 1)
+	if err := FinalizeMultisig(tx); err != nil {
+		t.Fatal(err)
+	}
+	pushes, err := scriptPushes(tx.Vin[0].ScriptSig)
+	if err != nil || len(pushes) != 3 {
+		t.Fatalf("finalized ScriptSig has %d pushes, %v", len(pushes), err)
+	}
+	if err := NewMempool(bc).Add(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := *tx
+	forged.Vin = []TXInput{tx.Vin[0]}
+	forged.Vin[0].ScriptSig = pushData(pushData(pushData(nil, pushes[1]), pushes[0]), redeemScript)
+	forged.ID = forged.Hash()
+	if reason, _ := txRejectReason(NewMempool(bc).Add(&forged)); reason != RejectBadSignature {
+		t.Fatalf("signatures out of order: got %s, want %s", reason, RejectBadSignature)
+	}
+
+	block := mineTestBlock(bc, funding, []*Transaction{NewCoinBaseTX(address, "", 2, 1), tx})
+	if _, err := bc.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := (UTXOSet{bc}).FindOutput(funding.Transactions[0].ID, 0); ok {
+		t.Error("multisig output is still unspent")
+	}
+	if got := (UTXOSet{bc}).GetBalance(HashPubKey(redeemScript)); got != funding.Transactions[0].Vout[0].Value-11 {
+		t.Errorf("multisig balance %d, want %d", got, funding.Transactions[0].Vout[0].Value-11)
+	}
+}
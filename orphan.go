@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+const maxOrphanBlocks = 100
+
+// orphanPool 按缺失的父区块哈希索引孤块，由 Node.mu 保护
+type orphanPool struct {
+	byHash   map[string]*Block
+	byParent map[string][]*Block
+}
+
+func newOrphanPool() orphanPool {
+	return orphanPool{
+		byHash:   make(map[string]*Block),
+		byParent: make(map[string][]*Block),
+	}
+}
+
+func (o *orphanPool) add(block *Block) {
+	if _, ok := o.byHash[hex.EncodeToString(block.HeaderHash)]; ok {
+		return
+	}
+	if len(o.byHash) >= maxOrphanBlocks {
+		for _, evicted := range o.byHash {
+			o.remove(evicted)
+			break
+		}
+	}
+
+	o.byHash[hex.EncodeToString(block.HeaderHash)] = block
+	parent := hex.EncodeToString(block.PrevBlockHeaderHash)
+	o.byParent[parent] = append(o.byParent[parent], block)
+}
+
+func (o *orphanPool) get(hash []byte) (*Block, bool) {
+	block, ok := o.byHash[hex.EncodeToString(hash)]
+	return block, ok
+}
+
+func (o *orphanPool) remove(block *Block) {
+	delete(o.byHash, hex.EncodeToString(block.HeaderHash))
+
+	parent := hex.EncodeToString(block.PrevBlockHeaderHash)
+	var siblings []*Block
+	for _, orphan := range o.byParent[parent] {
+		if !bytes.Equal(orphan.HeaderHash, block.HeaderHash) {
+			siblings = append(siblings, orphan)
+		}
+	}
+	if len(siblings) == 0 {
+		delete(o.byParent, parent)
+	} else {
+		o.byParent[parent] = siblings
+	}
+}
+
+func (o *orphanPool) takeChildren(parent []byte) []*Block {
+	children := o.byParent[hex.EncodeToString(parent)]
+	for _, child := range children {
+		o.remove(child)
+	}
+	return children
+}
+
+func (n *Node) addOrphan(block *Block) error {
+	pow := NewPoW(&block.BlockHeader)
+	if !pow.Verify() || !bytes.Equal(pow.Hash(), block.HeaderHash) {
+		return rejectBlock(RejectBadPoW, "orphan %x has invalid proof of work", block.HeaderHash)
+	}
+
+	n.orphans.add(block)
+	fmt.Printf("Block %x is an orphan, %d orphans waiting for parents\n", block.HeaderHash, len(n.orphans.byHash))
+	return nil
+}
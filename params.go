@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// ChainParams 定义链的共识参数
+type ChainParams struct {
+	PowLimit           *big.Int
+	GenesisBits        uint32
+	TargetSpacing      int64
+	RetargetInterval   int
+	MaxRetargetFactor  int64
+	MaxFutureBlockTime int64
+	MedianTimeSpan     int
+	InitialSubsidy     int
+	HalvingInterval    int
+	MaxSupply          int
+}
+
+var params = ChainParams{
+	PowLimit:           new(big.Int).Lsh(big.NewInt(1), 256-16),
+	GenesisBits:        BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-24)),
+	TargetSpacing:      60,
+	RetargetInterval:   20,
+	MaxRetargetFactor:  4,
+	MaxFutureBlockTime: 2 * 60 * 60,
+	MedianTimeSpan:     11,
+	InitialSubsidy:     50,
+	HalvingInterval:    210000,
+	MaxSupply:          21000000,
+}
+
+func BlockSubsidy(height int) int {
+	subsidy := scheduledSubsidy(height)
+	if remaining := params.MaxSupply - IssuedSupply(height); subsidy > remaining {
+		subsidy = max(remaining, 0)
+	}
+	return subsidy
+}
+
+func IssuedSupply(height int) int {
+	issued := 0
+	for start := 0; start < height; start += params.HalvingInterval {
+		subsidy := scheduledSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+		issued += subsidy * min(params.HalvingInterval, height-start)
+	}
+	return min(issued, params.MaxSupply)
+}
+
+// checkMoneyRange 把 value 加到 sum 上，先与上限比较再相加，不会溢出
+func checkMoneyRange(sum, value int) (int, error) {
+	if value < 0 || value > params.MaxSupply {
+		return sum, fmt.Errorf("amount %d is out of range", value)
+	}
+	if sum < 0 || sum > params.MaxSupply-value {
+		return sum, fmt.Errorf("total %d + %d exceeds the maximum supply", sum, value)
+	}
+	return sum + value, nil
+}
+
+func scheduledSubsidy(height int) int {
+	halvings := height / params.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return params.InitialSubsidy >> halvings
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 消息帧：魔数、12 字节命令名、负载长度、负载的双 SHA-256 前 4 字节、负载
+const networkMagic = 0x6f7a7963
+const messageHeaderLength = 4 + commandLength + 4 + 4
+const maxMessageSize = 32 * 1024 * 1024
+const sendQueueSize = 128
+const dialTimeout = 5 * time.Second
+
+var errBadMagic = errors.New("bad network magic")
+var errBadChecksum = errors.New("bad payload checksum")
+
+func messageChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
+
+func writeMessage(w io.Writer, command string, payload []byte) error {
+	if len(payload) > maxMessageSize {
+		return fmt.Errorf("%s message of %d bytes exceeds the maximum size", command, len(payload))
+	}
+
+	var header bytes.Buffer
+	_ = binary.Write(&header, binary.BigEndian, uint32(networkMagic))
+	header.Write(commandToBytes(command))
+	_ = binary.Write(&header, binary.BigEndian, uint32(len(payload)))
+	header.Write(messageChecksum(payload))
+
+	_, err := w.Write(append(header.Bytes(), payload...))
+	return err
+}
+
+func readMessage(r io.Reader) (string, []byte, error) {
+	header := make([]byte, messageHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, err
+	}
+
+	if binary.BigEndian.Uint32(header[:4]) != networkMagic {
+		return "", nil, errBadMagic
+	}
+	command := bytesToCommand(header[4 : 4+commandLength])
+	length := binary.BigEndian.Uint32(header[4+commandLength:])
+	checksum := header[8+commandLength:]
+
+	if length > maxMessageSize {
+		return "", nil, fmt.Errorf("%s message of %d bytes exceeds the maximum size", command, length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(checksum, messageChecksum(payload)) {
+		return "", nil, errBadChecksum
+	}
+
+	return command, payload, nil
+}
+
+type message struct {
+	command string
+	payload []byte
+}
+
+type Peer struct {
+	node       *Node
+	addr       string // 主动连接时对方的监听地址，入站连接为空
+	listenAddr string // version 中对方的监听地址，只由读循环访问
+	conn       net.Conn
+	sendQueue  chan message
+	quit       chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func (n *Node) newPeer(conn net.Conn, addr string) *Peer {
+	return &Peer{
+		node:      n,
+		addr:      addr,
+		conn:      conn,
+		sendQueue: make(chan message, sendQueueSize),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (p *Peer) start() {
+	go p.writeLoop()
+	go p.readLoop()
+}
+
+func (p *Peer) readLoop() {
+	defer p.Close()
+
+	for {
+		command, payload, err := readMessage(p.conn)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Disconnecting %s: %v\n", p, err)
+			}
+			return
+		}
+
+		if err := p.node.handleMessage(p, command, payload); err != nil {
+			log.Printf("Disconnecting %s: bad %s message: %v\n", p, command, err)
+			return
+		}
+	}
+}
+
+func (p *Peer) writeLoop() {
+	defer close(p.done)
+	defer p.conn.Close()
+
+	for {
+		select {
+		case msg := <-p.sendQueue:
+			if err := writeMessage(p.conn, msg.command, msg.payload); err != nil {
+				log.Printf("Disconnecting %s: %v\n", p, err)
+				p.Close()
+				return
+			}
+		case <-p.quit:
+			for {
+				select {
+				case msg := <-p.sendQueue:
+					if writeMessage(p.conn, msg.command, msg.payload) != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Send 把消息放入发送队列，队列已满时断开连接
+func (p *Peer) Send(command string, payload []byte) bool {
+	select {
+	case <-p.quit:
+		return false
+	default:
+	}
+
+	select {
+	case p.sendQueue <- message{command, payload}:
+		return true
+	default:
+		log.Printf("Disconnecting %s: send queue is full\n", p)
+		p.Close()
+		return false
+	}
+}
+
+func (p *Peer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.node.removePeer(p)
+	})
+}
+
+func (p *Peer) closed() bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Peer) Wait() {
+	<-p.done
+}
+
+func (p *Peer) String() string {
+	if p.addr != "" {
+		return p.addr
+	}
+	return p.conn.RemoteAddr().String()
+}
+
+// getPeer 拨号时不持有 peersMu，同一地址已有连接时关闭新连接
+func (n *Node) getPeer(addr string) (*Peer, error) {
+	n.peersMu.Lock()
+	p, ok := n.peers[addr]
+	n.peersMu.Unlock()
+	if ok {
+		return p, nil
+	}
+
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	if p, ok := n.peers[addr]; ok {
+		conn.Close()
+		return p, nil
+	}
+	p = n.newPeer(conn, addr)
+	n.peers[addr] = p
+	p.start()
+	return p, nil
+}
+
+func (n *Node) registerPeer(addr string, p *Peer) {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	if addr == "" {
+		return
+	}
+	if _, ok := n.peers[addr]; !ok {
+		n.peers[addr] = p
+	}
+}
+
+func (n *Node) removePeer(p *Peer) {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	for addr, peer := range n.peers {
+		if peer == p {
+			delete(n.peers, addr)
+		}
+	}
+}
+
+func (n *Node) closePeers() {
+	n.peersMu.Lock()
+	var all []*Peer
+	for _, p := range n.peers {
+		all = append(all, p)
+	}
+	n.peersMu.Unlock()
+
+	for _, p := range all {
+		p.Close()
+		p.Wait()
+	}
+}
+
+type peerInfo struct {
+	Addr    string `json:"addr"`
+	Inbound bool   `json:"inbound"`
+}
+
+func (n *Node) peerInfo() []peerInfo {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	info := []peerInfo{}
+	for addr, p := range n.peers {
+		info = append(info, peerInfo{addr, p.addr == ""})
+	}
+	sort.Slice(info, func(i, j int) bool { return info[i].Addr < info[j].Addr })
+	return info
+}
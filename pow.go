@@ -1,69 +1,221 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
-	"fmt"
+	"encoding/binary"
+	"errors"
 	"math"
 	"math/big"
+	"sync"
+	"sync/atomic"
 )
 
-const targetBits = 24
-const maxNonce = math.MaxInt64
+// maxNonce 用尽后由矿工更新 coinbase 中的 extranonce，测试中会调小
+var maxNonce = math.MaxUint32
+
+const hashCheckInterval = 1 << 14
+
+var errNonceExhausted = errors.New("nonce space exhausted")
 
 type PoW struct {
-	block  *Block
+	header *BlockHeader
 	target *big.Int
+	hashes uint64
 }
 
-func NewPoW(block *Block) *PoW {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
+func NewPoW(header *BlockHeader) *PoW {
+	target := CompactToBig(header.compactBits())
 
-	return &PoW{block, target}
+	return &PoW{header: header, target: target}
 }
 
 func (pow *PoW) prepareData(nonce int) []byte {
-	data := bytes.Join([][]byte{
-		pow.block.PrevBlockHeaderHash,
-		pow.block.HashTransactions(),
-		IntToHex(pow.block.Timestamp),
-		IntToHex(int64(targetBits)),
-		IntToHex(int64(nonce)),
-	}, []byte{})
-	return data
+	header := *pow.header
+	header.Nonce = nonce
+	return header.Serialize()
 }
 
-func (pow *PoW) Run() (int, []byte) {
-	var hashInt big.Int
-	var hash [32]byte
-	nonce := 0
+// Run 用 workers 个 goroutine 并行搜索 nonce，ctx 取消时返回 ctx.Err()，找不到时返回 errNonceExhausted
+func (pow *PoW) Run(ctx context.Context, workers int) (int, []byte, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	prefix := pow.prepareData(0)
+	prefix = prefix[:len(prefix)-8]
 
-	fmt.Printf("Mining a new block\n")
-	for nonce < maxNonce {
-		data := pow.prepareData(nonce)
-		hash = sha256.Sum256(data)
-		hashInt.SetBytes(hash[:])
+	searchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		if hashInt.Cmp(pow.target) == -1 {
-			fmt.Printf("\r%x", hash)
-			break
-		} else {
-			nonce++
-		}
+	type solution struct {
+		nonce int
+		hash  []byte
+	}
+	found := make(chan solution, workers)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+
+			data := make([]byte, len(prefix)+8)
+			copy(data, prefix)
+			var hashInt big.Int
+			tried := uint64(0)
+			defer func() { atomic.AddUint64(&pow.hashes, tried) }()
+
+			for nonce := start; nonce <= maxNonce; nonce += workers {
+				if tried%hashCheckInterval == 0 && searchCtx.Err() != nil {
+					return
+				}
+				binary.BigEndian.PutUint64(data[len(prefix):], uint64(nonce))
+				hash := sha256.Sum256(data)
+				tried++
+
+				hashInt.SetBytes(hash[:])
+				if hashInt.Cmp(pow.target) == -1 {
+					found <- solution{nonce, hash[:]}
+					cancel()
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	select {
+	case s := <-found:
+		return s.nonce, s.hash, nil
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
 	}
-	fmt.Printf("\n\n")
-	return nonce, hash[:]
+	return 0, nil, errNonceExhausted
+}
+
+func (pow *PoW) Hashes() uint64 {
+	return atomic.LoadUint64(&pow.hashes)
+}
+
+// Work 返回期望计算量 2^256 / (target+1)
+func (pow *PoW) Work() *big.Int {
+	if pow.target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, new(big.Int).Add(pow.target, big.NewInt(1)))
+}
+
+func (pow *PoW) Hash() []byte {
+	return pow.header.Hash()
 }
 
 func (pow *PoW) Verify() bool {
 	var hashInt big.Int
 
-	data := pow.prepareData(pow.block.Nonce)
-	hash := sha256.Sum256(data)
-	hashInt.SetBytes(hash[:])
+	if pow.target.Sign() <= 0 || pow.target.Cmp(params.PowLimit) > 0 {
+		return false
+	}
+
+	hashInt.SetBytes(pow.Hash())
 
 	isValid := hashInt.Cmp(pow.target) == -1
 
 	return isValid
 }
+
+// CompactToBig 将 32 位紧凑格式（与比特币 nBits 相同）转换为目标值
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	exponent := uint(compact >> 24)
+	isNegative := compact&0x00800000 != 0
+
+	var target *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = big.NewInt(int64(mantissa))
+	} else {
+		target = big.NewInt(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+
+	if isNegative {
+		target = target.Neg(target)
+	}
+	return target
+}
+
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Set(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Bits()[0])
+	}
+
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+func (h *BlockHeader) compactBits() uint32 {
+	if h.Version == 0 && h.Bits == legacyTargetBits {
+		return BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-legacyTargetBits))
+	}
+	return h.Bits
+}
+
+// CalcNextBits 每 RetargetInterval 个区块根据实际用时向 TargetSpacing 调整一次难度
+func (bc *Blockchain) CalcNextBits(parent *Block) uint32 {
+	return calcNextBits(parent, bc.findBlock)
+}
+
+func calcNextBits(parent *Block, lookup blockLookup) uint32 {
+	height := parent.Height + 1
+	if height%params.RetargetInterval != 0 {
+		return parent.compactBits()
+	}
+
+	first := parent
+	for i := 0; i < params.RetargetInterval-1; i++ {
+		prev, err := lookup(first.PrevBlockHeaderHash)
+		if err != nil {
+			break
+		}
+		first = prev
+	}
+
+	expected := params.TargetSpacing * int64(params.RetargetInterval)
+	actual := parent.Timestamp - first.Timestamp
+	if actual < expected/params.MaxRetargetFactor {
+		actual = expected / params.MaxRetargetFactor
+	}
+	if actual > expected*params.MaxRetargetFactor {
+		actual = expected * params.MaxRetargetFactor
+	}
+
+	target := CompactToBig(parent.compactBits())
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if target.Cmp(params.PowLimit) > 0 {
+		target.Set(params.PowLimit)
+	}
+
+	return BigToCompact(target)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testTemplate(data string, target *big.Int) *Block {
+	coinbase := NewCoinBaseTX(string(newTestWallet().GetAddress()), data, 1, 0)
+	return NewBlockTemplate(make([]byte, 32), 1, BigToCompact(target), time.Now().Unix(), []*Transaction{coinbase})
+}
+
+func TestPoWCancel(t *testing.T) {
+	block := testTemplate("", big.NewInt(1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := NewPoW(&block.BlockHeader).Run(ctx, 4); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled run: got %v, want %v", err, context.Canceled)
+	}
+	if err := block.Mine(ctx, 4); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled mine: got %v, want %v", err, context.Canceled)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	pow := NewPoW(&block.BlockHeader)
+	if _, _, err := pow.Run(ctx, 4); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("run past deadline: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if pow.Hashes() == 0 {
+		t.Error("no hashes counted before the deadline")
+	}
+}
+
+func TestPoWWorkers(t *testing.T) {
+	block := testTemplate("", new(big.Int).Lsh(big.NewInt(1), 248))
+
+	var first int
+	for _, workers := range []int{1, 2, 4, 7} {
+		header := block.BlockHeader
+		nonce, hash, err := NewPoW(&header).Run(context.Background(), workers)
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		header.Nonce = nonce
+		if !bytes.Equal(hash, header.Hash()) {
+			t.Errorf("%d workers: hash %x, want %x", workers, hash, header.Hash())
+		}
+		if !NewPoW(&header).Verify() {
+			t.Errorf("%d workers: nonce %d does not meet the target", workers, nonce)
+		}
+		if workers == 1 {
+			first = nonce
+		} else if nonce < first {
+			t.Errorf("%d workers: nonce %d is below the first valid nonce %d", workers, nonce, first)
+		}
+	}
+
+	for nonce := 0; nonce < first; nonce++ {
+		header := block.BlockHeader
+		header.Nonce = nonce
+		if NewPoW(&header).Verify() {
+			t.Fatalf("single worker skipped valid nonce %d", nonce)
+		}
+	}
+}
+
+func TestMineExtraNonce(t *testing.T) {
+	defer func(n int) { maxNonce = n }(maxNonce)
+	maxNonce = 3
+	target := new(big.Int).Lsh(big.NewInt(1), 252)
+
+	var block *Block
+	for i := 0; block == nil; i++ {
+		b := testTemplate(strconv.Itoa(i), target)
+		if _, _, err := NewPoW(&b.BlockHeader).Run(context.Background(), 2); errors.Is(err, errNonceExhausted) {
+			block = b
+		}
+	}
+	coinbase := block.Transactions[0]
+	_, data, err := coinbaseData(coinbase.Vin[0].ScriptSig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID, oldRoot := coinbase.ID, block.Root
+
+	if err := block.Mine(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	_, extended, err := coinbaseData(coinbase.Vin[0].ScriptSig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extended) != len(data)+8 || !bytes.HasPrefix(extended, data) {
+		t.Errorf("coinbase data %x does not extend %x with an extranonce", extended, data)
+	}
+	if bytes.Equal(coinbase.ID, oldID) || !bytes.Equal(coinbase.ID, coinbase.Hash()) {
+		t.Errorf("coinbase ID %x was not updated", coinbase.ID)
+	}
+	if bytes.Equal(block.Root, oldRoot) || !bytes.Equal(block.Root, block.HashTransactions()) {
+		t.Errorf("merkle root %x was not updated", block.Root)
+	}
+	if !NewPoW(&block.BlockHeader).Verify() || !bytes.Equal(block.HeaderHash, block.BlockHeader.Hash()) {
+		t.Errorf("mined block %x does not meet the target", block.HeaderHash)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const psbtMagic = "psbt"
+
+// PartialTransaction 是未签名的交易、它花费的交易和已收集的签名
+type PartialTransaction struct {
+	Tx     Transaction
+	Inputs []PartialInput
+}
+
+type PartialInput struct {
+	PrevTx       Transaction
+	PrevOut      TXOutput // PrevTx 中被花费的输出
+	RedeemScript []byte
+	Signatures   []PartialSignature
+}
+
+type PartialSignature struct {
+	PubKey    []byte
+	Signature []byte
+}
+
+func NewPartialTransaction(tx *Transaction, prevTXs map[string]Transaction, scripts map[string][]byte) (*PartialTransaction, error) {
+	p := &PartialTransaction{Tx: *tx}
+	p.Tx.Vin = append([]TXInput{}, tx.Vin...)
+	for i, in := range p.Tx.Vin {
+		p.Tx.Vin[i].ScriptSig = nil
+
+		prevTx, ok := prevTXs[hex.EncodeToString(in.Txid)]
+		if !ok {
+			return nil, fmt.Errorf("input %d: transaction %x not provided", i, in.Txid)
+		}
+		prevOut, err := spentOutput(&prevTx, in)
+		if err != nil {
+			return nil, fmt.Errorf("input %d: %w", i, err)
+		}
+
+		input := PartialInput{PrevTx: prevTx, PrevOut: prevOut}
+		if _, ok := ExtractScriptHash(prevOut.ScriptPubKey); ok {
+			address := ScriptAddress(prevOut.ScriptPubKey)
+			redeemScript, ok := scripts[address]
+			if !ok {
+				return nil, fmt.Errorf("input %d: redeem script of %s is unknown", i, address)
+			}
+			input.RedeemScript = redeemScript
+		}
+		p.Inputs = append(p.Inputs, input)
+	}
+	p.Tx.ID = p.Tx.Hash()
+	return p, nil
+}
+
+// spentOutput 核对 prevTx 的哈希是否是 in 引用的交易 ID，版本 0 交易无法核对
+func spentOutput(prevTx *Transaction, in TXInput) (TXOutput, error) {
+	if prevTx.Version == 0 || !bytes.Equal(prevTx.Hash(), in.Txid) {
+		return TXOutput{}, fmt.Errorf("transaction %x is not the spent transaction %x", prevTx.ID, in.Txid)
+	}
+	if in.Vout < 0 || in.Vout >= len(prevTx.Vout) {
+		return TXOutput{}, fmt.Errorf("transaction %x has no output %d", in.Txid, in.Vout)
+	}
+	return prevTx.Vout[in.Vout], nil
+}
+
+func (p *PartialTransaction) signatureHash(inIdx int) []byte {
+	return p.Tx.SignatureHash(inIdx, p.Inputs[inIdx].PrevOut.ScriptPubKey)
+}
+
+func (in *PartialInput) multisigKeys() (int, [][]byte, error) {
+	scriptHash, _ := ExtractScriptHash(in.PrevOut.ScriptPubKey)
+	if !bytes.Equal(HashPubKey(in.RedeemScript), scriptHash) {
+		return 0, nil, errors.New("redeem script does not match the output")
+	}
+	m, pubKeys, ok := parseMultisigScript(in.RedeemScript)
+	if !ok {
+		return 0, nil, errors.New("redeem script is not a multisig script")
+	}
+	return m, pubKeys, nil
+}
+
+func (in *PartialInput) signature(pubKey []byte) []byte {
+	for _, sig := range in.Signatures {
+		if bytes.Equal(sig.PubKey, pubKey) {
+			return sig.Signature
+		}
+	}
+	return nil
+}
+
+func (p *PartialTransaction) Sign(wallets *Wallets) (int, error) {
+	added := 0
+	for inIdx := range p.Inputs {
+		in := &p.Inputs[inIdx]
+
+		var candidates []*Wallet
+		if pubKeyHash, ok := scriptPubKeyHash(in.PrevOut.ScriptPubKey); ok {
+			for _, wallet := range wallets.Wallets {
+				if bytes.Equal(HashPubKey(wallet.PublicKey), pubKeyHash) {
+					candidates = append(candidates, wallet)
+				}
+			}
+		} else if _, ok := ExtractScriptHash(in.PrevOut.ScriptPubKey); ok {
+			_, pubKeys, err := in.multisigKeys()
+			if err != nil {
+				return 0, fmt.Errorf("input %d: %w", inIdx, err)
+			}
+			for _, pubKey := range pubKeys {
+				if wallet := findWalletByPubKey(wallets, pubKey); wallet != nil {
+					candidates = append(candidates, wallet)
+				}
+			}
+		}
+
+		for _, wallet := range candidates {
+			if in.signature(wallet.PublicKey) != nil {
+				continue
+			}
+			signature := signHash(wallet.PrivateKey, p.signatureHash(inIdx))
+			in.Signatures = append(in.Signatures, PartialSignature{wallet.PublicKey, signature})
+			added++
+		}
+	}
+	return added, nil
+}
+
+func (p *PartialTransaction) Combine(other *PartialTransaction) error {
+	if !bytes.Equal(p.Tx.ID, other.Tx.ID) {
+		return fmt.Errorf("transactions %x and %x differ", p.Tx.ID, other.Tx.ID)
+	}
+	for inIdx := range p.Inputs {
+		in := &p.Inputs[inIdx]
+		hash := p.signatureHash(inIdx)
+		for _, sig := range other.Inputs[inIdx].Signatures {
+			if in.signature(sig.PubKey) != nil {
+				continue
+			}
+			if !checkSignature(sig.Signature, sig.PubKey, hash) {
+				return fmt.Errorf("input %d: invalid signature for key %x", inIdx, sig.PubKey)
+			}
+			in.Signatures = append(in.Signatures, sig)
+		}
+	}
+	return nil
+}
+
+// Finalize 生成每个输入的 ScriptSig 并校验，返回可以广播的交易，p 本身不变
+func (p *PartialTransaction) Finalize() (*Transaction, error) {
+	tx := p.Tx
+	tx.Vin = append([]TXInput{}, p.Tx.Vin...)
+
+	for inIdx := range p.Inputs {
+		in := &p.Inputs[inIdx]
+		script := in.PrevOut.ScriptPubKey
+
+		if pubKeyHash, ok := scriptPubKeyHash(script); ok {
+			for _, sig := range in.Signatures {
+				if bytes.Equal(HashPubKey(sig.PubKey), pubKeyHash) {
+					tx.Vin[inIdx].ScriptSig = NewP2PKHScriptSig(sig.Signature, sig.PubKey)
+					break
+				}
+			}
+			if len(tx.Vin[inIdx].ScriptSig) == 0 {
+				return nil, fmt.Errorf("input %d is not signed", inIdx)
+			}
+		} else if _, ok := ExtractScriptHash(script); ok {
+			m, pubKeys, err := in.multisigKeys()
+			if err != nil {
+				return nil, fmt.Errorf("input %d: %w", inIdx, err)
+			}
+			signatures := make([][]byte, len(pubKeys))
+			for k, pubKey := range pubKeys {
+				signatures[k] = in.signature(pubKey)
+			}
+			scriptSig, n := multisigScriptSig(in.RedeemScript, signatures, m)
+			if n < m {
+				return nil, fmt.Errorf("input %d has %d of %d signatures", inIdx, n, m)
+			}
+			tx.Vin[inIdx].ScriptSig = scriptSig
+		} else {
+			return nil, fmt.Errorf("input %d spends a non-standard script", inIdx)
+		}
+
+		checker := &inputChecker{tx: &tx, inIdx: inIdx, prevScript: script}
+		if err := VerifyScript(tx.Vin[inIdx].ScriptSig, script, checker); err != nil {
+			return nil, fmt.Errorf("input %d: %w", inIdx, err)
+		}
+	}
+
+	tx.ID = tx.Hash()
+	return &tx, nil
+}
+
+func (p *PartialTransaction) Fee() int {
+	fee := 0
+	for _, in := range p.Inputs {
+		fee += in.PrevOut.Value
+	}
+	for _, out := range p.Tx.Vout {
+		fee -= out.Value
+	}
+	return fee
+}
+
+func (p *PartialTransaction) Serialize() []byte {
+	e := &encoder{}
+	e.buf.WriteString(psbtMagic)
+	e.writeUint8(encodingVersion)
+	e.writeBytes(p.Tx.Serialize())
+	e.writeUint32(uint32(len(p.Inputs)))
+	for _, in := range p.Inputs {
+		e.writeBytes(in.PrevTx.Serialize())
+		e.writeBytes(in.RedeemScript)
+		e.writeUint32(uint32(len(in.Signatures)))
+		for _, sig := range in.Signatures {
+			e.writeBytes(sig.PubKey)
+			e.writeBytes(sig.Signature)
+		}
+	}
+	return e.Bytes()
+}
+
+func DeserializePartialTransaction(data []byte) (*PartialTransaction, error) {
+	if !bytes.HasPrefix(data, []byte(psbtMagic)) {
+		return nil, errors.New("not a partially signed transaction")
+	}
+	d := &decoder{data: data[len(psbtMagic):]}
+	d.readVersion("partially signed transaction")
+	txData := d.readBytes()
+
+	var p PartialTransaction
+	var prevData [][]byte
+	count := d.readCount(12)
+	for i := 0; i < count; i++ {
+		var in PartialInput
+		prevData = append(prevData, d.readBytes())
+		in.RedeemScript = d.readBytes()
+		sigs := d.readCount(8)
+		for j := 0; j < sigs; j++ {
+			pubKey := d.readBytes()
+			in.Signatures = append(in.Signatures, PartialSignature{pubKey, d.readBytes()})
+		}
+		p.Inputs = append(p.Inputs, in)
+	}
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("decode partially signed transaction: %w", err)
+	}
+
+	tx, err := decodeTransaction(txData)
+	if err != nil {
+		return nil, err
+	}
+	p.Tx = tx
+	if len(p.Inputs) != len(tx.Vin) {
+		return nil, fmt.Errorf("%d inputs but %d input records", len(tx.Vin), len(p.Inputs))
+	}
+	for inIdx, in := range tx.Vin {
+		if len(in.ScriptSig) != 0 {
+			return nil, fmt.Errorf("input %d already has a ScriptSig", inIdx)
+		}
+		prevTx, err := decodeTransaction(prevData[inIdx])
+		if err != nil {
+			return nil, fmt.Errorf("input %d: %w", inIdx, err)
+		}
+		prevOut, err := spentOutput(&prevTx, in)
+		if err != nil {
+			return nil, fmt.Errorf("input %d: %w", inIdx, err)
+		}
+		p.Inputs[inIdx].PrevTx, p.Inputs[inIdx].PrevOut = prevTx, prevOut
+
+		hash := p.signatureHash(inIdx)
+		for _, sig := range p.Inputs[inIdx].Signatures {
+			if !checkSignature(sig.Signature, sig.PubKey, hash) {
+				return nil, fmt.Errorf("input %d: invalid signature for key %x", inIdx, sig.PubKey)
+			}
+		}
+	}
+	return &p, nil
+}
+
+func decodePartialTransactionHex(psbtHex string) (*PartialTransaction, error) {
+	data, err := hex.DecodeString(psbtHex)
+	if err != nil {
+		return nil, fmt.Errorf("partially signed transaction is not hex: %w", err)
+	}
+	return DeserializePartialTransaction(data)
+}
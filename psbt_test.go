@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func testWallets(ws ...*Wallet) *Wallets {
+	wallets := &Wallets{make(map[string]*Wallet), make(map[string][]byte)}
+	for _, w := range ws {
+		wallets.Wallets[string(w.GetAddress())] = w
+	}
+	return wallets
+}
+
+func createTestPSBT(t *testing.T, bc *Blockchain, from, to string, amount, fee int, scripts map[string][]byte) *PartialTransaction {
+	unspent := UTXOSet{bc}.FindSpendableUnspent(AddressScript(from), nil)
+	tx, err := NewUnsignedTransaction(from, to, amount, fee, TimeLock{}, unspent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevTXs := make(map[string]Transaction)
+	for _, in := range tx.Vin {
+		prevTx, err := bc.FindTransaction(in.Txid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prevTXs[hex.EncodeToString(in.Txid)] = prevTx
+	}
+	psbt, err := NewPartialTransaction(tx, prevTXs, scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return psbt
+}
+
+func roundTrip(t *testing.T, psbt *PartialTransaction) *PartialTransaction {
+	decoded, err := DeserializePartialTransaction(psbt.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestPartialTransaction(t *testing.T) {
+	bc, w := newTestChain(t, "psbt")
+	defer bc.Close()
+	to := string(newTestWallet().GetAddress())
+
+	psbt := roundTrip(t, createTestPSBT(t, bc, string(w.GetAddress()), to, 10, 2, nil))
+	if psbt.Fee() != 2 {
+		t.Fatalf("fee %d, want 2", psbt.Fee())
+	}
+	if _, err := psbt.Finalize(); err == nil {
+		t.Fatal("unsigned transaction finalized")
+	}
+
+	if added, err := psbt.Sign(testWallets(newTestWallet())); err != nil || added != 0 {
+		t.Fatalf("added %d signatures, %v", added, err)
+	}
+	if added, err := psbt.Sign(testWallets(w)); err != nil || added != 1 {
+		t.Fatalf("added %d signatures, %v", added, err)
+	}
+	tx, err := roundTrip(t, psbt).Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewMempool(bc).Add(tx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartialTransactionMultisig(t *testing.T) {
+	bc, w := newTestChain(t, "psbt-multisig")
+	defer bc.Close()
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signers := []*Wallet{newTestWallet(), newTestWallet(), newTestWallet()}
+	redeemScript, err := NewMultisigScript(2, [][]byte{signers[0].PublicKey, signers[1].PublicKey, signers[2].PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchOnly := testWallets()
+	from := watchOnly.AddScript(redeemScript)
+	block := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(from, "", 1, 0)})
+	if _, err := bc.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	psbt := createTestPSBT(t, bc, from, string(w.GetAddress()), 10, 1, watchOnly.Scripts)
+	first, second := roundTrip(t, psbt), roundTrip(t, psbt)
+	for i, p := range []*PartialTransaction{first, second} {
+		if added, err := p.Sign(testWallets(signers[i])); err != nil || added != 1 {
+			t.Fatalf("signer %d added %d signatures, %v", i, added, err)
+		}
+	}
+	if _, err := first.Finalize(); err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Fatalf("got %v, want a missing signature error", err)
+	}
+
+	forged := roundTrip(t, second)
+	forged.Inputs[0].Signatures[0].Signature = first.Inputs[0].Signatures[0].Signature
+	if err := roundTrip(t, first).Combine(forged); err == nil {
+		t.Fatal("invalid signature combined")
+	}
+	other := createTestPSBT(t, bc, from, string(w.GetAddress()), 11, 1, watchOnly.Scripts)
+	if err := roundTrip(t, first).Combine(other); err == nil {
+		t.Fatal("different transactions combined")
+	}
+
+	if err := first.Combine(second); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := roundTrip(t, first).Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewMempool(bc).Add(tx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartialTransactionPrevTx(t *testing.T) {
+	bc, w := newTestChain(t, "psbt-prevtx")
+	defer bc.Close()
+	to := string(newTestWallet().GetAddress())
+	psbt := createTestPSBT(t, bc, string(w.GetAddress()), to, 10, 2, nil)
+
+	forged := *psbt
+	forged.Inputs = append([]PartialInput{}, psbt.Inputs...)
+	prevTx := forged.Inputs[0].PrevTx
+	prevTx.Vout = append([]TXOutput{}, prevTx.Vout...)
+	prevTx.Vout[0].Value *= 2
+	forged.Inputs[0].PrevTx = prevTx
+	if _, err := DeserializePartialTransaction(forged.Serialize()); err == nil {
+		t.Fatal("partially signed transaction with a forged previous transaction decoded")
+	}
+
+	prevTXs := map[string]Transaction{hex.EncodeToString(psbt.Tx.Vin[0].Txid): prevTx}
+	if _, err := NewPartialTransaction(&psbt.Tx, prevTXs, nil); err == nil {
+		t.Fatal("partially signed transaction created from a forged previous transaction")
+	}
+}
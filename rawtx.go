@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+func NewRawTransaction(inputs []TXInput, outputs []TXOutput, lockTime uint32) (*Transaction, error) {
+	if len(inputs) == 0 {
+		return nil, errors.New("transaction has no inputs")
+	}
+	if len(outputs) == 0 {
+		return nil, errors.New("transaction has no outputs")
+	}
+
+	tx := &Transaction{nil, encodingVersion, nil, outputs, lockTime}
+	for _, in := range inputs {
+		tx.Vin = append(tx.Vin, TXInput{in.Txid, in.Vout, nil, in.Sequence})
+	}
+	tx.ID = tx.Hash()
+	return tx, nil
+}
+
+func parseRawInput(s string, sequence uint32) (TXInput, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return TXInput{}, fmt.Errorf("input %q is not TXID:VOUT[:SEQUENCE]", s)
+	}
+	txid, err := hex.DecodeString(parts[0])
+	if err != nil || len(txid) != 32 {
+		return TXInput{}, fmt.Errorf("input %q: invalid transaction ID", s)
+	}
+	vout, err := strconv.Atoi(parts[1])
+	if err != nil || vout < 0 {
+		return TXInput{}, fmt.Errorf("input %q: invalid output index", s)
+	}
+	if len(parts) == 3 {
+		value, err := strconv.ParseUint(parts[2], 0, 32)
+		if err != nil {
+			return TXInput{}, fmt.Errorf("input %q: invalid sequence", s)
+		}
+		sequence = uint32(value)
+	}
+	return TXInput{txid, vout, nil, sequence}, nil
+}
+
+func parseRawOutput(s string) (TXOutput, error) {
+	address, amountStr, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return TXOutput{}, fmt.Errorf("output %q is not ADDRESS:AMOUNT", s)
+	}
+	if !ValidateAddress(address) {
+		return TXOutput{}, fmt.Errorf("output %q: invalid address", s)
+	}
+	amount, err := strconv.Atoi(amountStr)
+	if err != nil || amount <= 0 {
+		return TXOutput{}, fmt.Errorf("output %q: invalid amount", s)
+	}
+	return *NewTXOutput(amount, address), nil
+}
+
+// SignRawTransaction 为还没有 ScriptSig 的 P2PKH 和时间锁输入签名，prevOuts 与输入一一对应
+func SignRawTransaction(tx *Transaction, prevOuts []TXOutput, wallets *Wallets) int {
+	signed := 0
+	for inIdx, prevOut := range prevOuts {
+		if len(tx.Vin[inIdx].ScriptSig) != 0 {
+			continue
+		}
+		pubKeyHash, ok := scriptPubKeyHash(prevOut.ScriptPubKey)
+		if !ok {
+			continue
+		}
+		wallet, ok := wallets.Wallets[string(encodeAddress(pkhVersion, pubKeyHash))]
+		if !ok {
+			continue
+		}
+
+		signature := signHash(wallet.PrivateKey, tx.SignatureHash(inIdx, prevOut.ScriptPubKey))
+		tx.Vin[inIdx].ScriptSig = NewP2PKHScriptSig(signature, wallet.PublicKey)
+		signed++
+	}
+	tx.ID = tx.Hash()
+	return signed
+}
+
+func verifyRawTransaction(tx *Transaction, prevOuts []TXOutput) error {
+	for inIdx, prevOut := range prevOuts {
+		if len(tx.Vin[inIdx].ScriptSig) == 0 {
+			return fmt.Errorf("input %d is not signed", inIdx)
+		}
+		checker := &inputChecker{tx: tx, inIdx: inIdx, prevScript: prevOut.ScriptPubKey}
+		if err := VerifyScript(tx.Vin[inIdx].ScriptSig, prevOut.ScriptPubKey, checker); err != nil {
+			return fmt.Errorf("input %d: %w", inIdx, err)
+		}
+	}
+	return nil
+}
+
+type txJSON struct {
+	TxID     string         `json:"txid"`
+	Size     int            `json:"size"`
+	LockTime uint32         `json:"locktime"`
+	Vin      []txInputJSON  `json:"vin"`
+	Vout     []txOutputJSON `json:"vout"`
+}
+
+type txInputJSON struct {
+	TxID      string      `json:"txid,omitempty"`
+	Vout      int         `json:"vout"`
+	Coinbase  string      `json:"coinbase,omitempty"`
+	ScriptSig *scriptJSON `json:"scriptsig,omitempty"`
+	Sequence  uint32      `json:"sequence"`
+}
+
+type txOutputJSON struct {
+	N            int        `json:"n"`
+	Value        int        `json:"value"`
+	ScriptPubKey scriptJSON `json:"scriptpubkey"`
+}
+
+type scriptJSON struct {
+	Asm     string `json:"asm"`
+	Hex     string `json:"hex"`
+	Type    string `json:"type,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+func scriptType(script []byte) string {
+	if _, ok := ExtractPubKeyHash(script); ok {
+		return "pubkeyhash"
+	}
+	if _, ok := ExtractScriptHash(script); ok {
+		return "scripthash"
+	}
+	if opcode, _, _, ok := ExtractTimeLock(script); ok {
+		if opcode == OP_CHECKLOCKTIMEVERIFY {
+			return "locktime"
+		}
+		return "sequencelock"
+	}
+	if _, _, ok := parseMultisigScript(script); ok {
+		return "multisig"
+	}
+	return "nonstandard"
+}
+
+func newTxJSON(tx *Transaction) txJSON {
+	result := txJSON{
+		TxID:     hex.EncodeToString(tx.ID),
+		Size:     len(tx.Serialize()),
+		LockTime: tx.LockTime,
+		Vin:      []txInputJSON{},
+		Vout:     []txOutputJSON{},
+	}
+	for _, in := range tx.Vin {
+		if tx.IsCoinbase() {
+			result.Vin = append(result.Vin, txInputJSON{Vout: in.Vout, Coinbase: hex.EncodeToString(in.ScriptSig), Sequence: in.Sequence})
+			continue
+		}
+		scriptSig := &scriptJSON{Asm: DisassembleScript(in.ScriptSig), Hex: hex.EncodeToString(in.ScriptSig)}
+		result.Vin = append(result.Vin, txInputJSON{hex.EncodeToString(in.Txid), in.Vout, "", scriptSig, in.Sequence})
+	}
+	for i, out := range tx.Vout {
+		script := scriptJSON{DisassembleScript(out.ScriptPubKey), hex.EncodeToString(out.ScriptPubKey),
+			scriptType(out.ScriptPubKey), ScriptAddress(out.ScriptPubKey)}
+		result.Vout = append(result.Vout, txOutputJSON{i, out.Value, script})
+	}
+	return result
+}
+
+func (t txJSON) String() string {
+	var lines []string
+
+	lines = append(lines, fmt.Sprintf("--- Transaction %s (%d bytes):", t.TxID, t.Size))
+
+	for i, input := range t.Vin {
+		lines = append(lines, fmt.Sprintf("     Input %d:", i))
+		if input.ScriptSig == nil {
+			lines = append(lines, fmt.Sprintf("       Coinbase:  %s", input.Coinbase))
+		} else {
+			lines = append(lines, fmt.Sprintf("       TXID:      %s", input.TxID))
+			lines = append(lines, fmt.Sprintf("       Out:       %d", input.Vout))
+			lines = append(lines, fmt.Sprintf("       ScriptSig: %s", input.ScriptSig.Asm))
+		}
+		lines = append(lines, fmt.Sprintf("       Sequence:  %08x", input.Sequence))
+	}
+
+	for _, output := range t.Vout {
+		lines = append(lines, fmt.Sprintf("     Output %d:", output.N))
+		lines = append(lines, fmt.Sprintf("       Value:   %d", output.Value))
+		lines = append(lines, fmt.Sprintf("       Script:  %s", output.ScriptPubKey.Asm))
+		if output.ScriptPubKey.Address != "" {
+			lines = append(lines, fmt.Sprintf("       Address: %s (%s)", output.ScriptPubKey.Address, output.ScriptPubKey.Type))
+		} else {
+			lines = append(lines, fmt.Sprintf("       Type:    %s", output.ScriptPubKey.Type))
+		}
+	}
+
+	lines = append(lines, fmt.Sprintf("     LockTime: %d", t.LockTime))
+
+	return strings.Join(lines, "\n")
+}
+
+func (t txJSON) JSON() string {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		log.Panic(err)
+	}
+	return string(data)
+}
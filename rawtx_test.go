@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func rpcCall(t *testing.T, s *RPCServer, result interface{}, method string, params ...interface{}) *rpcError {
+	req := rpcRequest{Method: method}
+	for _, param := range params {
+		data, err := json.Marshal(param)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Params = append(req.Params, data)
+	}
+	value, rpcErr := s.dispatch(req)
+	if rpcErr != nil {
+		return rpcErr
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		t.Fatal(err)
+	}
+	return nil
+}
+
+func TestRawTransaction(t *testing.T) {
+	bc, w := newTestChain(t, "rawtx")
+	defer bc.Close()
+	n := NewNode("rawtx-node", bc)
+	n.knownNodes = []string{n.address}
+	s := &RPCServer{node: n, nodeId: "rawtx"}
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coin := genesis.Transactions[0]
+	to := string(newTestWallet().GetAddress())
+	change := coin.Vout[0].Value - 10 - 1
+
+	in, err := parseRawInput(fmt.Sprintf("%x:0", coin.ID), SequenceFinal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vout []TXOutput
+	for _, arg := range []string{to + ":10", fmt.Sprintf("%s:%d", w.GetAddress(), change)} {
+		out, err := parseRawOutput(arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vout = append(vout, out)
+	}
+	created, err := NewRawTransaction([]TXInput{in}, vout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txHex := hex.EncodeToString(created.Serialize())
+
+	var decoded txJSON
+	if rpcErr := rpcCall(t, s, &decoded, "decoderawtransaction", txHex); rpcErr != nil {
+		t.Fatal(rpcErr)
+	}
+	if !reflect.DeepEqual(decoded, newTxJSON(created)) {
+		t.Errorf("decoded %+v, want %+v", decoded, newTxJSON(created))
+	}
+	if decoded.Vin[0].TxID != hex.EncodeToString(coin.ID) || decoded.Vin[0].Sequence != SequenceFinal {
+		t.Errorf("decoded input %+v", decoded.Vin[0])
+	}
+	if decoded.Vout[0].ScriptPubKey.Address != to || decoded.Vout[0].ScriptPubKey.Type != "pubkeyhash" || decoded.Vout[1].Value != change {
+		t.Errorf("decoded outputs %+v", decoded.Vout)
+	}
+	if text := decoded.String(); !strings.Contains(text, to) || !strings.Contains(text, decoded.TxID) {
+		t.Errorf("decoderaw text does not show the address and ID:\n%s", text)
+	}
+
+	tx, err := decodeTransactionHex(txHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := UTXOSet{bc}.GetEntry(coin.ID, 0)
+	if !ok {
+		t.Fatal("genesis output is not unspent")
+	}
+	prevOuts := []TXOutput{entry.Output}
+	if signed := SignRawTransaction(tx, prevOuts, testWallets(newTestWallet())); signed != 0 {
+		t.Fatalf("signed %d inputs without the key", signed)
+	}
+	if err := verifyRawTransaction(tx, prevOuts); err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Fatalf("got %v, want an unsigned input error", err)
+	}
+	if rpcErr := rpcCall(t, s, new(string), "sendrawtransaction", txHex); rpcErr == nil || rpcErr.Code != rpcErrTxRejected {
+		t.Fatalf("unsigned transaction: got %v, want code %d", rpcErr, rpcErrTxRejected)
+	}
+	if signed := SignRawTransaction(tx, prevOuts, testWallets(w)); signed != 1 {
+		t.Fatalf("signed %d inputs, want 1", signed)
+	}
+	if err := verifyRawTransaction(tx, prevOuts); err != nil {
+		t.Fatal(err)
+	}
+	if signed := SignRawTransaction(tx, prevOuts, testWallets(w)); signed != 0 {
+		t.Fatalf("signed %d inputs again", signed)
+	}
+	signedHex := hex.EncodeToString(tx.Serialize())
+
+	var txid string
+	if rpcErr := rpcCall(t, s, &txid, "sendrawtransaction", signedHex); rpcErr != nil {
+		t.Fatal(rpcErr)
+	}
+	if txid != hex.EncodeToString(tx.ID) || !n.mempool.Has(tx.ID) {
+		t.Fatalf("sent %s, want %x in the mempool", txid, tx.ID)
+	}
+	if rpcErr := rpcCall(t, s, &txid, "sendrawtransaction", signedHex); rpcErr == nil || rpcErr.Code != rpcErrTxRejected {
+		t.Errorf("resent transaction: got %v, want code %d", rpcErr, rpcErrTxRejected)
+	}
+
+	tampered, err := decodeTransactionHex(signedHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered.Vout[0].Value++
+	tampered.ID = tampered.Hash()
+	if err := verifyRawTransaction(tampered, prevOuts); err == nil {
+		t.Error("tampered transaction verified")
+	}
+	if !bytes.Equal(tx.Vin[0].ScriptSig, tampered.Vin[0].ScriptSig) {
+		t.Error("decoding changed the signature")
+	}
+}
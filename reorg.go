@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"log"
+	"math/big"
+)
+
+const chainWorkBucket = "chainwork"
+
+const childrenBucket = "children"
+
+// reorgKey 记录进行中的重组的原主链末端和目标分支末端，中断的重组由 recoverReorg 完成
+const reorgKey = "r"
+
+func createChainBuckets(tx *bbolt.Tx) error {
+	for _, name := range []string{heightBucket, chainWorkBucket, undoBucket, utxoBucket} {
+		_, err := tx.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+	}
+	if tx.Bucket([]byte(childrenBucket)) != nil {
+		return nil
+	}
+
+	children, err := tx.CreateBucket([]byte(childrenBucket))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(blocksBucket)).ForEach(func(k, v []byte) error {
+		if len(k) == 1 {
+			return nil
+		}
+		block, err := decodeBlock(v)
+		if err != nil {
+			return fmt.Errorf("decode block %x: %w", k, err)
+		}
+		return children.Put(childKey(block.PrevBlockHeaderHash, k), nil)
+	})
+}
+
+func childKey(parent, child []byte) []byte {
+	return append(append([]byte{}, parent...), child...)
+}
+
+func (bc *Blockchain) getTip() []byte {
+	var tip []byte
+	err := bc.db.View(func(tx *bbolt.Tx) error {
+		tip = append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))...)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return tip
+}
+
+func (bc *Blockchain) GetChainWork(hash []byte) *big.Int {
+	var work *big.Int
+	err := bc.db.View(func(tx *bbolt.Tx) error {
+		work = chainWork(tx, hash)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return work
+}
+
+func chainWork(tx *bbolt.Tx, hash []byte) *big.Int {
+	wb := tx.Bucket([]byte(chainWorkBucket))
+	b := tx.Bucket([]byte(blocksBucket))
+
+	var missing []*Block
+	work := big.NewInt(0)
+	for len(hash) > 0 {
+		if data := wb.Get(hash); data != nil {
+			work.SetBytes(data)
+			break
+		}
+		block := DeserializeBlock(b.Get(hash))
+		missing = append(missing, block)
+		hash = block.PrevBlockHeaderHash
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		work.Add(work, NewPoW(&missing[i].BlockHeader).Work())
+	}
+	return work
+}
+
+func (bc *Blockchain) storeBlock(tx *bbolt.Tx, block *Block) error {
+	err := tx.Bucket([]byte(blocksBucket)).Put(block.HeaderHash, block.Serialize())
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte(childrenBucket)).Put(childKey(block.PrevBlockHeaderHash, block.HeaderHash), nil)
+	if err != nil {
+		return err
+	}
+
+	work := chainWork(tx, block.PrevBlockHeaderHash)
+	work.Add(work, NewPoW(&block.BlockHeader).Work())
+	return tx.Bucket([]byte(chainWorkBucket)).Put(block.HeaderHash, work.Bytes())
+}
+
+func (bc *Blockchain) connectBlock(tx *bbolt.Tx, block *Block) error {
+	err := UTXOSet{bc}.Update(tx, block)
+	if err != nil {
+		return err
+	}
+	err = indexBlockTxs(tx, block)
+	if err != nil {
+		return err
+	}
+	err = indexBlockAddresses(tx, block)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte(heightBucket)).Put(heightKey(block.Height), block.HeaderHash)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte(blocksBucket)).Put([]byte("l"), block.HeaderHash)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (bc *Blockchain) disconnectBlock(tx *bbolt.Tx, block *Block) error {
+	err := UTXOSet{bc}.Rollback(tx, block)
+	if err != nil {
+		return err
+	}
+	err = unindexBlockTxs(tx, block)
+	if err != nil {
+		return err
+	}
+	err = unindexBlockAddresses(tx, block)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte(heightBucket)).Delete(heightKey(block.Height))
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte(blocksBucket)).Put([]byte("l"), block.PrevBlockHeaderHash)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (bc *Blockchain) findFork(oldTip []byte, newTip *Block) ([]*Block, []*Block) {
+	var detach, attach []*Block
+
+	oldBlock := bc.GetBlock(oldTip)
+	old := &oldBlock
+	cur := newTip
+
+	for old.Height > cur.Height {
+		detach = append(detach, old)
+		parent := bc.GetBlock(old.PrevBlockHeaderHash)
+		old = &parent
+	}
+	for cur.Height > old.Height {
+		attach = append([]*Block{cur}, attach...)
+		parent := bc.GetBlock(cur.PrevBlockHeaderHash)
+		cur = &parent
+	}
+	for !bytes.Equal(old.HeaderHash, cur.HeaderHash) {
+		detach = append(detach, old)
+		attach = append([]*Block{cur}, attach...)
+		oldParent := bc.GetBlock(old.PrevBlockHeaderHash)
+		curParent := bc.GetBlock(cur.PrevBlockHeaderHash)
+		old, cur = &oldParent, &curParent
+	}
+
+	return detach, attach
+}
+
+// reorganize 切换到以 newTip 结尾的分支，新分支中有无效区块时删除它们并恢复原主链
+func (bc *Blockchain) reorganize(newTip *Block) ([]*Transaction, error) {
+	bc.setReorgMarker(bc.getTip(), newTip.HeaderHash)
+	txs, err := bc.switchChain(newTip)
+	bc.setReorgMarker(nil, nil)
+	return txs, err
+}
+
+func (bc *Blockchain) switchChain(newTip *Block) ([]*Transaction, error) {
+	detach, attach := bc.findFork(bc.getTip(), newTip)
+	fmt.Printf("Reorganizing chain: disconnecting %d blocks, connecting %d blocks\n", len(detach), len(attach))
+
+	for _, block := range detach {
+		bc.updateChain(block, bc.disconnectBlock)
+	}
+
+	for i, block := range attach {
+		if err := bc.checkBlockConnect(block); err != nil {
+			bc.removeInvalidBlock(block)
+			for j := i - 1; j >= 0; j-- {
+				bc.updateChain(attach[j], bc.disconnectBlock)
+			}
+			for j := len(detach) - 1; j >= 0; j-- {
+				bc.updateChain(detach[j], bc.connectBlock)
+			}
+			return nil, err
+		}
+		bc.updateChain(block, bc.connectBlock)
+	}
+
+	confirmed := make(map[string]bool)
+	for _, block := range attach {
+		for _, tx := range block.Transactions {
+			confirmed[string(tx.ID)] = true
+		}
+	}
+
+	var txs []*Transaction
+	for _, block := range detach {
+		for _, tx := range block.Transactions {
+			if !tx.IsCoinbase() && !confirmed[string(tx.ID)] {
+				txs = append(txs, tx)
+			}
+		}
+	}
+	return txs, nil
+}
+
+func (bc *Blockchain) setReorgMarker(from, to []byte) {
+	err := bc.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		if from == nil {
+			return b.Delete([]byte(reorgKey))
+		}
+		e := &encoder{}
+		e.writeBytes(from)
+		e.writeBytes(to)
+		return b.Put([]byte(reorgKey), e.Bytes())
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// recoverReorg 先不经校验切回原主链，再重新尝试切换到目标分支
+func (bc *Blockchain) recoverReorg() {
+	var marker []byte
+	err := bc.db.View(func(tx *bbolt.Tx) error {
+		marker = append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get([]byte(reorgKey))...)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if len(marker) == 0 {
+		return
+	}
+
+	d := &decoder{data: marker}
+	from, to := d.readBytes(), d.readBytes()
+	if err := d.finish(); err != nil {
+		log.Panicf("decode reorg marker: %v", err)
+	}
+
+	fmt.Println("Resuming an interrupted chain reorganization")
+	oldTip := bc.GetBlock(from)
+	detach, attach := bc.findFork(bc.getTip(), &oldTip)
+	for _, block := range detach {
+		bc.updateChain(block, bc.disconnectBlock)
+	}
+	for _, block := range attach {
+		bc.updateChain(block, bc.connectBlock)
+	}
+
+	newTip, err := bc.findBlock(to)
+	if err == nil && bc.GetChainWork(to).Cmp(bc.GetChainWork(from)) > 0 {
+		if _, err := bc.reorganize(newTip); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+	bc.setReorgMarker(nil, nil)
+}
+
+func (bc *Blockchain) updateChain(block *Block, step func(*bbolt.Tx, *Block) error) {
+	err := bc.updateChainstate(func(tx *bbolt.Tx) error {
+		return step(tx, block)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (bc *Blockchain) removeInvalidBlock(invalid *Block) {
+	err := bc.db.Update(func(tx *bbolt.Tx) error {
+		children := tx.Bucket([]byte(childrenBucket))
+		for queue := [][]byte{childKey(invalid.PrevBlockHeaderHash, invalid.HeaderHash)}; len(queue) > 0; queue = queue[1:] {
+			hash := queue[0][len(queue[0])-len(invalid.HeaderHash):]
+			c := children.Cursor()
+			for k, _ := c.Seek(hash); k != nil && bytes.HasPrefix(k, hash); k, _ = c.Next() {
+				queue = append(queue, append([]byte{}, k...))
+			}
+
+			fmt.Printf("Removing invalid block %x\n", hash)
+			err := children.Delete(queue[0])
+			if err != nil {
+				return err
+			}
+			err = tx.Bucket([]byte(blocksBucket)).Delete(hash)
+			if err != nil {
+				return err
+			}
+			err = tx.Bucket([]byte(chainWorkBucket)).Delete(hash)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
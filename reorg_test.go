@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"go.etcd.io/bbolt"
+	"testing"
+)
+
+func hasBlock(bc *Blockchain, block *Block) bool {
+	_, err := bc.findBlock(block.HeaderHash)
+	return err == nil
+}
+
+// TestReorganizeInvalidBranch 重组失败后保留原主链，并删除无效区块及其后代
+func TestReorganizeInvalidBranch(t *testing.T) {
+	bc, w := newTestChain(t, "reorg-invalid")
+	defer bc.Close()
+	address := string(w.GetAddress())
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tip := genesis
+	for height := 1; height <= 3; height++ {
+		tip = mineTestBlock(bc, tip, []*Transaction{NewCoinBaseTX(address, "a", height, 0)})
+		if _, err := bc.AddBlock(tip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b1 := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "b", 1, 0)})
+	b2 := mineTestBlock(bc, b1, []*Transaction{NewCoinBaseTX(address, "b", 2, 5)})
+	b3 := mineTestBlock(bc, b2, []*Transaction{NewCoinBaseTX(address, "b", 3, 0)})
+	sibling := mineTestBlock(bc, b2, []*Transaction{NewCoinBaseTX(address, "sibling", 3, 0)})
+	b4 := mineTestBlock(bc, b3, []*Transaction{NewCoinBaseTX(address, "b", 4, 0)})
+	for _, block := range []*Block{b1, b2, b3, sibling} {
+		if _, err := bc.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = bc.AddBlock(b4)
+	if reason, _ := rejectReason(err); reason != RejectCoinbaseOverpay {
+		t.Fatalf("got %v, want a coinbase overpay rejection", err)
+	}
+	if !bytes.Equal(bc.getTip(), tip.HeaderHash) {
+		t.Fatalf("tip %x, want %x", bc.getTip(), tip.HeaderHash)
+	}
+	if !hasBlock(bc, b1) {
+		t.Error("valid branch block was removed")
+	}
+	for _, block := range []*Block{b2, b3, sibling, b4} {
+		if hasBlock(bc, block) {
+			t.Errorf("block %x at height %d was not removed", block.HeaderHash, block.Height)
+		}
+	}
+	if got := (UTXOSet{bc}).TotalValue(); got != 4*BlockSubsidy(0) {
+		t.Errorf("total value %d, want %d", got, 4*BlockSubsidy(0))
+	}
+}
+
+func TestRecoverReorg(t *testing.T) {
+	bc, w := newTestChain(t, "reorg-recover")
+	address := string(w.GetAddress())
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1 := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "a", 1, 0)})
+	b1 := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "b", 1, 0)})
+	b2 := mineTestBlock(bc, b1, []*Transaction{NewCoinBaseTX(address, "b", 2, 0)})
+	for _, block := range []*Block{a1, b1} {
+		if _, err := bc.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = bc.db.Update(func(tx *bbolt.Tx) error {
+		return bc.storeBlock(tx, b2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc.setReorgMarker(a1.HeaderHash, b2.HeaderHash)
+	bc.updateChain(a1, bc.disconnectBlock)
+	if err := bc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bc = NewBlockChain("reorg-recover")
+	defer bc.Close()
+	if !bytes.Equal(bc.getTip(), b2.HeaderHash) {
+		t.Fatalf("tip %x, want %x", bc.getTip(), b2.HeaderHash)
+	}
+	err = bc.db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte(blocksBucket)).Get([]byte(reorgKey)) != nil {
+			t.Error("reorg marker was not cleared")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := UTXOSet{bc}
+	if _, ok := set.FindOutput(a1.Transactions[0].ID, 0); ok {
+		t.Error("coinbase of the disconnected block is still unspent")
+	}
+	for _, block := range []*Block{b1, b2} {
+		if _, ok := set.FindOutput(block.Transactions[0].ID, 0); !ok {
+			t.Errorf("coinbase of block %d on the new chain is missing", block.Height)
+		}
+	}
+}
+
+func TestMutatedBlock(t *testing.T) {
+	bc, w := newTestChain(t, "reorg-mutated")
+	defer bc.Close()
+	address := string(w.GetAddress())
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1 := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "a", 1, 0)})
+	if _, err := bc.AddBlock(a1); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := []*Transaction{NewCoinBaseTX(address, "b", 1, 1), testSpend(w, genesis.Transactions[0], 1)}
+	txs = append(txs, testSpend(w, NewCoinBaseTX(address, "other", 1, 0), 0))
+	b1 := mineTestBlock(bc, genesis, txs)
+	mutated := *b1
+	mutated.Transactions = append(append([]*Transaction{}, txs...), txs[2])
+
+	n := NewNode("reorg-mutated", bc)
+	for _, add := range []func(*Block) error{
+		n.acceptBlock,
+		func(block *Block) error { _, err := bc.AddBlock(block); return err },
+	} {
+		if reason, _ := rejectReason(add(&mutated)); reason != RejectDuplicate {
+			t.Fatalf("got %s, want %s", reason, RejectDuplicate)
+		}
+		if hasBlock(bc, b1) {
+			t.Fatal("mutated block was stored")
+		}
+	}
+
+	if err := n.acceptBlock(b1); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := bc.findBlock(b1.HeaderHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Transactions) != len(txs) {
+		t.Fatalf("stored block has %d transactions, want %d", len(stored.Transactions), len(txs))
+	}
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+const rpcPortOffset = 10000
+const rpcCookieFile = "rpc_%s.cookie"
+const rpcCookieUser = "__cookie__"
+const maxRPCRequestSize = 4 * 1024 * 1024
+
+const (
+	rpcErrParse          = -32700
+	rpcErrInvalidRequest = -32600
+	rpcErrMethodNotFound = -32601
+	rpcErrInvalidParams  = -32602
+	rpcErrInternal       = -32603
+	rpcErrWallet         = -4
+	rpcErrNotFound       = -5
+	rpcErrTxRejected     = -26
+)
+
+type rpcRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+func newRPCError(code int, format string, args ...interface{}) *rpcError {
+	return &rpcError{code, fmt.Sprintf(format, args...)}
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+	Error   *rpcError       `json:"error"`
+}
+
+type rpcHandler func(s *RPCServer, params []json.RawMessage) (interface{}, error)
+
+var rpcHandlers = map[string]rpcHandler{
+	"getblockchaininfo":    (*RPCServer).getBlockchainInfo,
+	"getblock":             (*RPCServer).getBlock,
+	"getblockhash":         (*RPCServer).getBlockHash,
+	"getrawtransaction":    (*RPCServer).getRawTransaction,
+	"sendrawtransaction":   (*RPCServer).sendRawTransaction,
+	"decoderawtransaction": (*RPCServer).decodeRawTransaction,
+	"gettxout":             (*RPCServer).getTxOut,
+	"getmempoolinfo":       (*RPCServer).getMempoolInfo,
+	"getpeerinfo":          (*RPCServer).getPeerInfo,
+	"getbalance":           (*RPCServer).getBalance,
+	"getaddresshistory":    (*RPCServer).getAddressHistory,
+	"listunspent":          (*RPCServer).listUnspent,
+	"sendtoaddress":        (*RPCServer).sendToAddress,
+	"generate":             (*RPCServer).generate,
+}
+
+// RPCServer 是只监听本机地址的 JSON-RPC 服务，使用 HTTP Basic 认证或 cookie 文件中的凭据
+type RPCServer struct {
+	node     *Node
+	nodeId   string
+	addr     string
+	user     string
+	password string
+	cookie   string
+}
+
+func NewRPCServer(node *Node, nodeId, addr, user, password string) (*RPCServer, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &RPCServer{node, nodeId, addr, user, password, hex.EncodeToString(secret)}, nil
+}
+
+func rpcPort(nodeId string, port int) int {
+	if port != 0 {
+		return port
+	}
+	nodePort, err := strconv.Atoi(nodeId)
+	if err != nil {
+		log.Panic(err)
+	}
+	return nodePort + rpcPortOffset
+}
+
+// ListenAndServe 开始监听后才写入 cookie 文件
+func (s *RPCServer) ListenAndServe() error {
+	ln, err := net.Listen(protocol, s.addr)
+	if err != nil {
+		return err
+	}
+	cookie := fmt.Sprintf("%s:%s\n%s\n", rpcCookieUser, s.cookie, s.addr)
+	if err := os.WriteFile(fmt.Sprintf(rpcCookieFile, s.nodeId), []byte(cookie), 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("RPC server listening on %s\n", s.addr)
+	return http.Serve(ln, s)
+}
+
+func (s *RPCServer) authorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	if user == rpcCookieUser {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(s.cookie)) == 1
+	}
+	return s.user != "" &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(s.user)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) == 1
+}
+
+func (s *RPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ozycoin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req rpcRequest
+	resp := rpcResponse{JSONRPC: "2.0"}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRPCRequestSize)).Decode(&req)
+	if err != nil {
+		resp.Error = newRPCError(rpcErrParse, "%v", err)
+	} else {
+		resp.ID = req.ID
+		resp.Result, resp.Error = s.dispatch(req)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+}
+
+// dispatch 把处理函数中的 panic 转换为内部错误
+func (s *RPCServer) dispatch(req rpcRequest) (result interface{}, rpcErr *rpcError) {
+	handler, ok := rpcHandlers[req.Method]
+	if !ok {
+		return nil, newRPCError(rpcErrMethodNotFound, "method %q not found", req.Method)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			result, rpcErr = nil, newRPCError(rpcErrInternal, "%v", r)
+		}
+	}()
+
+	result, err := handler(s, req.Params)
+	if err != nil {
+		if e, ok := err.(*rpcError); ok {
+			return nil, e
+		}
+		return nil, newRPCError(rpcErrInternal, "%v", err)
+	}
+	return result, nil
+}
+
+func parseParams(params []json.RawMessage, required int, values ...interface{}) error {
+	if len(params) < required || len(params) > len(values) {
+		return newRPCError(rpcErrInvalidParams, "expected %d to %d parameters, got %d", required, len(values), len(params))
+	}
+	for i, param := range params {
+		if err := json.Unmarshal(param, values[i]); err != nil {
+			return newRPCError(rpcErrInvalidParams, "parameter %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func parseHash(s string) ([]byte, error) {
+	hash, err := hex.DecodeString(s)
+	if err != nil || len(hash) != 32 {
+		return nil, newRPCError(rpcErrInvalidParams, "%q is not a 32-byte hex hash", s)
+	}
+	return hash, nil
+}
+
+type blockchainInfo struct {
+	Blocks        int    `json:"blocks"`
+	Headers       int    `json:"headers"`
+	BestBlockHash string `json:"bestblockhash"`
+	Bits          string `json:"bits"`
+	MedianTime    int64  `json:"mediantime"`
+	ChainWork     string `json:"chainwork"`
+	Supply        int    `json:"supply"`
+}
+
+func (s *RPCServer) getBlockchainInfo(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	bc := s.node.bc
+
+	tip, err := bc.findBlock(bc.getTip())
+	if err != nil {
+		return nil, err
+	}
+
+	headers := tip.Height
+	s.node.mu.Lock()
+	for _, header := range s.node.download.headers {
+		if header.Height > headers {
+			headers = header.Height
+		}
+	}
+	s.node.mu.Unlock()
+
+	return blockchainInfo{
+		Blocks:        tip.Height,
+		Headers:       headers,
+		BestBlockHash: hex.EncodeToString(tip.HeaderHash),
+		Bits:          fmt.Sprintf("%08x", tip.Bits),
+		MedianTime:    bc.MedianTimePast(tip),
+		ChainWork:     bc.GetChainWork(tip.HeaderHash).Text(16),
+		Supply:        UTXOSet{bc}.TotalValue(),
+	}, nil
+}
+
+type blockInfo struct {
+	Hash              string   `json:"hash"`
+	Confirmations     int      `json:"confirmations"`
+	Height            int      `json:"height"`
+	Version           uint8    `json:"version"`
+	PreviousBlockHash string   `json:"previousblockhash"`
+	MerkleRoot        string   `json:"merkleroot"`
+	Time              int64    `json:"time"`
+	Bits              string   `json:"bits"`
+	Nonce             int      `json:"nonce"`
+	Tx                []string `json:"tx"`
+}
+
+func (s *RPCServer) getBlock(params []json.RawMessage) (interface{}, error) {
+	var hashHex string
+	verbose := true
+	if err := parseParams(params, 1, &hashHex, &verbose); err != nil {
+		return nil, err
+	}
+	hash, err := parseHash(hashHex)
+	if err != nil {
+		return nil, err
+	}
+
+	bc := s.node.bc
+	block, err := bc.findBlock(hash)
+	if err != nil {
+		return nil, newRPCError(rpcErrNotFound, "block %s not found", hashHex)
+	}
+	if !verbose {
+		return hex.EncodeToString(block.Serialize()), nil
+	}
+
+	confirmations := -1
+	if mainHash, err := bc.GetBlockHashByHeight(block.Height); err == nil && hex.EncodeToString(mainHash) == hashHex {
+		confirmations = bc.GetBestHeight() - block.Height + 1
+	}
+
+	info := blockInfo{
+		Hash:              hashHex,
+		Confirmations:     confirmations,
+		Height:            block.Height,
+		Version:           block.Version,
+		PreviousBlockHash: hex.EncodeToString(block.PrevBlockHeaderHash),
+		MerkleRoot:        hex.EncodeToString(block.Root),
+		Time:              block.Timestamp,
+		Bits:              fmt.Sprintf("%08x", block.Bits),
+		Nonce:             block.Nonce,
+	}
+	for _, tx := range block.Transactions {
+		info.Tx = append(info.Tx, hex.EncodeToString(tx.ID))
+	}
+	return info, nil
+}
+
+func (s *RPCServer) getBlockHash(params []json.RawMessage) (interface{}, error) {
+	var height int
+	if err := parseParams(params, 1, &height); err != nil {
+		return nil, err
+	}
+
+	hash, err := s.node.bc.GetBlockHashByHeight(height)
+	if err != nil {
+		return nil, newRPCError(rpcErrInvalidParams, "block height %d out of range", height)
+	}
+	return hex.EncodeToString(hash), nil
+}
+
+type txInfo struct {
+	TxID          string `json:"txid"`
+	Hex           string `json:"hex"`
+	BlockHash     string `json:"blockhash,omitempty"`
+	Height        int    `json:"height,omitempty"`
+	Confirmations int    `json:"confirmations"`
+}
+
+func (s *RPCServer) getRawTransaction(params []json.RawMessage) (interface{}, error) {
+	var txidHex string
+	verbose := false
+	if err := parseParams(params, 1, &txidHex, &verbose); err != nil {
+		return nil, err
+	}
+	txid, err := parseHash(txidHex)
+	if err != nil {
+		return nil, err
+	}
+
+	info := txInfo{TxID: txidHex}
+	if tx, ok := s.node.mempool.Get(txid); ok {
+		info.Hex = hex.EncodeToString(tx.Serialize())
+	} else {
+		tx, loc, err := s.node.bc.FindTransactionLocation(txid)
+		if err != nil {
+			return nil, newRPCError(rpcErrNotFound, "transaction %s not found", txidHex)
+		}
+		info.Hex = hex.EncodeToString(tx.Serialize())
+		info.BlockHash = hex.EncodeToString(loc.BlockHash)
+		info.Height = loc.Height
+		info.Confirmations = s.node.bc.GetBestHeight() - loc.Height + 1
+	}
+
+	if !verbose {
+		return info.Hex, nil
+	}
+	return info, nil
+}
+
+func (s *RPCServer) sendRawTransaction(params []json.RawMessage) (interface{}, error) {
+	var txHex string
+	if err := parseParams(params, 1, &txHex); err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, newRPCError(rpcErrInvalidParams, "transaction is not hex: %v", err)
+	}
+	tx, err := decodeTransaction(data)
+	if err != nil {
+		return nil, newRPCError(rpcErrInvalidParams, "%v", err)
+	}
+
+	if err := s.node.submitTx(&tx); err != nil {
+		return nil, newRPCError(rpcErrTxRejected, "%v", err)
+	}
+	return hex.EncodeToString(tx.ID), nil
+}
+
+func (s *RPCServer) decodeRawTransaction(params []json.RawMessage) (interface{}, error) {
+	var txHex string
+	if err := parseParams(params, 1, &txHex); err != nil {
+		return nil, err
+	}
+	tx, err := decodeTransactionHex(txHex)
+	if err != nil {
+		return nil, newRPCError(rpcErrInvalidParams, "%v", err)
+	}
+	return newTxJSON(tx), nil
+}
+
+type mempoolInfo struct {
+	Size     int `json:"size"`
+	Bytes    int `json:"bytes"`
+	MaxSize  int `json:"maxsize"`
+	MaxBytes int `json:"maxbytes"`
+}
+
+func (s *RPCServer) getMempoolInfo(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	mp := s.node.mempool
+	return mempoolInfo{mp.Count(), mp.Size(), maxMempoolTxs, maxMempoolBytes}, nil
+}
+
+func (s *RPCServer) getPeerInfo(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	return s.node.peerInfo(), nil
+}
+
+func (s *RPCServer) getBalance(params []json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, 1, &address); err != nil {
+		return nil, err
+	}
+	if !ValidateAddress(address) {
+		return nil, newRPCError(rpcErrNotFound, "invalid address %q", address)
+	}
+
+	return UTXOSet{s.node.bc}.GetBalance(GetPublicKeyHash(address)), nil
+}
+
+type addressTxInfo struct {
+	TxID     string `json:"txid"`
+	Height   int    `json:"height"`
+	Received int    `json:"received"`
+	Spent    int    `json:"spent"`
+}
+
+type addressHistory struct {
+	Transactions []addressTxInfo `json:"transactions"`
+	Balance      int             `json:"balance"`
+}
+
+func newAddressHistory(txs []AddressTx, balance int) addressHistory {
+	history := addressHistory{Transactions: []addressTxInfo{}, Balance: balance}
+	for _, tx := range txs {
+		history.Transactions = append(history.Transactions, addressTxInfo{hex.EncodeToString(tx.TxID), tx.Height, tx.Received, tx.Spent})
+	}
+	return history
+}
+
+func (s *RPCServer) getAddressHistory(params []json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, 1, &address); err != nil {
+		return nil, err
+	}
+	if !ValidateAddress(address) {
+		return nil, newRPCError(rpcErrNotFound, "invalid address %q", address)
+	}
+
+	txs, balance, err := s.node.bc.GetAddressHistory(GetPublicKeyHash(address))
+	if err != nil {
+		return nil, err
+	}
+	return newAddressHistory(txs, balance), nil
+}
+
+type unspentInfo struct {
+	TxID         string `json:"txid"`
+	Vout         int    `json:"vout"`
+	Value        int    `json:"value"`
+	ScriptPubKey string `json:"scriptpubkey"`
+	Height       int    `json:"height"`
+	Coinbase     bool   `json:"coinbase"`
+}
+
+func (s *RPCServer) listUnspent(params []json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, 1, &address); err != nil {
+		return nil, err
+	}
+	if !ValidateAddress(address) {
+		return nil, newRPCError(rpcErrNotFound, "invalid address %q", address)
+	}
+
+	result := []unspentInfo{}
+	for _, out := range (UTXOSet{s.node.bc}).FindSpendableUnspent(AddressScript(address), s.node.mempool.IsSpent) {
+		entry := out.Entry
+		result = append(result, unspentInfo{hex.EncodeToString(out.TxID), out.Vout, entry.Output.Value,
+			hex.EncodeToString(entry.Output.ScriptPubKey), entry.Height, entry.Coinbase})
+	}
+	return result, nil
+}
+
+func (s *RPCServer) getTxOut(params []json.RawMessage) (interface{}, error) {
+	var txidHex string
+	var vout int
+	if err := parseParams(params, 2, &txidHex, &vout); err != nil {
+		return nil, err
+	}
+	txid, err := parseHash(txidHex)
+	if err != nil {
+		return nil, err
+	}
+	if s.node.mempool.IsSpent(txid, vout) {
+		return nil, nil
+	}
+
+	entry, ok := (UTXOSet{s.node.bc}).GetEntry(txid, vout)
+	if !ok {
+		tx, inMempool := s.node.mempool.Get(txid)
+		if !inMempool || vout < 0 || vout >= len(tx.Vout) {
+			return nil, nil
+		}
+		entry = UTXOEntry{tx.Vout[vout], -1, false}
+	}
+	return &unspentInfo{txidHex, vout, entry.Output.Value, hex.EncodeToString(entry.Output.ScriptPubKey),
+		entry.Height, entry.Coinbase}, nil
+}
+
+func (s *RPCServer) sendToAddress(params []json.RawMessage) (interface{}, error) {
+	var from, to string
+	var amount, fee, feeRate int
+	var lock TimeLock
+	if err := parseParams(params, 3, &from, &to, &amount, &fee, &feeRate, &lock.LockTime, &lock.Blocks); err != nil {
+		return nil, err
+	}
+	if amount <= 0 || fee < 0 || feeRate < 0 {
+		return nil, newRPCError(rpcErrInvalidParams, "invalid amount or fee")
+	}
+
+	set := UTXOSet{s.node.bc}
+	tx, err := CreateTransactionFeeRate(s.nodeId, from, to, amount, fee, feeRate, lock, &set, s.node.mempool.IsSpent)
+	if err != nil {
+		if errors.Is(err, errInvalidAddress) || errors.Is(err, errAddressNotInWallet) {
+			return nil, newRPCError(rpcErrNotFound, "%v", err)
+		}
+		return nil, newRPCError(rpcErrWallet, "%v", err)
+	}
+
+	if err := s.node.submitTx(tx); err != nil {
+		return nil, newRPCError(rpcErrTxRejected, "%v", err)
+	}
+	return hex.EncodeToString(tx.ID), nil
+}
+
+func (s *RPCServer) generate(params []json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, 1, &address); err != nil {
+		return nil, err
+	}
+	if !ValidateAddress(address) {
+		return nil, newRPCError(rpcErrNotFound, "invalid address %q", address)
+	}
+
+	miner := NewMiner(s.node, address, runtime.NumCPU(), 0)
+	block, _ := miner.newTemplate()
+	if err := block.Mine(s.node.ctx, miner.workers); err != nil {
+		return nil, err
+	}
+	if err := miner.publish(block); err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(block.HeaderHash), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const rpcDialTimeout = time.Second
+
+var errNodeNotRunning = errors.New("node is not running, start it to broadcast transactions")
+
+type RPCClient struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+}
+
+type rpcClientResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+// connectRPC 返回正在运行的节点的 RPC 客户端，节点没有运行时返回 nil
+func connectRPC(nodeId string) *RPCClient {
+	data, err := os.ReadFile(fmt.Sprintf(rpcCookieFile, nodeId))
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		return nil
+	}
+	user, password, ok := strings.Cut(lines[0], ":")
+	if !ok {
+		return nil
+	}
+
+	conn, err := net.DialTimeout(protocol, lines[1], rpcDialTimeout)
+	if err != nil {
+		return nil
+	}
+	_ = conn.Close()
+
+	return &RPCClient{"http://" + lines[1], user, password, &http.Client{}}
+}
+
+func (c *RPCClient) Call(result interface{}, method string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.user, c.password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rpc %s: %s", method, resp.Status)
+	}
+
+	var payload rpcClientResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return err
+	}
+	if payload.Error != nil {
+		return payload.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(payload.Result, result)
+}
@@ -0,0 +1,846 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	OP_0                   = 0x00
+	OP_PUSHDATA1           = 0x4c
+	OP_PUSHDATA2           = 0x4d
+	OP_1NEGATE             = 0x4f
+	OP_1                   = 0x51
+	OP_16                  = 0x60
+	OP_NOP                 = 0x61
+	OP_VERIFY              = 0x69
+	OP_RETURN              = 0x6a
+	OP_DROP                = 0x75
+	OP_DUP                 = 0x76
+	OP_SWAP                = 0x7c
+	OP_SIZE                = 0x82
+	OP_EQUAL               = 0x87
+	OP_EQUALVERIFY         = 0x88
+	OP_1ADD                = 0x8b
+	OP_1SUB                = 0x8c
+	OP_NEGATE              = 0x8f
+	OP_ABS                 = 0x90
+	OP_NOT                 = 0x91
+	OP_0NOTEQUAL           = 0x92
+	OP_ADD                 = 0x93
+	OP_SUB                 = 0x94
+	OP_BOOLAND             = 0x9a
+	OP_BOOLOR              = 0x9b
+	OP_NUMEQUAL            = 0x9c
+	OP_NUMEQUALVERIFY      = 0x9d
+	OP_NUMNOTEQUAL         = 0x9e
+	OP_LESSTHAN            = 0x9f
+	OP_GREATERTHAN         = 0xa0
+	OP_LESSTHANOREQUAL     = 0xa1
+	OP_GREATERTHANOREQUAL  = 0xa2
+	OP_MIN                 = 0xa3
+	OP_MAX                 = 0xa4
+	OP_WITHIN              = 0xa5
+	OP_SHA256              = 0xa8
+	OP_HASH160             = 0xa9
+	OP_CHECKSIG            = 0xac
+	OP_CHECKSIGVERIFY      = 0xad
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+	OP_CHECKSEQUENCEVERIFY = 0xb2
+)
+
+// 脚本执行的限制
+const (
+	maxScriptSize         = 10000
+	maxScriptElementSize  = 520
+	maxOpsPerScript       = 201
+	maxStackSize          = 1000
+	maxPubKeysPerMultisig = 20
+	maxScriptNumLen       = 4
+	maxLockTimeNumLen     = 5
+)
+
+var opcodeNames = map[byte]string{
+	OP_0: "OP_0", OP_PUSHDATA1: "OP_PUSHDATA1", OP_PUSHDATA2: "OP_PUSHDATA2", OP_1NEGATE: "OP_1NEGATE",
+	OP_NOP: "OP_NOP", OP_VERIFY: "OP_VERIFY", OP_RETURN: "OP_RETURN",
+	OP_DROP: "OP_DROP", OP_DUP: "OP_DUP", OP_SWAP: "OP_SWAP", OP_SIZE: "OP_SIZE",
+	OP_EQUAL: "OP_EQUAL", OP_EQUALVERIFY: "OP_EQUALVERIFY",
+	OP_1ADD: "OP_1ADD", OP_1SUB: "OP_1SUB", OP_NEGATE: "OP_NEGATE", OP_ABS: "OP_ABS",
+	OP_NOT: "OP_NOT", OP_0NOTEQUAL: "OP_0NOTEQUAL", OP_ADD: "OP_ADD", OP_SUB: "OP_SUB",
+	OP_BOOLAND: "OP_BOOLAND", OP_BOOLOR: "OP_BOOLOR",
+	OP_NUMEQUAL: "OP_NUMEQUAL", OP_NUMEQUALVERIFY: "OP_NUMEQUALVERIFY", OP_NUMNOTEQUAL: "OP_NUMNOTEQUAL",
+	OP_LESSTHAN: "OP_LESSTHAN", OP_GREATERTHAN: "OP_GREATERTHAN",
+	OP_LESSTHANOREQUAL: "OP_LESSTHANOREQUAL", OP_GREATERTHANOREQUAL: "OP_GREATERTHANOREQUAL",
+	OP_MIN: "OP_MIN", OP_MAX: "OP_MAX", OP_WITHIN: "OP_WITHIN",
+	OP_SHA256: "OP_SHA256", OP_HASH160: "OP_HASH160",
+	OP_CHECKSIG: "OP_CHECKSIG", OP_CHECKSIGVERIFY: "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG: "OP_CHECKMULTISIG", OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY", OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+type ScriptError struct {
+	Detail string
+}
+
+func (e *ScriptError) Error() string {
+	return "script failed: " + e.Detail
+}
+
+func scriptErrorf(format string, args ...interface{}) error {
+	return &ScriptError{fmt.Sprintf(format, args...)}
+}
+
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+func isPushOpcode(opcode byte) bool {
+	return opcode <= OP_PUSHDATA2 || opcode == OP_1NEGATE || (opcode >= OP_1 && opcode <= OP_16)
+}
+
+func parseScript(script []byte) ([]scriptOp, error) {
+	var ops []scriptOp
+	for i := 0; i < len(script); {
+		opcode := script[i]
+		i++
+
+		n := -1
+		switch {
+		case opcode > OP_0 && opcode < OP_PUSHDATA1:
+			n = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, scriptErrorf("truncated OP_PUSHDATA1")
+			}
+			n = int(script[i])
+			i++
+		case opcode == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, scriptErrorf("truncated OP_PUSHDATA2")
+			}
+			n = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		}
+
+		if n < 0 {
+			ops = append(ops, scriptOp{opcode, nil})
+			continue
+		}
+		if i+n > len(script) {
+			return nil, scriptErrorf("push of %d bytes past end of script", n)
+		}
+		ops = append(ops, scriptOp{opcode, script[i : i+n]})
+		i += n
+	}
+	return ops, nil
+}
+
+func pushData(script, data []byte) []byte {
+	n := len(data)
+	switch {
+	case n == 0:
+		return append(script, OP_0)
+	case n == 1 && data[0] >= 1 && data[0] <= 16:
+		return append(script, OP_1+data[0]-1)
+	case n < OP_PUSHDATA1:
+		script = append(script, byte(n))
+	case n <= 0xff:
+		script = append(script, OP_PUSHDATA1, byte(n))
+	default:
+		script = append(script, OP_PUSHDATA2)
+		script = binary.LittleEndian.AppendUint16(script, uint16(n))
+	}
+	return append(script, data...)
+}
+
+func NewP2PKHScript(pubKeyHash []byte) []byte {
+	script := []byte{OP_DUP, OP_HASH160}
+	script = pushData(script, pubKeyHash)
+	return append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+func NewP2PKHScriptSig(signature, pubKey []byte) []byte {
+	return pushData(pushData(nil, signature), pubKey)
+}
+
+func ExtractPubKeyHash(script []byte) ([]byte, bool) {
+	if len(script) != 25 || script[0] != OP_DUP || script[1] != OP_HASH160 || script[2] != 20 ||
+		script[23] != OP_EQUALVERIFY || script[24] != OP_CHECKSIG {
+		return nil, false
+	}
+	return script[3:23], true
+}
+
+func NewP2SHScript(redeemScript []byte) []byte {
+	return newScriptHashScript(HashPubKey(redeemScript))
+}
+
+func newScriptHashScript(scriptHash []byte) []byte {
+	script := []byte{OP_HASH160}
+	script = pushData(script, scriptHash)
+	return append(script, OP_EQUAL)
+}
+
+func ExtractScriptHash(script []byte) ([]byte, bool) {
+	if len(script) != 23 || script[0] != OP_HASH160 || script[1] != 20 || script[22] != OP_EQUAL {
+		return nil, false
+	}
+	return script[2:22], true
+}
+
+func NewTimeLockScript(opcode byte, lock uint32, pubKeyHash []byte) []byte {
+	script := pushData(nil, encodeScriptNum(int64(lock)))
+	script = append(script, opcode, OP_DROP)
+	return append(script, NewP2PKHScript(pubKeyHash)...)
+}
+
+func ExtractTimeLock(script []byte) (byte, uint32, []byte, bool) {
+	if len(script) < 25 {
+		return 0, 0, nil, false
+	}
+	pubKeyHash, ok := ExtractPubKeyHash(script[len(script)-25:])
+	if !ok {
+		return 0, 0, nil, false
+	}
+	ops, err := parseScript(script[:len(script)-25])
+	if err != nil || len(ops) != 3 || ops[2].opcode != OP_DROP ||
+		(ops[1].opcode != OP_CHECKLOCKTIMEVERIFY && ops[1].opcode != OP_CHECKSEQUENCEVERIFY) {
+		return 0, 0, nil, false
+	}
+	value, ok := pushValue(ops[0])
+	if !ok {
+		return 0, 0, nil, false
+	}
+	lock, err := decodeScriptNumLen(value, maxLockTimeNumLen)
+	if err != nil || lock < 0 || lock > 0xffffffff {
+		return 0, 0, nil, false
+	}
+	return ops[1].opcode, uint32(lock), pubKeyHash, true
+}
+
+func scriptPubKeyHash(script []byte) ([]byte, bool) {
+	if pubKeyHash, ok := ExtractPubKeyHash(script); ok {
+		return pubKeyHash, true
+	}
+	_, _, pubKeyHash, ok := ExtractTimeLock(script)
+	return pubKeyHash, ok
+}
+
+func scriptAddressHash(script []byte) []byte {
+	if pubKeyHash, ok := scriptPubKeyHash(script); ok {
+		return pubKeyHash
+	}
+	if scriptHash, ok := ExtractScriptHash(script); ok {
+		return scriptHash
+	}
+	return nil
+}
+
+func NewMultisigScript(m int, pubKeys [][]byte) ([]byte, error) {
+	n := len(pubKeys)
+	if m < 1 || m > n || n > maxPubKeysPerMultisig {
+		return nil, fmt.Errorf("invalid %d-of-%d multisig", m, n)
+	}
+	script := pushData(nil, encodeScriptNum(int64(m)))
+	for _, pubKey := range pubKeys {
+		if len(pubKey) == 0 {
+			return nil, errors.New("empty public key")
+		}
+		script = pushData(script, pubKey)
+	}
+	script = pushData(script, encodeScriptNum(int64(n)))
+	script = append(script, OP_CHECKMULTISIG)
+	if len(script) > maxScriptElementSize {
+		return nil, fmt.Errorf("multisig script is %d bytes, at most %d", len(script), maxScriptElementSize)
+	}
+	return script, nil
+}
+
+func parseMultisigScript(script []byte) (int, [][]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+	small := func(op scriptOp) int {
+		if op.opcode >= OP_1 && op.opcode <= OP_16 {
+			return int(op.opcode-OP_1) + 1
+		}
+		return -1
+	}
+	m, n := small(ops[0]), small(ops[len(ops)-2])
+	keys := ops[1 : len(ops)-2]
+	if m < 1 || n != len(keys) || m > n {
+		return 0, nil, false
+	}
+
+	var pubKeys [][]byte
+	for _, op := range keys {
+		if len(op.data) == 0 {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, op.data)
+	}
+	return m, pubKeys, true
+}
+
+func scriptPushes(script []byte) ([][]byte, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil, err
+	}
+	var pushes [][]byte
+	for _, op := range ops {
+		value, ok := pushValue(op)
+		if !ok {
+			return nil, scriptErrorf("%s is not a push", opcodeName(op.opcode))
+		}
+		pushes = append(pushes, value)
+	}
+	return pushes, nil
+}
+
+func pushValue(op scriptOp) ([]byte, bool) {
+	switch {
+	case op.opcode == OP_1NEGATE:
+		return encodeScriptNum(-1), true
+	case op.opcode >= OP_1 && op.opcode <= OP_16:
+		return encodeScriptNum(int64(op.opcode - OP_1 + 1)), true
+	case isPushOpcode(op.opcode):
+		return op.data, true
+	}
+	return nil, false
+}
+
+func opcodeName(opcode byte) string {
+	if opcode >= OP_1 && opcode <= OP_16 {
+		return fmt.Sprintf("OP_%d", opcode-OP_1+1)
+	}
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("OP_UNKNOWN_%02x", opcode)
+}
+
+func DisassembleScript(script []byte) string {
+	ops, err := parseScript(script)
+	if err != nil {
+		return fmt.Sprintf("[invalid script %x]", script)
+	}
+	var parts []string
+	for _, op := range ops {
+		if op.data != nil {
+			parts = append(parts, hex.EncodeToString(op.data))
+		} else {
+			parts = append(parts, opcodeName(op.opcode))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func encodeScriptNum(v int64) []byte {
+	if v == 0 {
+		return nil
+	}
+	negative := v < 0
+	if negative {
+		v = -v
+	}
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append(b, byte(v))
+	}
+	if b[len(b)-1]&0x80 != 0 {
+		if negative {
+			b = append(b, 0x80)
+		} else {
+			b = append(b, 0x00)
+		}
+	} else if negative {
+		b[len(b)-1] |= 0x80
+	}
+	return b
+}
+
+func decodeScriptNum(b []byte) (int64, error) {
+	return decodeScriptNumLen(b, maxScriptNumLen)
+}
+
+func decodeScriptNumLen(b []byte, maxLen int) (int64, error) {
+	if len(b) > maxLen {
+		return 0, scriptErrorf("number of %d bytes is too long", len(b))
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if b[len(b)-1]&0x7f == 0 && (len(b) == 1 || b[len(b)-2]&0x80 == 0) {
+		return 0, scriptErrorf("number %x is not minimally encoded", b)
+	}
+
+	var v int64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | int64(b[i])
+	}
+	if b[len(b)-1]&0x80 != 0 {
+		v &^= int64(0x80) << (8 * (len(b) - 1))
+		v = -v
+	}
+	return v, nil
+}
+
+func castToBool(b []byte) bool {
+	for i, c := range b {
+		if c != 0 {
+			return !(i == len(b)-1 && c == 0x80)
+		}
+	}
+	return false
+}
+
+func encodeBool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return nil
+}
+
+// scriptChecker 提供脚本执行所需的交易上下文
+type scriptChecker interface {
+	CheckSig(signature, pubKey []byte) bool
+	CheckLockTime(lockTime int64) bool
+	CheckSequence(sequence int64) bool
+}
+
+type scriptStack [][]byte
+
+func (s *scriptStack) push(v []byte) {
+	*s = append(*s, v)
+}
+
+func (s *scriptStack) pop() ([]byte, error) {
+	if len(*s) == 0 {
+		return nil, scriptErrorf("stack underflow")
+	}
+	v := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	return v, nil
+}
+
+func (s *scriptStack) popNum() (int64, error) {
+	v, err := s.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNum(v)
+}
+
+func (s *scriptStack) peek() ([]byte, error) {
+	if len(*s) == 0 {
+		return nil, scriptErrorf("stack underflow")
+	}
+	return (*s)[len(*s)-1], nil
+}
+
+var errVerifyFailed = errors.New("verify failed")
+
+// VerifyScript 依次执行 scriptSig 和 scriptPubKey，P2SH 输出再执行赎回脚本
+func VerifyScript(scriptSig, scriptPubKey []byte, checker scriptChecker) error {
+	if len(scriptSig) > maxScriptSize {
+		return scriptErrorf("scriptSig is %d bytes", len(scriptSig))
+	}
+	pushes, err := scriptPushes(scriptSig)
+	if err != nil {
+		return fmt.Errorf("scriptSig: %w", err)
+	}
+
+	var stack scriptStack
+	for _, v := range pushes {
+		if len(v) > maxScriptElementSize {
+			return scriptErrorf("push of %d bytes exceeds %d", len(v), maxScriptElementSize)
+		}
+		stack.push(v)
+	}
+	if len(stack) > maxStackSize {
+		return scriptErrorf("stack size exceeds %d", maxStackSize)
+	}
+
+	if err := executeScript(scriptPubKey, &stack, checker); err != nil {
+		return err
+	}
+	if err := checkStackTop(stack); err != nil {
+		return err
+	}
+
+	if _, ok := ExtractScriptHash(scriptPubKey); !ok {
+		return nil
+	}
+	if len(pushes) == 0 {
+		return scriptErrorf("no redeem script for P2SH output")
+	}
+	redeemScript := pushes[len(pushes)-1]
+	stack = append(scriptStack{}, pushes[:len(pushes)-1]...)
+	if err := executeScript(redeemScript, &stack, checker); err != nil {
+		return fmt.Errorf("redeem script: %w", err)
+	}
+	return checkStackTop(stack)
+}
+
+func checkStackTop(stack scriptStack) error {
+	top, err := stack.peek()
+	if err != nil {
+		return scriptErrorf("empty stack at end of script")
+	}
+	if !castToBool(top) {
+		return scriptErrorf("false at end of script")
+	}
+	return nil
+}
+
+func executeScript(script []byte, stack *scriptStack, checker scriptChecker) error {
+	if len(script) > maxScriptSize {
+		return scriptErrorf("script is %d bytes", len(script))
+	}
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	opCount := 0
+	for _, op := range ops {
+		if op.opcode > OP_16 {
+			opCount++
+			if opCount > maxOpsPerScript {
+				return scriptErrorf("more than %d operations", maxOpsPerScript)
+			}
+		}
+		if err := executeOp(op, stack, checker, &opCount); err != nil {
+			if err == errVerifyFailed {
+				return scriptErrorf("%s failed", opcodeName(op.opcode))
+			}
+			return err
+		}
+		if len(*stack) > maxStackSize {
+			return scriptErrorf("stack size exceeds %d", maxStackSize)
+		}
+	}
+	return nil
+}
+
+func executeOp(op scriptOp, stack *scriptStack, checker scriptChecker, opCount *int) error {
+	switch {
+	case op.opcode == OP_1NEGATE:
+		stack.push(encodeScriptNum(-1))
+		return nil
+	case op.opcode >= OP_1 && op.opcode <= OP_16:
+		stack.push(encodeScriptNum(int64(op.opcode - OP_1 + 1)))
+		return nil
+	case isPushOpcode(op.opcode):
+		if len(op.data) > maxScriptElementSize {
+			return scriptErrorf("push of %d bytes exceeds %d", len(op.data), maxScriptElementSize)
+		}
+		stack.push(op.data)
+		return nil
+	}
+
+	switch op.opcode {
+	case OP_NOP:
+		return nil
+
+	case OP_VERIFY:
+		v, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		if !castToBool(v) {
+			return errVerifyFailed
+		}
+		return nil
+
+	case OP_RETURN:
+		return scriptErrorf("OP_RETURN executed")
+
+	case OP_DROP:
+		_, err := stack.pop()
+		return err
+
+	case OP_DUP:
+		v, err := stack.peek()
+		if err != nil {
+			return err
+		}
+		stack.push(v)
+		return nil
+
+	case OP_SWAP:
+		a, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		b, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		stack.push(a)
+		stack.push(b)
+		return nil
+
+	case OP_SIZE:
+		v, err := stack.peek()
+		if err != nil {
+			return err
+		}
+		stack.push(encodeScriptNum(int64(len(v))))
+		return nil
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		b, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		equal := bytes.Equal(a, b)
+		if op.opcode == OP_EQUALVERIFY {
+			if !equal {
+				return errVerifyFailed
+			}
+			return nil
+		}
+		stack.push(encodeBool(equal))
+		return nil
+
+	case OP_1ADD, OP_1SUB, OP_NEGATE, OP_ABS, OP_NOT, OP_0NOTEQUAL:
+		v, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		switch op.opcode {
+		case OP_1ADD:
+			v++
+		case OP_1SUB:
+			v--
+		case OP_NEGATE:
+			v = -v
+		case OP_ABS:
+			if v < 0 {
+				v = -v
+			}
+		case OP_NOT:
+			v = boolToNum(v == 0)
+		case OP_0NOTEQUAL:
+			v = boolToNum(v != 0)
+		}
+		stack.push(encodeScriptNum(v))
+		return nil
+
+	case OP_ADD, OP_SUB, OP_BOOLAND, OP_BOOLOR, OP_NUMEQUAL, OP_NUMEQUALVERIFY, OP_NUMNOTEQUAL,
+		OP_LESSTHAN, OP_GREATERTHAN, OP_LESSTHANOREQUAL, OP_GREATERTHANOREQUAL, OP_MIN, OP_MAX:
+		b, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		a, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		var v int64
+		switch op.opcode {
+		case OP_ADD:
+			v = a + b
+		case OP_SUB:
+			v = a - b
+		case OP_BOOLAND:
+			v = boolToNum(a != 0 && b != 0)
+		case OP_BOOLOR:
+			v = boolToNum(a != 0 || b != 0)
+		case OP_NUMEQUAL, OP_NUMEQUALVERIFY:
+			v = boolToNum(a == b)
+		case OP_NUMNOTEQUAL:
+			v = boolToNum(a != b)
+		case OP_LESSTHAN:
+			v = boolToNum(a < b)
+		case OP_GREATERTHAN:
+			v = boolToNum(a > b)
+		case OP_LESSTHANOREQUAL:
+			v = boolToNum(a <= b)
+		case OP_GREATERTHANOREQUAL:
+			v = boolToNum(a >= b)
+		case OP_MIN:
+			v = min(a, b)
+		case OP_MAX:
+			v = max(a, b)
+		}
+		if op.opcode == OP_NUMEQUALVERIFY {
+			if v == 0 {
+				return errVerifyFailed
+			}
+			return nil
+		}
+		stack.push(encodeScriptNum(v))
+		return nil
+
+	case OP_WITHIN:
+		hi, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		lo, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		x, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		stack.push(encodeBool(lo <= x && x < hi))
+		return nil
+
+	case OP_SHA256, OP_HASH160:
+		v, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		if op.opcode == OP_SHA256 {
+			hash := sha256.Sum256(v)
+			stack.push(hash[:])
+		} else {
+			stack.push(HashPubKey(v))
+		}
+		return nil
+
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		ok := len(signature) > 0 && checker.CheckSig(signature, pubKey)
+		if op.opcode == OP_CHECKSIGVERIFY {
+			if !ok {
+				return errVerifyFailed
+			}
+			return nil
+		}
+		stack.push(encodeBool(ok))
+		return nil
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		v, err := stack.peek()
+		if err != nil {
+			return err
+		}
+		lockTime, err := decodeScriptNumLen(v, maxLockTimeNumLen)
+		if err != nil {
+			return err
+		}
+		if lockTime < 0 {
+			return scriptErrorf("negative lock time %d", lockTime)
+		}
+		if !checker.CheckLockTime(lockTime) {
+			return errVerifyFailed
+		}
+		return nil
+
+	case OP_CHECKSEQUENCEVERIFY:
+		v, err := stack.peek()
+		if err != nil {
+			return err
+		}
+		sequence, err := decodeScriptNumLen(v, maxLockTimeNumLen)
+		if err != nil {
+			return err
+		}
+		if sequence < 0 {
+			return scriptErrorf("negative sequence %d", sequence)
+		}
+		if sequence&sequenceDisableFlag != 0 {
+			return nil
+		}
+		if !checker.CheckSequence(sequence) {
+			return errVerifyFailed
+		}
+		return nil
+
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		ok, err := checkMultisig(stack, checker, opCount)
+		if err != nil {
+			return err
+		}
+		if op.opcode == OP_CHECKMULTISIGVERIFY {
+			if !ok {
+				return errVerifyFailed
+			}
+			return nil
+		}
+		stack.push(encodeBool(ok))
+		return nil
+	}
+
+	return scriptErrorf("unknown opcode %s", opcodeName(op.opcode))
+}
+
+func boolToNum(v bool) int64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// checkMultisig 要求签名与公钥按相同顺序对应，不额外弹出一个元素
+func checkMultisig(stack *scriptStack, checker scriptChecker, opCount *int) (bool, error) {
+	n, err := stack.popNum()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > maxPubKeysPerMultisig {
+		return false, scriptErrorf("%d public keys for OP_CHECKMULTISIG", n)
+	}
+	*opCount += int(n)
+	if *opCount > maxOpsPerScript {
+		return false, scriptErrorf("more than %d operations", maxOpsPerScript)
+	}
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if pubKeys[i], err = stack.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	m, err := stack.popNum()
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, scriptErrorf("%d of %d signatures for OP_CHECKMULTISIG", m, n)
+	}
+	signatures := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if signatures[i], err = stack.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	k := 0
+	for _, signature := range signatures {
+		for k < len(pubKeys) && !(len(signature) > 0 && checker.CheckSig(signature, pubKeys[k])) {
+			k++
+		}
+		if k == len(pubKeys) {
+			return false, nil
+		}
+		k++
+	}
+	return true, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+type testChecker struct {
+	lockTime, sequence int64
+}
+
+var validSig = []byte("valid signature")
+
+func (c testChecker) CheckSig(signature, pubKey []byte) bool {
+	return bytes.Equal(signature, validSig)
+}
+
+func (c testChecker) CheckLockTime(lockTime int64) bool {
+	return lockTime <= c.lockTime
+}
+
+func (c testChecker) CheckSequence(sequence int64) bool {
+	return sequence <= c.sequence
+}
+
+func testScript(items ...interface{}) []byte {
+	var script []byte
+	for _, item := range items {
+		switch v := item.(type) {
+		case byte:
+			script = append(script, v)
+		case []byte:
+			script = pushData(script, v)
+		case int:
+			script = pushData(script, encodeScriptNum(int64(v)))
+		}
+	}
+	return script
+}
+
+func repeatOp(op byte, n int) []byte {
+	return bytes.Repeat([]byte{op}, n)
+}
+
+func TestVerifyScript(t *testing.T) {
+	data := []byte("data")
+	hash := sha256.Sum256(data)
+	pubKey := []byte("public key")
+	redeemScript := testScript(2, byte(OP_ADD), 5, byte(OP_NUMEQUAL))
+	multisig := testScript(1, pubKey, []byte("other key"), 2, byte(OP_CHECKMULTISIG))
+
+	tests := []struct {
+		name         string
+		scriptSig    []byte
+		scriptPubKey []byte
+		err          string // 为空表示通过，否则为错误信息的一部分
+	}{
+		{"add", testScript(2, 3), testScript(byte(OP_ADD), 5, byte(OP_NUMEQUAL)), ""},
+		{"sub to negative", testScript(2, 3), testScript(byte(OP_SUB), byte(OP_1NEGATE), byte(OP_NUMEQUAL)), ""},
+		{"abs negate", testScript(byte(OP_1NEGATE)), testScript(byte(OP_ABS), byte(OP_NEGATE), byte(OP_1ADD), byte(OP_NOT)), ""},
+		{"dup size max", testScript(3, 7), testScript(byte(OP_DUP), byte(OP_SIZE), byte(OP_DROP), byte(OP_DROP), byte(OP_MAX), 7, byte(OP_NUMEQUAL)), ""},
+		{"within", testScript(5), testScript(5, 6, byte(OP_WITHIN)), ""},
+		{"not within", testScript(6), testScript(5, 6, byte(OP_WITHIN)), "false at end"},
+		{"swap compare", testScript(1, 2), testScript(byte(OP_SWAP), byte(OP_GREATERTHAN)), ""},
+		{"booland", testScript(1, 0), testScript(byte(OP_BOOLAND)), "false at end"},
+		{"sha256", testScript(data), testScript(byte(OP_SHA256), hash[:], byte(OP_EQUAL)), ""},
+		{"hash160", testScript(data), testScript(byte(OP_HASH160), HashPubKey(data), byte(OP_EQUALVERIFY), 1), ""},
+		{"negative zero is false", testScript([]byte{0x80}), nil, "false at end"},
+
+		{"p2pkh", NewP2PKHScriptSig(validSig, pubKey), NewP2PKHScript(HashPubKey(pubKey)), ""},
+		{"p2pkh wrong key", NewP2PKHScriptSig(validSig, data), NewP2PKHScript(HashPubKey(pubKey)), "OP_EQUALVERIFY failed"},
+		{"checksig fails", NewP2PKHScriptSig([]byte("bad"), pubKey), NewP2PKHScript(HashPubKey(pubKey)), "false at end"},
+		{"checksigverify fails", testScript([]byte("bad"), pubKey), testScript(byte(OP_CHECKSIGVERIFY), 1), "OP_CHECKSIGVERIFY failed"},
+		{"empty signature", testScript([]byte{}, pubKey), testScript(byte(OP_CHECKSIG)), "false at end"},
+		{"multisig", testScript(validSig), multisig, ""},
+		{"multisig bad signature", testScript([]byte("bad")), multisig, "false at end"},
+		{"multisig too many keys", testScript(0), append(repeatOp(OP_1, 21), testScript(21, byte(OP_CHECKMULTISIG))...), "21 public keys"},
+		{"p2sh", testScript(3, redeemScript), NewP2SHScript(redeemScript), ""},
+		{"p2sh redeem script false", testScript(4, redeemScript), NewP2SHScript(redeemScript), "false at end"},
+		{"p2sh redeem script fails", testScript(redeemScript), NewP2SHScript(redeemScript), "redeem script: script failed: stack underflow"},
+		{"p2sh wrong redeem script", testScript(3, redeemScript[1:]), NewP2SHScript(redeemScript), "false at end"},
+		{"p2sh without redeem script", nil, NewP2SHScript(redeemScript), "stack underflow"},
+
+		{"cltv reached", nil, testScript(100, byte(OP_CHECKLOCKTIMEVERIFY)), ""},
+		{"cltv not reached", nil, testScript(101, byte(OP_CHECKLOCKTIMEVERIFY)), "OP_CHECKLOCKTIMEVERIFY failed"},
+		{"cltv negative", nil, testScript(-1, byte(OP_CHECKLOCKTIMEVERIFY)), "negative lock time"},
+		{"csv not reached", nil, testScript(11, byte(OP_CHECKSEQUENCEVERIFY)), "OP_CHECKSEQUENCEVERIFY failed"},
+		{"csv disabled", nil, testScript(sequenceDisableFlag|11, byte(OP_CHECKSEQUENCEVERIFY)), ""},
+
+		{"verify fails", testScript(0), testScript(byte(OP_VERIFY), 1), "OP_VERIFY failed"},
+		{"equalverify fails", testScript(1, 2), testScript(byte(OP_EQUALVERIFY), 1), "OP_EQUALVERIFY failed"},
+		{"numequalverify fails", testScript(1, 2), testScript(byte(OP_NUMEQUALVERIFY), 1), "OP_NUMEQUALVERIFY failed"},
+		{"return", testScript(1), testScript(byte(OP_RETURN)), "OP_RETURN executed"},
+		{"disabled OP_CAT", testScript(data, data), []byte{0x7e}, "unknown opcode OP_UNKNOWN_7e"},
+		{"disabled OP_MUL", testScript(2, 3), []byte{0x95}, "unknown opcode"},
+
+		{"empty stack", nil, testScript(byte(OP_NOP)), "empty stack"},
+		{"underflow", nil, testScript(byte(OP_DROP)), "stack underflow"},
+		{"number too long", testScript([]byte{1, 2, 3, 4, 5}), testScript(byte(OP_1ADD)), "too long"},
+		{"number not minimal", testScript([]byte{1, 0}), testScript(byte(OP_1ADD)), "not minimally encoded"},
+		{"non-push scriptSig", testScript(1, byte(OP_DUP)), testScript(1), "OP_DUP is not a push"},
+
+		{"element size limit", testScript(make([]byte, maxScriptElementSize)), testScript(byte(OP_SIZE)), ""},
+		{"element too large in scriptSig", testScript(make([]byte, maxScriptElementSize+1)), testScript(1), "exceeds 520"},
+		{"element too large in scriptPubKey", nil, testScript(make([]byte, maxScriptElementSize+1)), "exceeds 520"},
+		{"scriptSig too large", repeatOp(OP_1, maxScriptSize+1), nil, "scriptSig is 10001 bytes"},
+		{"script too large", nil, repeatOp(OP_1, maxScriptSize+1), "script is 10001 bytes"},
+		{"operation limit", nil, append(repeatOp(OP_NOP, maxOpsPerScript), OP_1), ""},
+		{"too many operations", nil, append(repeatOp(OP_NOP, maxOpsPerScript+1), OP_1), "more than 201 operations"},
+		{"stack limit", nil, repeatOp(OP_1, maxStackSize), ""},
+		{"stack too large", nil, repeatOp(OP_1, maxStackSize+1), "stack size exceeds 1000"},
+		{"scriptSig stack too large", repeatOp(OP_1, maxStackSize+1), nil, "stack size exceeds 1000"},
+
+		{"truncated pushdata1", nil, []byte{OP_PUSHDATA1}, "truncated OP_PUSHDATA1"},
+		{"truncated pushdata2", nil, []byte{OP_PUSHDATA2, 1}, "truncated OP_PUSHDATA2"},
+		{"push past end", nil, []byte{5, 1, 2}, "push of 5 bytes past end"},
+		{"pushdata1 past end", nil, []byte{OP_PUSHDATA1, 3, 1}, "push of 3 bytes past end"},
+		{"malformed scriptSig", []byte{2, 1}, testScript(1), "scriptSig: script failed: push of 2 bytes past end"},
+	}
+
+	checker := testChecker{lockTime: 100, sequence: 10}
+	for _, tt := range tests {
+		err := VerifyScript(tt.scriptSig, tt.scriptPubKey, checker)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%s: passed, want %q", tt.name, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%s: got %q, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestScriptNum(t *testing.T) {
+	for _, v := range []int64{0, 1, -1, 127, -127, 128, -128, 255, 256, 1<<31 - 1, -(1<<31 - 1)} {
+		got, err := decodeScriptNum(encodeScriptNum(v))
+		if err != nil || got != v {
+			t.Errorf("%d decoded as %d, %v", v, got, err)
+		}
+	}
+	for _, b := range [][]byte{{0}, {0x80}, {1, 0}, {1, 0x80}} {
+		if _, err := decodeScriptNum(b); err == nil {
+			t.Errorf("non-minimal %x decoded", b)
+		}
+	}
+}
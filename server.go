@@ -2,34 +2,67 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
-	"encoding/hex"
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const protocol = "tcp"
-const nodeVersion = 1
+const nodeVersion = 2
 const commandLength = 12
 
 // commands
 const (
-	VERSION    = "version"
-	GET_BLOCKS = "getBlocks"
-	INV        = "inv"
-	GET_DATA   = "getdata"
-	BLOCK      = "block"
-	TX         = "tx"
-	ADDR       = "addr"
+	VERSION     = "version"
+	GET_HEADERS = "getheaders"
+	HEADERS     = "headers"
+	INV         = "inv"
+	GET_DATA    = "getdata"
+	BLOCK       = "block"
+	TX          = "tx"
+	ADDR        = "addr"
 )
 
-var nodeAddress string
-var miningAddress string
-var knownNodes = []string{"localhost:3000"}
-var blocksInTransit = [][]byte{}
-var mempool = make(map[string]Transaction)
+const centralNode = "localhost:3000"
+
+// Node 持有节点的运行状态，mu 保护已知节点、区块下载进度和孤块
+type Node struct {
+	address string
+	bc      *Blockchain
+	miner   *Miner
+	ctx     context.Context // 节点关闭时取消，挖矿等长时间运行的操作随之停止
+	stop    context.CancelFunc
+
+	mu         sync.Mutex
+	knownNodes []string
+	mempool    *Mempool
+	download   blockDownload
+	orphans    orphanPool
+
+	peersMu sync.Mutex
+	peers   map[string]*Peer
+}
+
+func NewNode(address string, bc *Blockchain) *Node {
+	ctx, stop := context.WithCancel(context.Background())
+	return &Node{
+		address:    address,
+		bc:         bc,
+		ctx:        ctx,
+		stop:       stop,
+		knownNodes: []string{centralNode},
+		mempool:    NewMempool(bc),
+		download:   newBlockDownload(),
+		orphans:    newOrphanPool(),
+		peers:      make(map[string]*Peer),
+	}
+}
 
 type version struct {
 	Version    int
@@ -37,29 +70,21 @@ type version struct {
 	AddrFrom   string
 }
 
-type getblocks struct {
-	AddrFrom string
-}
-
 type inv struct {
-	AddrFrom string
-	Type     string
-	Items    [][]byte
+	Type  string
+	Items [][]byte
 }
 
 type getdata struct {
-	AddrFrom string
-	Type     string
-	ID       []byte
+	Type string
+	ID   []byte
 }
 
 type block struct {
-	AddrFrom string
-	Block    []byte
+	Block []byte
 }
 
 type tx struct {
-	AddrFrom    string
 	Transaction []byte
 }
 
@@ -67,356 +92,349 @@ type addr struct {
 	AddrList []string
 }
 
-func sendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
+func (n *Node) dial(addr string) (*Peer, bool) {
+	peer, err := n.getPeer(addr)
 	if err != nil {
 		fmt.Printf("%s is not available\n", addr)
-		var updateNodes []string
-
-		for _, node := range knownNodes {
-			if node != addr {
-				updateNodes = append(updateNodes, node)
-			}
-		}
-
-		knownNodes = updateNodes
-		return
+		n.removeKnownNode(addr)
+		return nil, false
 	}
-	defer func(conn net.Conn) {
-		err := conn.Close()
-		if err != nil {
-			log.Println(err)
-		}
-	}(conn)
-
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	if err != nil {
-		log.Panic(err)
-	}
-}
-
-func sendVersion(addr string, bc *Blockchain) {
-	bestHeight := bc.GetBestHeight()
-	payload := gobEncode(version{nodeVersion, bestHeight, nodeAddress})
-
-	request := append(commandToBytes(VERSION), payload...)
-
-	sendData(addr, request)
-}
-
-func sendGetBlocks(addr string) {
-	payload := gobEncode(getblocks{nodeAddress})
-	request := append(commandToBytes(GET_BLOCKS), payload...)
-
-	sendData(addr, request)
+	return peer, true
 }
 
-func sendInv(addr, t string, items [][]byte) {
-	payload := gobEncode(inv{nodeAddress, t, items})
-	request := append(commandToBytes(INV), payload...)
-
-	sendData(addr, request)
+func (n *Node) sendVersion(p *Peer) {
+	bestHeight := n.bc.GetBestHeight()
+	p.Send(VERSION, encodeMessage(&version{nodeVersion, bestHeight, n.address}))
 }
 
-func sendGetData(addr, t string, hash []byte) {
-	payload := gobEncode(getdata{nodeAddress, t, hash})
-	request := append(commandToBytes(GET_DATA), payload...)
-
-	sendData(addr, request)
+func (n *Node) sendInv(p *Peer, t string, items [][]byte) {
+	p.Send(INV, encodeMessage(&inv{t, items}))
 }
 
-func sendBlock(addr string, b *Block) {
-	payload := gobEncode(block{nodeAddress, b.Serialize()})
-	request := append(commandToBytes(BLOCK), payload...)
-
-	sendData(addr, request)
+func (n *Node) sendGetData(p *Peer, t string, hash []byte) {
+	p.Send(GET_DATA, encodeMessage(&getdata{t, hash}))
 }
 
-func sendTx(addr string, t *Transaction) {
-	payload := gobEncode(tx{nodeAddress, t.Serialize()})
-	request := append(commandToBytes(TX), payload...)
-
-	sendData(addr, request)
+func (n *Node) sendBlock(p *Peer, b *Block) {
+	p.Send(BLOCK, encodeMessage(&block{b.Serialize()}))
 }
 
-func sendAddr(address string) {
-	nodes := addr{knownNodes}
-	nodes.AddrList = append(nodes.AddrList, nodeAddress)
-	payload := gobEncode(nodes)
-	request := append(commandToBytes(ADDR), payload...)
-
-	sendData(address, request)
+func (n *Node) sendTx(p *Peer, t *Transaction) {
+	p.Send(TX, encodeMessage(&tx{t.Serialize()}))
 }
 
-func handleAddr(request []byte, bc *Blockchain) {
-	var buffer bytes.Buffer
+func (n *Node) handleAddr(p *Peer, data []byte) error {
 	var payload addr
 
-	buffer.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buffer)
-	err := dec.Decode(&payload)
+	err := decodeMessage(data, &payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	knownNodes = append(knownNodes, payload.AddrList...)
+	for _, node := range payload.AddrList {
+		n.addKnownNode(node)
+	}
+	knownNodes := n.getKnownNodes()
 	fmt.Printf("known nodes: %d\n", len(knownNodes))
 	for _, node := range knownNodes {
-		sendGetBlocks(node)
+		if peer, ok := n.dial(node); ok {
+			n.sendGetHeaders(peer)
+		}
 	}
+	return nil
 }
 
-func handleTx(request []byte, bc *Blockchain) {
-	var buffer bytes.Buffer
+func (n *Node) handleTx(p *Peer, data []byte) error {
 	var payload tx
 
-	buffer.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buffer)
-	err := dec.Decode(&payload)
+	err := decodeMessage(data, &payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	txData := payload.Transaction
-	tx := DeserializeTransaction(txData)
-	mempool[hex.EncodeToString(tx.ID)] = tx
-
-	if nodeAddress == knownNodes[0] {
-		for _, node := range knownNodes {
-			if node != nodeAddress && node != payload.AddrFrom {
-				sendInv(node, TX, [][]byte{tx.ID})
-			}
-		}
-	} else {
-		if len(mempool) >= 2 && len(miningAddress) > 0 {
-		MineTransactions:
-			var txs []*Transaction
-
-			for id := range mempool {
-				tx := mempool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
-			}
-
-			if len(txs) == 0 {
-				fmt.Println("All transactions are invalid! Waiting for new ones...")
-				return
-			}
-
-			cbTx := NewCoinBaseTX(miningAddress, "")
-			txs = append(txs, cbTx)
-
-			newBlock := bc.MineBlock(txs)
-			set := UTXOSet{bc}
-			set.Update(newBlock)
+	tx, err := decodeTransaction(payload.Transaction)
+	if err != nil {
+		return err
+	}
+	if err := n.mempool.Add(&tx); err != nil {
+		fmt.Println(err)
+		return nil
+	}
 
-			fmt.Println("New block mined!")
+	if n.address == centralNode {
+		n.announceTx(&tx, p)
+	}
+	if n.miner != nil {
+		n.miner.notify()
+	}
+	return nil
+}
 
-			for _, tx := range txs {
-				txID := hex.EncodeToString(tx.ID)
-				delete(mempool, txID)
-			}
+func (n *Node) submitTx(tx *Transaction) error {
+	if err := n.mempool.Add(tx); err != nil {
+		return err
+	}
 
-			for _, node := range knownNodes {
-				if node != nodeAddress {
-					sendInv(node, TX, [][]byte{newBlock.HeaderHash})
-				}
-			}
+	n.announceTx(tx, nil)
+	if n.miner != nil {
+		n.miner.notify()
+	}
+	return nil
+}
 
-			if len(mempool) > 0 {
-				goto MineTransactions
-			}
+func (n *Node) announceTx(tx *Transaction, except *Peer) {
+	for _, node := range n.getKnownNodes() {
+		if node == n.address {
+			continue
+		}
+		if peer, ok := n.dial(node); ok && peer != except {
+			n.sendInv(peer, TX, [][]byte{tx.ID})
 		}
 	}
 }
 
-func handleBlock(request []byte, bc *Blockchain) {
-	var buffer bytes.Buffer
+func (n *Node) handleBlock(p *Peer, data []byte) error {
 	var payload block
 
-	buffer.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buffer)
-	err := dec.Decode(&payload)
+	err := decodeMessage(data, &payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	blockData := payload.Block
-	newBlock := DeserializeBlock(blockData)
+	newBlock, err := decodeBlock(payload.Block)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Received a new block")
-	// todo verify new block
-	bc.AddBlock(newBlock)
+	if n.receiveDownloadedBlock(newBlock, p) {
+		return nil
+	}
+
+	orphan, err := n.receiveBlock(newBlock)
+	if err != nil {
+		fmt.Println(err)
+	} else if orphan {
+		n.sendGetHeaders(p)
+	}
+	return nil
+}
+
+func (n *Node) receiveBlock(block *Block) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-	fmt.Printf("Added block %x\n", newBlock.HeaderHash)
+	if _, err := n.bc.findBlock(block.PrevBlockHeaderHash); err != nil {
+		return true, n.addOrphan(block)
+	}
+	return false, n.processBlock(block)
+}
 
-	set := UTXOSet{bc}
-	set.Update(newBlock)
+func (n *Node) processBlock(block *Block) error {
+	if err := n.acceptBlock(block); err != nil {
+		return err
+	}
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, BLOCK, blockHash)
+	parents := [][]byte{block.HeaderHash}
+	for len(parents) > 0 {
+		for _, orphan := range n.orphans.takeChildren(parents[0]) {
+			if err := n.acceptBlock(orphan); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			parents = append(parents, orphan.HeaderHash)
+		}
+		parents = parents[1:]
+	}
+	return nil
+}
 
-		blocksInTransit = blocksInTransit[1:]
+func (n *Node) acceptBlock(block *Block) error {
+	if _, err := n.bc.findBlock(block.HeaderHash); err == nil {
+		fmt.Printf("Block %x already known\n", block.HeaderHash)
+		return nil
 	}
+	if err := n.bc.ValidateBlock(block); err != nil {
+		return err
+	}
+	oldTip := n.bc.getTip()
+	txs, err := n.bc.AddBlock(block)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added block %x\n", block.HeaderHash)
+
+	if !bytes.Equal(n.bc.getTip(), block.HeaderHash) {
+		return nil
+	}
+	if bytes.Equal(block.PrevBlockHeaderHash, oldTip) {
+		n.mempool.RemoveForBlock(block)
+	} else {
+		n.mempool.Revalidate(txs)
+	}
+	return nil
 }
 
-func handleGetData(request []byte, bc *Blockchain) {
-	var buffer bytes.Buffer
+func (n *Node) handleGetData(p *Peer, data []byte) error {
 	var payload getdata
 
-	buffer.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buffer)
-	err := dec.Decode(&payload)
+	err := decodeMessage(data, &payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	if payload.Type == BLOCK {
-		block := bc.GetBlock(payload.ID)
+		block, err := n.bc.findBlock(payload.ID)
+		if err != nil {
+			return nil
+		}
 
-		sendBlock(payload.AddrFrom, &block)
+		n.sendBlock(p, block)
 	} else if payload.Type == TX {
-		txId := hex.EncodeToString(payload.ID)
-		tx := mempool[txId]
+		tx, ok := n.mempool.Get(payload.ID)
+		if !ok {
+			return nil
+		}
 
-		sendTx(payload.AddrFrom, &tx)
+		n.sendTx(p, tx)
 	}
+	return nil
 }
 
-func handleInv(request []byte, bc *Blockchain) {
-	var buffer bytes.Buffer
+func (n *Node) handleInv(p *Peer, data []byte) error {
 	var payload inv
 
-	buffer.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buffer)
-	err := dec.Decode(&payload)
+	err := decodeMessage(data, &payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
+	if len(payload.Items) == 0 {
+		return nil
+	}
 
 	if payload.Type == BLOCK {
-		blocksInTransit = payload.Items
-
-		blockHash := payload.Items[0]
-		sendGetData(payload.AddrFrom, BLOCK, blockHash)
-
-		var newTransit [][]byte
-		for _, out := range blocksInTransit {
-			if bytes.Compare(blockHash, out) != 0 {
-				newTransit = append(newTransit, out)
+		n.mu.Lock()
+		unknown := false
+		for _, hash := range payload.Items {
+			if !n.isKnownBlock(hash) {
+				unknown = true
 			}
 		}
-		blocksInTransit = newTransit
+		n.mu.Unlock()
+
+		if unknown {
+			n.sendGetHeaders(p)
+		}
 	} else if payload.Type == TX {
 		txId := payload.Items[0]
 
-		if mempool[hex.EncodeToString(txId)].ID == nil {
-			sendGetData(payload.AddrFrom, TX, txId)
+		if !n.mempool.Has(txId) {
+			n.sendGetData(p, TX, txId)
 		}
 	}
+	return nil
 }
 
-func handleGetBlocks(request []byte, bc *Blockchain) {
-	var buffer bytes.Buffer
-	var payload getblocks
+func (n *Node) handleVersion(p *Peer, data []byte) error {
+	var payload version
 
-	buffer.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buffer)
-	err := dec.Decode(&payload)
+	err := decodeMessage(data, &payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	blocks := bc.GetBlockHashes()
-	sendInv(payload.AddrFrom, BLOCK, blocks)
-}
-
-func handleVersion(request []byte, bc *Blockchain) {
-	var buffer bytes.Buffer
-	var payload version
-
-	buffer.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buffer)
-	err := dec.Decode(&payload)
-	if err != nil {
-		fmt.Println("Error decoding version")
+	if p.listenAddr == "" && payload.AddrFrom != "" {
+		p.listenAddr = payload.AddrFrom
+		n.registerPeer(payload.AddrFrom, p)
+		n.addKnownNode(payload.AddrFrom)
 	}
 
-	myBestHeight := bc.GetBestHeight()
+	myBestHeight := n.bc.GetBestHeight()
 	foreignerBestHeight := payload.BestHeight
 
 	if myBestHeight < foreignerBestHeight {
-		sendGetBlocks(payload.AddrFrom)
+		n.sendGetHeaders(p)
 	} else if myBestHeight > foreignerBestHeight {
-		sendVersion(payload.AddrFrom, bc)
-	}
-
-	if !nodeIsKnown(payload.AddrFrom) {
-		knownNodes = append(knownNodes, payload.AddrFrom)
+		n.sendVersion(p)
 	}
+	return nil
 }
 
-func handleConnection(conn net.Conn, bc *Blockchain) {
-	request, err := io.ReadAll(conn)
-	if err != nil {
-		log.Fatal(err)
-	}
-	command := bytesToCommand(request[:commandLength])
+func (n *Node) handleMessage(p *Peer, command string, payload []byte) error {
 	fmt.Println("Received command:", command)
+	if n.bc == nil {
+		return nil
+	}
 
 	switch command {
 	case VERSION:
-		handleVersion(request, bc)
-		break
-	case GET_BLOCKS:
-		handleGetBlocks(request, bc)
-		break
+		return n.handleVersion(p, payload)
+	case GET_HEADERS:
+		return n.handleGetHeaders(p, payload)
+	case HEADERS:
+		return n.handleHeaders(p, payload)
 	case INV:
-		handleInv(request, bc)
-		break
+		return n.handleInv(p, payload)
 	case GET_DATA:
-		handleGetData(request, bc)
-		break
+		return n.handleGetData(p, payload)
 	case BLOCK:
-		handleBlock(request, bc)
-		break
+		return n.handleBlock(p, payload)
 	case TX:
-		handleTx(request, bc)
-		break
+		return n.handleTx(p, payload)
 	case ADDR:
-		handleAddr(request, bc)
-		break
+		return n.handleAddr(p, payload)
 	default:
 		fmt.Println("Unknown command:", command)
 	}
-	err = conn.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
+	return nil
 }
 
-func StartServer(nodeId, minerAddress string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeId)
-	miningAddress = minerAddress
+type ServerOptions struct {
+	MinerAddress  string // 非空时在后台挖矿，奖励发往该地址
+	MinerThreads  int
+	EmptyInterval time.Duration // 大于 0 时，内存池为空也会按此间隔挖出空区块
+	RPCPort       int           // 0 表示使用节点端口加 rpcPortOffset
+	RPCUser       string
+	RPCPassword   string
+}
+
+func StartServer(nodeId string, opts ServerOptions) {
+	nodeAddress := fmt.Sprintf("localhost:%s", nodeId)
 	ln, err := net.Listen(protocol, nodeAddress)
+	if err != nil {
+		panic(err)
+	}
 	defer func(ln net.Listener) {
 		err := ln.Close()
 		if err != nil {
 			panic(err)
 		}
 	}(ln)
-	if err != nil {
-		panic(err)
-	}
 
 	bc := NewBlockChain(nodeId)
+	node := NewNode(nodeAddress, bc)
+	go closeOnSignal(nodeId, node)
+	go node.checkStalledDownloads()
+	if opts.MinerAddress != "" {
+		node.miner = NewMiner(node, opts.MinerAddress, opts.MinerThreads, opts.EmptyInterval)
+		go node.miner.run()
+	}
 
-	if nodeAddress != knownNodes[0] {
-		sendVersion(knownNodes[0], bc)
+	rpcAddress := fmt.Sprintf("localhost:%d", rpcPort(nodeId, opts.RPCPort))
+	rpc, err := NewRPCServer(node, nodeId, rpcAddress, opts.RPCUser, opts.RPCPassword)
+	if err != nil {
+		log.Panic(err)
+	}
+	go func() {
+		log.Panic(rpc.ListenAndServe())
+	}()
+
+	if nodeAddress != centralNode {
+		if peer, ok := node.dial(centralNode); ok {
+			node.sendVersion(peer)
+		}
 	}
 
 	for {
@@ -424,15 +442,27 @@ func StartServer(nodeId, minerAddress string) {
 		if err != nil {
 			panic(err)
 		}
-		go handleConnection(conn, bc)
+		node.newPeer(conn, "").start()
+	}
+}
+
+func closeOnSignal(nodeId string, node *Node) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	fmt.Println("Shutting down")
+	node.stop()
+	_ = os.Remove(fmt.Sprintf(rpcCookieFile, nodeId))
+	if err := node.bc.Close(); err != nil {
+		log.Panic(err)
 	}
+	os.Exit(0)
 }
 
 func commandToBytes(command string) []byte {
 	var b [commandLength]byte
-	for i, c := range command {
-		b[i] = byte(c)
-	}
+	copy(b[:], command)
 	return b[:]
 }
 
@@ -447,22 +477,34 @@ func bytesToCommand(bytes []byte) string {
 	return fmt.Sprintf("%s", command)
 }
 
-func gobEncode(v interface{}) []byte {
-	var buffer bytes.Buffer
+func (n *Node) getKnownNodes() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-	dec := gob.NewEncoder(&buffer)
-	err := dec.Encode(v)
-	if err != nil {
-		fmt.Println("Error encoding version")
-	}
-	return buffer.Bytes()
+	return append([]string{}, n.knownNodes...)
 }
 
-func nodeIsKnown(addr string) bool {
-	for _, knownNode := range knownNodes {
+func (n *Node) addKnownNode(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, knownNode := range n.knownNodes {
 		if addr == knownNode {
-			return true
+			return
+		}
+	}
+	n.knownNodes = append(n.knownNodes, addr)
+}
+
+func (n *Node) removeKnownNode(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var updatedNodes []string
+	for _, node := range n.knownNodes {
+		if node != addr {
+			updatedNodes = append(updatedNodes, node)
 		}
 	}
-	return false
+	n.knownNodes = updatedNodes
 }
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const raceTestPeers = 16
+const raceTestBlocks = 40
+
+func raceTestChain(t *testing.T, src *Blockchain, w *Wallet) ([]*Block, []*Transaction) {
+	address := string(w.GetAddress())
+	genesis, err := src.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbases := []*Transaction{genesis.Transactions[0]}
+
+	var blocks []*Block
+	for height := 1; height <= raceTestBlocks; height++ {
+		var txs []*Transaction
+		fees := 0
+		if height%2 == 0 {
+			txs = append(txs, testSpend(w, coinbases[height-1], 1))
+			fees = 1
+		}
+		coinbase := NewCoinBaseTX(address, "", height, fees)
+		block, err := src.MineBlock(append([]*Transaction{coinbase}, txs...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+		coinbases = append(coinbases, coinbase)
+	}
+
+	var unconfirmed []*Transaction
+	for height := 0; height <= raceTestBlocks; height += 2 {
+		unconfirmed = append(unconfirmed, testSpend(w, coinbases[height], 2))
+	}
+	return blocks, unconfirmed
+}
+
+type pipeConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.once.Do(func() { close(c.closed) })
+	}
+	return n, err
+}
+
+type testPeer struct {
+	addr    string
+	conn    net.Conn
+	node    *pipeConn
+	blocks  map[string]*Block
+	synced  chan struct{}
+	done    chan struct{}
+	pending sync.WaitGroup
+}
+
+func newTestPeer(t *testing.T, n *Node, id int, blocks []*Block) *testPeer {
+	remote, local := net.Pipe()
+	tp := &testPeer{
+		addr:   fmt.Sprintf("pipe-%d", id),
+		conn:   remote,
+		node:   &pipeConn{Conn: local, closed: make(chan struct{})},
+		blocks: make(map[string]*Block),
+		synced: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for _, block := range blocks {
+		tp.blocks[hex.EncodeToString(block.HeaderHash)] = block
+	}
+	n.newPeer(tp.node, "").start()
+	go tp.readLoop(t)
+	return tp
+}
+
+func (tp *testPeer) send(command string, m messagePayload) {
+	_ = writeMessage(tp.conn, command, encodeMessage(m))
+}
+
+func (tp *testPeer) readLoop(t *testing.T) {
+	defer close(tp.done)
+	for {
+		command, payload, err := readMessage(tp.conn)
+		if err != nil {
+			if err != io.EOF && err != io.ErrClosedPipe {
+				t.Errorf("%s: %v", tp.addr, err)
+			}
+			return
+		}
+
+		switch command {
+		case GET_DATA:
+			var req getdata
+			if err := decodeMessage(payload, &req); err != nil {
+				t.Errorf("%s: %v", tp.addr, err)
+				return
+			}
+			if b, ok := tp.blocks[hex.EncodeToString(req.ID)]; ok && req.Type == BLOCK {
+				tp.pending.Add(1)
+				go func() {
+					defer tp.pending.Done()
+					tp.send(BLOCK, &block{b.Serialize()})
+				}()
+			}
+		case HEADERS:
+			close(tp.synced)
+		}
+	}
+}
+
+func raceTestDone(n *Node, tip []byte) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return bytes.Equal(n.bc.getTip(), tip) && len(n.orphans.byHash) == 0 &&
+		len(n.download.queue) == 0 && len(n.download.received) == 0
+}
+
+// TestConcurrentPeers 让多个模拟节点同时发送乱序的区块、区块头、交易和 inv
+func TestConcurrentPeers(t *testing.T) {
+	src, w := newTestChain(t, "race-src")
+	if err := src.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fmt.Sprintf(dbFile, "race-src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fmt.Sprintf(dbFile, "race-dst"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	src = NewBlockChain("race-src")
+	defer src.Close()
+	blocks, unconfirmed := raceTestChain(t, src, w)
+
+	var headerData [][]byte
+	var txs []*Transaction
+	for _, block := range blocks {
+		headerData = append(headerData, block.BlockHeader.Serialize())
+		txs = append(txs, block.Transactions[1:]...)
+	}
+	txs = append(txs, unconfirmed...)
+
+	bc := NewBlockChain("race-dst")
+	n := NewNode("race-node", bc)
+
+	var peers []*testPeer
+	var wg sync.WaitGroup
+	for i := 0; i < raceTestPeers; i++ {
+		tp := newTestPeer(t, n, i, blocks)
+		peers = append(peers, tp)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(i)))
+
+			tp.send(VERSION, &version{nodeVersion, raceTestBlocks, tp.addr})
+			if i%2 == 0 {
+				tp.send(HEADERS, &headers{headerData})
+			}
+			for _, k := range r.Perm(len(blocks)) {
+				b := blocks[k]
+				switch r.Intn(4) {
+				case 0:
+					tp.send(INV, &inv{BLOCK, [][]byte{b.HeaderHash}})
+				case 1:
+					tp.send(TX, &tx{txs[r.Intn(len(txs))].Serialize()})
+				case 2:
+					tp.send(GET_DATA, &getdata{TX, txs[r.Intn(len(txs))].ID})
+				}
+				tp.send(BLOCK, &block{b.Serialize()})
+			}
+			for _, k := range r.Perm(len(txs)) {
+				tp.send(TX, &tx{txs[k].Serialize()})
+			}
+			tp.send(GET_HEADERS, &getheaders{nil, nil})
+		}(i)
+	}
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			n.mempool.Transactions()
+			n.mempool.BlockTemplate(maxBlockTemplateBytes)
+			n.getKnownNodes()
+			n.headerLocator()
+			n.requestBlocks()
+			n.peerInfo()
+		}
+	}()
+
+	wg.Wait()
+	for _, tp := range peers {
+		select {
+		case <-tp.synced:
+		case <-time.After(time.Minute):
+			t.Fatalf("%s: no reply to the final getheaders", tp.addr)
+		}
+	}
+
+	tip := blocks[len(blocks)-1].HeaderHash
+	deadline := time.Now().Add(time.Minute)
+	for !raceTestDone(n, tip) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	readers.Wait()
+
+	for _, tp := range peers {
+		tp.conn.Close()
+		<-tp.node.closed
+		<-tp.done
+		tp.pending.Wait()
+	}
+
+	if !raceTestDone(n, tip) {
+		t.Fatalf("tip %x, want %x; %d orphans, %d queued and %d received blocks left", bc.getTip(), tip,
+			len(n.orphans.byHash), len(n.download.queue), len(n.download.received))
+	}
+
+	for _, tx := range n.mempool.Transactions() {
+		if _, err := bc.FindTransaction(tx.ID); err == nil {
+			t.Errorf("confirmed transaction %x is still in the mempool", tx.ID)
+		}
+	}
+	for _, tx := range unconfirmed {
+		_ = n.mempool.Add(tx)
+	}
+	if got := n.mempool.Count(); got != len(unconfirmed) {
+		t.Errorf("mempool has %d transactions, want %d", got, len(unconfirmed))
+	}
+
+	if err := bc.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetPeerConcurrent(t *testing.T) {
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	n := NewNode("getpeer-node", nil)
+	addr := ln.Addr().String()
+	got := make([]*Peer, raceTestPeers)
+	var wg sync.WaitGroup
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p, err := n.getPeer(addr)
+			if err != nil {
+				t.Error(err)
+			}
+			got[i] = p
+		}(i)
+	}
+	wg.Wait()
+	defer n.closePeers()
+
+	for _, p := range got {
+		if p != got[0] {
+			t.Fatal("getPeer returned different connections for the same address")
+		}
+	}
+	if info := n.peerInfo(); len(info) != 1 {
+		t.Fatalf("%d peers, want 1", len(info))
+	}
+}
+
+func connectPipePeer(n *Node, addr string) *Peer {
+	remote, local := net.Pipe()
+	go func() {
+		_, _ = io.Copy(io.Discard, remote)
+		remote.Close()
+	}()
+	p := n.newPeer(local, addr)
+	n.registerPeer(addr, p)
+	p.start()
+	return p
+}
+
+func TestInvalidDownloadedBlock(t *testing.T) {
+	src, w := newTestChain(t, "download-src")
+	if err := src.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fmt.Sprintf(dbFile, "download-src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fmt.Sprintf(dbFile, "download-dst"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	src = NewBlockChain("download-src")
+	defer src.Close()
+	bc := NewBlockChain("download-dst")
+	defer bc.Close()
+
+	address := string(w.GetAddress())
+	genesis, err := src.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := mineTestBlock(src, genesis, []*Transaction{NewCoinBaseTX(address, "b", 1, 0)})
+	invalid := mineTestBlock(src, b1, []*Transaction{NewCoinBaseTX(address, "invalid", 2, 5)})
+	child := mineTestBlock(src, invalid, []*Transaction{NewCoinBaseTX(address, "child", 3, 0)})
+	b2 := mineTestBlock(src, b1, []*Transaction{NewCoinBaseTX(address, "b", 2, 0)})
+	tampered := *b2
+	tampered.Transactions = []*Transaction{NewCoinBaseTX(address, "tampered", 2, 0)}
+
+	n := NewNode("download-node", bc)
+	defer n.closePeers()
+	var headerData [][]byte
+	for _, block := range []*Block{b1, invalid, child, b2} {
+		headerData = append(headerData, block.BlockHeader.Serialize())
+	}
+	good, bad, liar := connectPipePeer(n, "good"), connectPipePeer(n, "bad"), connectPipePeer(n, "liar")
+	for _, p := range []*Peer{good, bad, liar} {
+		if _, err := n.addHeaders(p, headerData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request := func(block *Block, p *Peer) {
+		n.mu.Lock()
+		n.download.inFlight[hex.EncodeToString(block.HeaderHash)] = blockRequest{p, time.Now()}
+		n.mu.Unlock()
+	}
+
+	request(b1, good)
+	request(child, good)
+	request(invalid, bad)
+	request(b2, liar)
+	n.receiveDownloadedBlock(b1, bad)
+	if !bytes.Equal(bc.getTip(), genesis.HeaderHash) || bad.closed() {
+		t.Fatal("accepted a block that was requested from another peer")
+	}
+	n.receiveDownloadedBlock(b1, good)
+	n.receiveDownloadedBlock(child, good)
+	n.receiveDownloadedBlock(invalid, bad)
+	n.receiveDownloadedBlock(&tampered, liar)
+
+	n.mu.Lock()
+	queue, peers := len(n.download.queue), maps.Clone(n.download.peers)
+	_, childKnown := n.download.headers[hex.EncodeToString(child.HeaderHash)]
+	n.mu.Unlock()
+	if !bytes.Equal(bc.getTip(), b1.HeaderHash) {
+		t.Fatalf("tip %x, want %x", bc.getTip(), b1.HeaderHash)
+	}
+	if queue != 1 || childKnown {
+		t.Fatalf("%d queued blocks, want only the tampered one", queue)
+	}
+	for _, p := range []*Peer{bad, liar} {
+		if !p.closed() || peers[p] {
+			t.Errorf("%s was not disconnected", p)
+		}
+	}
+	if good.closed() || !peers[good] {
+		t.Error("disconnected the peer that sent valid blocks")
+	}
+
+	request(b2, good)
+	n.receiveDownloadedBlock(b2, good)
+	if !bytes.Equal(bc.getTip(), b2.HeaderHash) {
+		t.Fatalf("tip %x, want %x", bc.getTip(), b2.HeaderHash)
+	}
+}
+
+func TestReplyToSender(t *testing.T) {
+	bc, _ := newTestChain(t, "reply")
+	defer bc.Close()
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewNode("reply-node", bc)
+	remote, local := net.Pipe()
+	n.newPeer(local, "").start()
+	defer n.closePeers()
+	defer remote.Close()
+
+	go func() {
+		_ = writeMessage(remote, GET_DATA, encodeMessage(&getdata{BLOCK, genesis.HeaderHash}))
+	}()
+	_ = remote.SetReadDeadline(time.Now().Add(10 * time.Second))
+	command, _, err := readMessage(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command != BLOCK {
+		t.Fatalf("got %s, want %s", command, BLOCK)
+	}
+	if info := n.peerInfo(); len(info) != 0 {
+		t.Fatalf("node connected to %v", info)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const maxHeadersPerMsg = 2000
+const maxLocatorSize = 101
+const maxDownloadQueue = 8 * maxHeadersPerMsg
+const blockDownloadWindow = 128
+const maxBlocksInFlightPerPeer = 16
+const blockStallTimeout = 30 * time.Second
+
+type getheaders struct {
+	Locator  [][]byte
+	StopHash []byte
+}
+
+type headers struct {
+	Headers [][]byte
+}
+
+type blockRequest struct {
+	peer *Peer
+	time time.Time
+}
+
+type downloadedBlock struct {
+	block *Block
+	peer  *Peer
+}
+
+// blockDownload 保存区块下载进度，由 Node.mu 保护
+type blockDownload struct {
+	headers     map[string]*Block // 已校验但尚未连接的区块头，只有区块头字段和高度
+	queue       [][]byte          // 等待连接的区块哈希，按连接顺序排列
+	inFlight    map[string]blockRequest
+	received    map[string]downloadedBlock // 已下载、等待前面的区块先连接
+	peers       map[*Peer]bool             // 发送过区块头、可以从其下载区块体的连接
+	moreHeaders *Peer                      // 队列已满时暂停请求区块头的连接
+}
+
+func newBlockDownload() blockDownload {
+	return blockDownload{
+		headers:  make(map[string]*Block),
+		inFlight: make(map[string]blockRequest),
+		received: make(map[string]downloadedBlock),
+		peers:    make(map[*Peer]bool),
+	}
+}
+
+func (n *Node) sendGetHeaders(p *Peer) {
+	p.Send(GET_HEADERS, encodeMessage(&getheaders{n.headerLocator(), nil}))
+}
+
+func (n *Node) sendHeaders(p *Peer, blockHeaders []*BlockHeader) {
+	var data [][]byte
+	for _, header := range blockHeaders {
+		data = append(data, header.Serialize())
+	}
+	p.Send(HEADERS, encodeMessage(&headers{data}))
+}
+
+func (n *Node) headerLocator() [][]byte {
+	locator := n.bc.BlockLocator()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if queue := n.download.queue; len(queue) > 0 {
+		locator = append([][]byte{queue[len(queue)-1]}, locator...)
+	}
+	return locator
+}
+
+func (n *Node) handleGetHeaders(p *Peer, data []byte) error {
+	var payload getheaders
+
+	err := decodeMessage(data, &payload)
+	if err != nil {
+		return err
+	}
+	if len(payload.Locator) > maxLocatorSize {
+		return fmt.Errorf("locator has %d hashes", len(payload.Locator))
+	}
+
+	blockHeaders := n.bc.GetHeadersAfter(payload.Locator, payload.StopHash, maxHeadersPerMsg)
+	n.sendHeaders(p, blockHeaders)
+	return nil
+}
+
+func (n *Node) handleHeaders(p *Peer, data []byte) error {
+	var payload headers
+
+	err := decodeMessage(data, &payload)
+	if err != nil {
+		return err
+	}
+	if len(payload.Headers) > maxHeadersPerMsg {
+		return fmt.Errorf("%d headers in one message", len(payload.Headers))
+	}
+
+	added, err := n.addHeaders(p, payload.Headers)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Received %d headers, %d new\n", len(payload.Headers), added)
+
+	if len(payload.Headers) == maxHeadersPerMsg && !n.pauseHeaders(p) {
+		n.sendGetHeaders(p)
+	}
+	n.requestBlocks()
+	return nil
+}
+
+func (n *Node) addHeaders(p *Peer, data [][]byte) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	added := 0
+	for _, headerData := range data {
+		if len(n.download.queue) >= maxDownloadQueue {
+			n.download.moreHeaders = p
+			break
+		}
+		header, err := decodeBlockHeader(headerData)
+		if err != nil {
+			return added, err
+		}
+		hash := header.Hash()
+		if n.isKnownBlock(hash) {
+			continue
+		}
+
+		parent, err := n.findHeader(header.PrevBlockHeaderHash)
+		if err != nil {
+			fmt.Printf("Headers from %s do not connect to a known block\n", p)
+			return added, nil
+		}
+		block := &Block{BlockHeader: *header, HeaderHash: hash, Height: parent.Height + 1}
+		if err := checkHeader(block, parent, n.findHeader); err != nil {
+			return added, err
+		}
+
+		n.download.headers[hex.EncodeToString(hash)] = block
+		n.download.queue = append(n.download.queue, hash)
+		added++
+
+		if orphan, ok := n.orphans.get(hash); ok {
+			n.orphans.remove(orphan)
+			n.download.received[hex.EncodeToString(hash)] = downloadedBlock{orphan, nil}
+		}
+	}
+
+	if len(data) > 0 {
+		n.download.peers[p] = true
+	}
+	n.connectDownloaded()
+	return added, nil
+}
+
+func (n *Node) pauseHeaders(p *Peer) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.download.queue) > maxDownloadQueue-maxHeadersPerMsg {
+		n.download.moreHeaders = p
+		return true
+	}
+	return false
+}
+
+func (n *Node) findHeader(hash []byte) (*Block, error) {
+	if block, ok := n.download.headers[hex.EncodeToString(hash)]; ok {
+		return block, nil
+	}
+	return n.bc.findBlock(hash)
+}
+
+func (n *Node) isKnownBlock(hash []byte) bool {
+	_, err := n.findHeader(hash)
+	return err == nil
+}
+
+// requestBlocks 把下载窗口内尚未请求的区块分配给负载最低的节点
+func (n *Node) requestBlocks() {
+	requests := make(map[*Peer][][]byte)
+
+	n.mu.Lock()
+	d := &n.download
+	load := make(map[*Peer]int)
+	var peers []*Peer
+	for peer := range d.peers {
+		if peer.closed() {
+			delete(d.peers, peer)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].String() < peers[j].String() })
+	for key, req := range d.inFlight {
+		if req.peer.closed() {
+			delete(d.inFlight, key)
+			continue
+		}
+		load[req.peer]++
+	}
+
+	window := d.queue
+	if len(window) > blockDownloadWindow {
+		window = window[:blockDownloadWindow]
+	}
+	for _, hash := range window {
+		key := hex.EncodeToString(hash)
+		if _, ok := d.inFlight[key]; ok {
+			continue
+		}
+		if _, ok := d.received[key]; ok {
+			continue
+		}
+
+		var peer *Peer
+		for _, candidate := range peers {
+			if load[candidate] < maxBlocksInFlightPerPeer && (peer == nil || load[candidate] < load[peer]) {
+				peer = candidate
+			}
+		}
+		if peer == nil {
+			break
+		}
+		d.inFlight[key] = blockRequest{peer, time.Now()}
+		load[peer]++
+		requests[peer] = append(requests[peer], hash)
+	}
+	n.mu.Unlock()
+
+	for peer, hashes := range requests {
+		for _, hash := range hashes {
+			n.sendGetData(peer, BLOCK, hash)
+		}
+	}
+}
+
+func (n *Node) receiveDownloadedBlock(block *Block, p *Peer) bool {
+	n.mu.Lock()
+	d := &n.download
+	key := hex.EncodeToString(block.HeaderHash)
+	if _, ok := d.headers[key]; !ok {
+		n.mu.Unlock()
+		return false
+	}
+	if req, ok := d.inFlight[key]; !ok || req.peer != p {
+		n.mu.Unlock()
+		fmt.Printf("Ignoring block %x that was not requested from %s\n", block.HeaderHash, p)
+		return true
+	}
+	delete(d.inFlight, key)
+	d.received[key] = downloadedBlock{block, p}
+	n.connectDownloaded()
+
+	var resume *Peer
+	if d.moreHeaders != nil && len(d.queue) <= maxDownloadQueue-maxHeadersPerMsg {
+		resume = d.moreHeaders
+		d.moreHeaders = nil
+	}
+	n.mu.Unlock()
+
+	if resume != nil {
+		n.sendGetHeaders(resume)
+	}
+	n.requestBlocks()
+	return true
+}
+
+func (n *Node) connectDownloaded() {
+	d := &n.download
+	for len(d.queue) > 0 {
+		hash := d.queue[0]
+		key := hex.EncodeToString(hash)
+		got, ok := d.received[key]
+		if !ok {
+			return
+		}
+		delete(d.received, key)
+
+		if err := n.processBlock(got.block); err != nil {
+			fmt.Println(err)
+			n.rejectDownloaded(got)
+			continue
+		}
+		delete(d.headers, key)
+		d.queue = d.queue[1:]
+	}
+}
+
+func (n *Node) rejectDownloaded(got downloadedBlock) {
+	d := &n.download
+	hash := got.block.HeaderHash
+	if got.peer != nil {
+		fmt.Printf("Disconnecting %s: sent invalid block %x\n", got.peer, hash)
+		delete(d.peers, got.peer)
+		got.peer.Close()
+	}
+
+	header := d.headers[hex.EncodeToString(hash)]
+	if got.block.Height != header.Height || checkTransactions(got.block) != nil {
+		return
+	}
+
+	invalid := map[string]bool{hex.EncodeToString(hash): true}
+	var queue [][]byte
+	for _, queued := range d.queue {
+		key := hex.EncodeToString(queued)
+		if !invalid[key] && !invalid[hex.EncodeToString(d.headers[key].PrevBlockHeaderHash)] {
+			queue = append(queue, queued)
+			continue
+		}
+		invalid[key] = true
+		delete(d.headers, key)
+		delete(d.received, key)
+		delete(d.inFlight, key)
+	}
+	d.queue = queue
+	fmt.Printf("Dropped %d queued blocks\n", len(invalid))
+}
+
+func (n *Node) checkStalledDownloads() {
+	for range time.Tick(blockStallTimeout / 2) {
+		n.mu.Lock()
+		for key, req := range n.download.inFlight {
+			if time.Since(req.time) > blockStallTimeout {
+				fmt.Printf("Block download from %s stalled\n", req.peer)
+				delete(n.download.inFlight, key)
+				delete(n.download.peers, req.peer)
+			}
+		}
+		n.mu.Unlock()
+
+		n.requestBlocks()
+	}
+}
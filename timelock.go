@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// SequenceFinal 表示输入既没有相对锁定，也不启用交易的 LockTime
+	SequenceFinal = 0xffffffff
+	// sequenceLockTimeOnly 启用交易的 LockTime，但没有相对锁定
+	sequenceLockTimeOnly = SequenceFinal - 1
+
+	lockTimeThreshold    = 500000000
+	sequenceDisableFlag  = 1 << 31
+	sequenceTypeFlag     = 1 << 22
+	sequenceLockTimeMask = 0x0000ffff
+	sequenceGranularity  = 9
+)
+
+// lockContext 是校验时间锁时所在区块的高度和父区块的中位时间
+type lockContext struct {
+	height int
+	mtp    int64
+	mtpAt  func(height int) int64
+}
+
+func (bc *Blockchain) nextLockContext() lockContext {
+	tip, err := bc.findBlock(bc.getTip())
+	if err != nil {
+		log.Panic(err)
+	}
+	return bc.lockContextAfter(tip)
+}
+
+func (bc *Blockchain) lockContextAfter(parent *Block) lockContext {
+	mtpAt := func(height int) int64 {
+		block, err := bc.GetBlockByHeight(height)
+		if err != nil {
+			log.Panic(err)
+		}
+		return bc.MedianTimePast(block)
+	}
+	return lockContext{parent.Height + 1, bc.MedianTimePast(parent), mtpAt}
+}
+
+func (ctx lockContext) lockTimeReached(lockTime uint32) bool {
+	if lockTime < lockTimeThreshold {
+		return int64(lockTime) < int64(ctx.height)
+	}
+	return int64(lockTime) < ctx.mtp
+}
+
+func (ctx lockContext) sequenceReached(sequence uint32, coinHeight int) bool {
+	if sequence&sequenceDisableFlag != 0 {
+		return true
+	}
+	value := int64(sequence & sequenceLockTimeMask)
+	if sequence&sequenceTypeFlag == 0 {
+		return int64(coinHeight)+value <= int64(ctx.height)
+	}
+	coinTime := ctx.mtpAt(max(coinHeight-1, 0))
+	return coinTime+(value<<sequenceGranularity) <= ctx.mtp
+}
+
+func (tx *Transaction) IsFinal(ctx lockContext) bool {
+	if tx.LockTime == 0 || ctx.lockTimeReached(tx.LockTime) {
+		return true
+	}
+	for _, in := range tx.Vin {
+		if in.Sequence != SequenceFinal {
+			return false
+		}
+	}
+	return true
+}
+
+func (tx *Transaction) checkLocks(ctx lockContext, coinHeights []int) error {
+	if !tx.IsFinal(ctx) {
+		return fmt.Errorf("lock time %d not reached", tx.LockTime)
+	}
+	for i, in := range tx.Vin {
+		if !ctx.sequenceReached(in.Sequence, coinHeights[i]) {
+			return fmt.Errorf("input %d: relative lock %08x not reached", i, in.Sequence)
+		}
+	}
+	return nil
+}
+
+type TimeLock struct {
+	LockTime uint32
+	Blocks   uint32
+}
+
+func (lock TimeLock) Script(pubKeyHash []byte) ([]byte, error) {
+	switch {
+	case lock.LockTime != 0 && lock.Blocks != 0:
+		return nil, errors.New("an output can have an absolute or a relative lock, not both")
+	case lock.LockTime != 0:
+		return NewTimeLockScript(OP_CHECKLOCKTIMEVERIFY, lock.LockTime, pubKeyHash), nil
+	case lock.Blocks > sequenceLockTimeMask:
+		return nil, fmt.Errorf("relative lock of %d blocks exceeds %d", lock.Blocks, sequenceLockTimeMask)
+	case lock.Blocks != 0:
+		return NewTimeLockScript(OP_CHECKSEQUENCEVERIFY, lock.Blocks, pubKeyHash), nil
+	}
+	return NewP2PKHScript(pubKeyHash), nil
+}
+
+func spendableAt(script []byte, coinHeight int, ctx lockContext) bool {
+	opcode, lock, _, ok := ExtractTimeLock(script)
+	if !ok {
+		return true
+	}
+	if opcode == OP_CHECKLOCKTIMEVERIFY {
+		return ctx.lockTimeReached(lock)
+	}
+	return ctx.sequenceReached(lock, coinHeight)
+}
+
+func parseLockTime(s string) (uint32, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(v), nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			if t.Unix() < lockTimeThreshold || t.Unix() > 0xffffffff {
+				return 0, fmt.Errorf("lock time %s is out of range", s)
+			}
+			return uint32(t.Unix()), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid lock time %q", s)
+}
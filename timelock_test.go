@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+func lockedSpend(w *Wallet, prev *Transaction, vout int, lockTime, sequence uint32) *Transaction {
+	out := NewTXOutput(prev.Vout[vout].Value-1, string(w.GetAddress()))
+	tx := &Transaction{nil, encodingVersion, []TXInput{{prev.ID, vout, nil, sequence}}, []TXOutput{*out}, lockTime}
+	tx.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(prev.ID): *prev})
+	tx.ID = tx.Hash()
+	return tx
+}
+
+func txRejectReason(err error) (RejectReason, bool) {
+	var txErr *TxError
+	if !errors.As(err, &txErr) {
+		return 0, false
+	}
+	return txErr.Reason, true
+}
+
+func TestTimeLocks(t *testing.T) {
+	bc, w := newTestChain(t, "timelock")
+	defer bc.Close()
+	address := string(w.GetAddress())
+	pubKeyHash := HashPubKey(w.PublicKey)
+	tip, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lockTime := uint32(time.Now().Unix() + 3600)
+	scripts := [][]byte{
+		NewTimeLockScript(OP_CHECKLOCKTIMEVERIFY, 4, pubKeyHash),
+		NewTimeLockScript(OP_CHECKSEQUENCEVERIFY, 2, pubKeyHash),
+		NewTimeLockScript(OP_CHECKLOCKTIMEVERIFY, lockTime, pubKeyHash),
+		NewP2PKHScript(pubKeyHash),
+		NewP2PKHScript(pubKeyHash),
+	}
+	coin := tip.Transactions[0]
+	funding := &Transaction{nil, encodingVersion, []TXInput{{coin.ID, 0, nil, SequenceFinal}}, nil, 0}
+	for _, script := range scripts {
+		funding.Vout = append(funding.Vout, TXOutput{10, script})
+	}
+	funding.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(coin.ID): *coin})
+	funding.ID = funding.Hash()
+
+	tip = mineTestBlock(bc, tip, []*Transaction{NewCoinBaseTX(address, "", 1, 0), funding})
+	if _, err := bc.AddBlock(tip); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		tx   *Transaction
+		// unlocked 判断交易能否进入 height 高度、父区块中位时间为 mtp 的区块
+		unlocked func(height int, mtp int64) bool
+		rejected bool
+		accepted bool
+	}{
+		{"cltv height", lockedSpend(w, funding, 0, 4, sequenceLockTimeOnly),
+			func(height int, mtp int64) bool { return height > 4 }, false, false},
+		{"csv blocks", lockedSpend(w, funding, 1, 0, 2),
+			func(height int, mtp int64) bool { return height >= 1+2 }, false, false},
+		{"cltv time", lockedSpend(w, funding, 2, lockTime, sequenceLockTimeOnly),
+			func(height int, mtp int64) bool { return mtp > int64(lockTime) }, false, false},
+		{"non-final lock time", lockedSpend(w, funding, 3, 3, sequenceLockTimeOnly),
+			func(height int, mtp int64) bool { return height > 3 }, false, false},
+		{"final sequence ignores lock time", lockedSpend(w, funding, 3, lockTime, SequenceFinal),
+			func(height int, mtp int64) bool { return true }, false, false},
+		{"non-final sequence", lockedSpend(w, funding, 4, 0, 3),
+			func(height int, mtp int64) bool { return height >= 1+3 }, false, false},
+	}
+
+	for tip.Height < 10 {
+		mtp := bc.MedianTimePast(tip)
+		for i := range tests {
+			tt := &tests[i]
+			want := tt.unlocked(tip.Height+1, mtp)
+			block := mineTestBlock(bc, tip, []*Transaction{NewCoinBaseTX(address, tt.name, tip.Height+1, 0), tt.tx})
+
+			mempoolErr := NewMempool(bc).Add(tt.tx)
+			blockErr := bc.ValidateBlock(block)
+			if blockErr == nil && !want && tt.tx.LockTime != 0 {
+				t.Errorf("%s at height %d: ValidateBlock accepted a non-final transaction", tt.name, tip.Height+1)
+			}
+			if blockErr == nil {
+				blockErr = bc.checkBlockConnect(block)
+			}
+			if want {
+				tt.accepted = true
+				if mempoolErr != nil || blockErr != nil {
+					t.Errorf("%s at height %d: mempool %v, block %v", tt.name, tip.Height+1, mempoolErr, blockErr)
+				}
+				continue
+			}
+			tt.rejected = true
+			if reason, _ := txRejectReason(mempoolErr); reason != RejectNonFinal {
+				t.Errorf("%s at height %d: mempool got %v, want %s", tt.name, tip.Height+1, mempoolErr, RejectNonFinal)
+			}
+			if reason, _ := rejectReason(blockErr); reason != RejectNonFinal {
+				t.Errorf("%s at height %d: block got %v, want %s", tt.name, tip.Height+1, blockErr, RejectNonFinal)
+			}
+		}
+
+		timestamp := max(bc.NextBlockTime(tip), int64(lockTime)+600)
+		tip = NewBlock(tip.HeaderHash, tip.Height+1, bc.CalcNextBits(tip), timestamp, []*Transaction{NewCoinBaseTX(address, "", tip.Height+1, 0)})
+		if _, err := bc.AddBlock(tip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range tests {
+		if !tt.accepted || (!tt.rejected && tt.name != "final sequence ignores lock time") {
+			t.Errorf("%s: rejected %v, accepted %v, want both", tt.name, tt.rejected, tt.accepted)
+		}
+	}
+
+	for _, tx := range []*Transaction{
+		lockedSpend(w, funding, 0, 3, sequenceLockTimeOnly),
+		lockedSpend(w, funding, 0, 4, SequenceFinal),
+		lockedSpend(w, funding, 1, 0, 1),
+		lockedSpend(w, funding, 1, 0, SequenceFinal),
+	} {
+		if reason, _ := txRejectReason(NewMempool(bc).Add(tx)); reason != RejectBadSignature {
+			t.Errorf("lock time %d, sequence %x: got %s, want %s", tx.LockTime, tx.Vin[0].Sequence, reason, RejectBadSignature)
+		}
+	}
+}
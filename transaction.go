@@ -6,20 +6,26 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"strings"
 )
 
-const initReward = 50
+var (
+	errInvalidAddress     = errors.New("invalid address")
+	errAddressNotInWallet = errors.New("address is not in the wallet")
+	errInsufficientFunds  = errors.New("not enough funds")
+)
 
 type Transaction struct {
-	ID   []byte
-	Vin  []TXInput
-	Vout []TXOutput
+	ID       []byte
+	Version  uint8 // 编码版本，新交易为 encodingVersion，旧区块中的交易保留原版本，见 encoding.go
+	Vin      []TXInput
+	Vout     []TXOutput
+	LockTime uint32 // 绝对锁定的区块高度或 Unix 时间，0 表示不锁定，见 timelock.go
 }
 
 func (tx Transaction) String() string {
@@ -32,35 +38,31 @@ func (tx Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:      %x", input.Txid))
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Vout))
-		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+		lines = append(lines, fmt.Sprintf("       ScriptSig: %s", DisassembleScript(input.ScriptSig)))
+		lines = append(lines, fmt.Sprintf("       Sequence:  %08x", input.Sequence))
 	}
 
 	for i, output := range tx.Vout {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
-		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("       Script: %s", DisassembleScript(output.ScriptPubKey)))
 	}
 
+	lines = append(lines, fmt.Sprintf("     LockTime: %d", tx.LockTime))
+
 	return strings.Join(lines, "\n")
 }
 
 type TXInput struct {
 	Txid      []byte // 前一笔交易的id
 	Vout      int    // 前一笔交易中输出数据的索引
-	Signature []byte
-	PubKey    []byte
-}
-
-func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := HashPubKey(in.PubKey)
-
-	return bytes.Compare(lockingHash[:], pubKeyHash) == 0
+	ScriptSig []byte // 满足前一个输出 ScriptPubKey 的解锁脚本
+	Sequence  uint32 // 相对锁定，SequenceFinal 表示不锁定
 }
 
 type TXOutput struct {
-	Value      int
-	PubKeyHash []byte
+	Value        int
+	ScriptPubKey []byte
 }
 
 func NewTXOutput(value int, address string) *TXOutput {
@@ -70,13 +72,12 @@ func NewTXOutput(value int, address string) *TXOutput {
 }
 
 func (out *TXOutput) Lock(address []byte) {
-	pubKeyHash := Base58Decode(address)
-	pubKeyHash = pubKeyHash[len([]byte{pkhVersion}) : len(pubKeyHash)-addressChecksumLen]
-	out.PubKeyHash = pubKeyHash
+	out.ScriptPubKey = AddressScript(string(address))
 }
 
 func (out *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	lockingHash, ok := scriptPubKeyHash(out.ScriptPubKey)
+	return ok && bytes.Equal(lockingHash, pubKeyHash)
 }
 
 // IsCoinbase 判断是否是 coinbase 交易
@@ -85,66 +86,101 @@ func (tx Transaction) IsCoinbase() bool {
 }
 
 func (tx *Transaction) Hash() []byte {
-	var hash [32]byte
-
-	txCopy := *tx
-	txCopy.ID = []byte{}
-
-	hash = sha256.Sum256(txCopy.Serialize())
+	hash := sha256.Sum256(tx.Serialize())
 
 	return hash[:]
 }
 
 func (tx *Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
+	return encodeTransaction(tx)
+}
 
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
+func DeserializeTransaction(data []byte) Transaction {
+	tx, err := decodeTransaction(data)
 	if err != nil {
 		log.Panic(err)
 	}
-
-	return encoded.Bytes()
+	return tx
 }
 
-func DeserializeTransaction(data []byte) Transaction {
-	var tx Transaction
+// SignatureHash 清空所有 ScriptSig，把第 inIdx 个输入换成被花费输出的 ScriptPubKey 后取交易哈希
+func (tx *Transaction) SignatureHash(inIdx int, prevScript []byte) []byte {
+	txCopy := tx.TrimmedCopy()
+	txCopy.Vin[inIdx].ScriptSig = prevScript
+	if tx.Version == 1 {
+		pubKeyHash, _ := ExtractPubKeyHash(prevScript)
+		txCopy.Vin[inIdx].ScriptSig = NewP2PKHScriptSig(nil, pubKeyHash)
+	}
+	return txCopy.Hash()
+}
 
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&tx)
-	if err != nil {
-		log.Panic(err)
+func (tx *Transaction) prevOutputs(prevTXs map[string]Transaction) ([]TXOutput, error) {
+	prevOuts := make([]TXOutput, len(tx.Vin))
+	for inIdx, in := range tx.Vin {
+		prevTX, ok := prevTXs[hex.EncodeToString(in.Txid)]
+		if !ok || in.Vout < 0 || in.Vout >= len(prevTX.Vout) {
+			return nil, fmt.Errorf("input %d: output %x:%d not found", inIdx, in.Txid, in.Vout)
+		}
+		prevOuts[inIdx] = prevTX.Vout[in.Vout]
 	}
-	return tx
+	return prevOuts, nil
 }
 
+// Sign 签名覆盖 LockTime 和 Sequence，要在设置好它们之后调用
 func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
 	if tx.IsCoinbase() {
 		return
 	}
 
-	for _, in := range tx.Vin {
-		if prevTXs[hex.EncodeToString(in.Txid)].ID == nil {
-			log.Panic("ERROR: Previous transaction not found")
-		}
+	prevOuts, err := tx.prevOutputs(prevTXs)
+	if err != nil {
+		log.Panic("ERROR: Previous transaction not found")
 	}
+	tx.signOutputs(privateKey, prevOuts)
+}
 
-	txCopy := tx.TrimmedCopy()
-
-	for inIdx, in := range txCopy.Vin {
-		prevTX := prevTXs[hex.EncodeToString(in.Txid)]
-		txCopy.Vin[inIdx].Signature = nil
-		txCopy.Vin[inIdx].PubKey = prevTX.Vout[in.Vout].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Vin[inIdx].PubKey = nil
+func (tx *Transaction) signOutputs(privateKey ecdsa.PrivateKey, prevOuts []TXOutput) {
+	pubKey := append(privateKey.PublicKey.X.Bytes(), privateKey.PublicKey.Y.Bytes()...)
+	pubKeyHash := HashPubKey(pubKey)
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privateKey, txCopy.ID)
-		if err != nil {
-			log.Panic(err)
+	for inIdx := range tx.Vin {
+		prevOut := prevOuts[inIdx]
+		if !prevOut.IsLockedWithKey(pubKeyHash) {
+			continue
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
-		tx.Vin[inIdx].Signature = signature
+
+		signature := signHash(privateKey, tx.SignatureHash(inIdx, prevOut.ScriptPubKey))
+		tx.Vin[inIdx].ScriptSig = NewP2PKHScriptSig(signature, pubKey)
+	}
+}
+
+func signHash(privateKey ecdsa.PrivateKey, hash []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, &privateKey, hash)
+	if err != nil {
+		log.Panic(err)
 	}
+	size := (privateKey.Curve.Params().N.BitLen() + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+	return signature
+}
+
+func checkSignature(signature, pubKey, hash []byte) bool {
+	r := big.Int{}
+	s := big.Int{}
+	sigLen := len(signature)
+	r.SetBytes(signature[:(sigLen / 2)])
+	s.SetBytes(signature[(sigLen / 2):])
+
+	x := big.Int{}
+	y := big.Int{}
+	keyLen := len(pubKey)
+	x.SetBytes(pubKey[:(keyLen / 2)])
+	y.SetBytes(pubKey[(keyLen / 2):])
+
+	rawPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: &x, Y: &y}
+	return ecdsa.Verify(&rawPubKey, hash, &r, &s)
 }
 
 func (tx *Transaction) TrimmedCopy() Transaction {
@@ -152,121 +188,219 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TXOutput
 
 	for _, in := range tx.Vin {
-		inputs = append(inputs, TXInput{in.Txid, in.Vout, nil, nil})
+		inputs = append(inputs, TXInput{in.Txid, in.Vout, nil, in.Sequence})
 	}
 	for _, out := range tx.Vout {
-		outputs = append(outputs, TXOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TXOutput{out.Value, out.ScriptPubKey})
 	}
 
-	return Transaction{tx.ID, inputs, outputs}
+	return Transaction{tx.ID, tx.Version, inputs, outputs, tx.LockTime}
 }
 
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
+	prevOuts, err := tx.prevOutputs(prevTXs)
+	return err == nil && tx.VerifyScripts(prevOuts) == nil
+}
 
+func (tx *Transaction) VerifyScripts(prevOuts []TXOutput) error {
 	for inIdx, in := range tx.Vin {
-		prevTX := prevTXs[hex.EncodeToString(in.Txid)]
-		txCopy.Vin[inIdx].Signature = nil
-		txCopy.Vin[inIdx].PubKey = prevTX.Vout[in.Vout].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Vin[inIdx].PubKey = nil
-
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
-
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if !ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) {
-			return false
+		prevScript := prevOuts[inIdx].ScriptPubKey
+
+		checker := &inputChecker{tx: tx, inIdx: inIdx, prevScript: prevScript}
+		if err := VerifyScript(in.ScriptSig, prevScript, checker); err != nil {
+			return fmt.Errorf("input %d: %w", inIdx, err)
 		}
 	}
-	return true
+	return nil
 }
 
-func NewUTXOTransaction(nodeId, from, to string, amount int, set *UTXOSet) *Transaction {
-	var inputs []TXInput
-	var outputs []TXOutput
+type inputChecker struct {
+	tx         *Transaction
+	inIdx      int
+	prevScript []byte
+	hash       []byte
+}
 
-	wallets, err := NewWallets(nodeId)
+func (c *inputChecker) CheckSig(signature, pubKey []byte) bool {
+	if c.hash == nil {
+		c.hash = c.tx.SignatureHash(c.inIdx, c.prevScript)
+	}
+	return checkSignature(signature, pubKey, c.hash)
+}
+
+func (c *inputChecker) CheckLockTime(lockTime int64) bool {
+	txLockTime := int64(c.tx.LockTime)
+	if (lockTime < lockTimeThreshold) != (txLockTime < lockTimeThreshold) {
+		return false
+	}
+	return lockTime <= txLockTime && c.tx.Vin[c.inIdx].Sequence != SequenceFinal
+}
+
+func (c *inputChecker) CheckSequence(sequence int64) bool {
+	txSequence := int64(c.tx.Vin[c.inIdx].Sequence)
+	if txSequence&sequenceDisableFlag != 0 {
+		return false
+	}
+	if sequence&sequenceTypeFlag != txSequence&sequenceTypeFlag {
+		return false
+	}
+	return sequence&sequenceLockTimeMask <= txSequence&sequenceLockTimeMask
+}
+
+func NewUTXOTransaction(nodeId, from, to string, amount, fee int, set *UTXOSet) *Transaction {
+	tx, err := CreateTransaction(nodeId, from, to, amount, fee, TimeLock{}, set, nil)
 	if err != nil {
 		log.Panic(err)
 	}
-	wallet := wallets.GetWallet(from)
-	publicKeyHash := HashPubKey(wallet.PublicKey)
-	acc, validOutputs := set.FindSpendableOutputs(publicKeyHash, amount)
-	if acc < amount {
-		log.Panic("ERROR: Not enough funds")
+	return tx
+}
+
+func CreateTransaction(nodeId, from, to string, amount, fee int, lock TimeLock, set *UTXOSet, exclude func(txid []byte, vout int) bool) (*Transaction, error) {
+	if !ValidateAddress(from) || !ValidateAddress(to) {
+		return nil, errInvalidAddress
+	}
+	wallets, err := NewWallets(nodeId)
+	if err != nil {
+		return nil, err
+	}
+	wallet, ok := wallets.Wallets[from]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", from, errAddressNotInWallet)
+	}
+
+	unspent := set.FindSpendableUnspent(AddressScript(from), exclude)
+	tx, err := NewUnsignedTransaction(from, to, amount, fee, lock, unspent)
+	if err != nil {
+		return nil, err
+	}
+	set.Blockchain.SignTransaction(tx, wallet.PrivateKey)
+	tx.ID = tx.Hash()
+	return tx, nil
+}
+
+func NewUnsignedTransaction(from, to string, amount, fee int, lock TimeLock, unspent []UnspentOutput) (*Transaction, error) {
+	if !ValidateAddress(from) || !ValidateAddress(to) {
+		return nil, errInvalidAddress
 	}
 
 	// build inputs
-	for txid, outs := range validOutputs {
-		txId, err := hex.DecodeString(txid)
-		if err != nil {
-			log.Panic(err)
+	var inputs []TXInput
+	var lockTime uint32
+	acc := 0
+	for _, out := range unspent {
+		if acc >= amount+fee {
+			break
 		}
-		for _, out := range outs {
-			input := TXInput{txId, out, nil, wallet.PublicKey}
-			inputs = append(inputs, input)
+		input := TXInput{out.TxID, out.Vout, nil, SequenceFinal}
+		if opcode, value, _, ok := ExtractTimeLock(out.Entry.Output.ScriptPubKey); ok {
+			if opcode == OP_CHECKLOCKTIMEVERIFY {
+				if lockTime != 0 && (lockTime < lockTimeThreshold) != (value < lockTimeThreshold) {
+					continue
+				}
+				lockTime = max(lockTime, value)
+			} else {
+				input.Sequence = value
+			}
+		}
+		inputs = append(inputs, input)
+		acc += out.Entry.Output.Value
+	}
+	if acc < amount+fee {
+		return nil, errInsufficientFunds
+	}
+	if lockTime != 0 {
+		for i := range inputs {
+			if inputs[i].Sequence == SequenceFinal {
+				inputs[i].Sequence = sequenceLockTimeOnly
+			}
 		}
 	}
 
 	// build outputs
-	outputs = append(outputs, *NewTXOutput(amount, to))
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	var outputs []TXOutput
+	payment := NewTXOutput(amount, to)
+	if lock != (TimeLock{}) {
+		pubKeyHash, ok := ExtractPubKeyHash(payment.ScriptPubKey)
+		if !ok {
+			return nil, fmt.Errorf("time locked payments need a P2PKH address: %w", errInvalidAddress)
+		}
+		script, err := lock.Script(pubKeyHash)
+		if err != nil {
+			return nil, err
+		}
+		payment.ScriptPubKey = script
+	}
+	outputs = append(outputs, *payment)
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from))
 	}
 
-	tx := &Transaction{nil, inputs, outputs}
+	tx := &Transaction{nil, encodingVersion, inputs, outputs, lockTime}
 	tx.ID = tx.Hash()
-	set.Blockchain.SignTransaction(tx, wallet.PrivateKey)
-	return tx
+	return tx, nil
+}
+
+func CreateTransactionFeeRate(nodeId, from, to string, amount, fee, feeRate int, lock TimeLock, set *UTXOSet, exclude func(txid []byte, vout int) bool) (*Transaction, error) {
+	tx, err := CreateTransaction(nodeId, from, to, amount, fee, lock, set, exclude)
+	for err == nil && feeRate > 0 && fee*1000 < feeRate*len(tx.Serialize()) {
+		fee = (feeRate*len(tx.Serialize()) + 999) / 1000
+		tx, err = CreateTransaction(nodeId, from, to, amount, fee, lock, set, exclude)
+	}
+	return tx, err
 }
 
-func NewCoinBaseTX(to, data string) *Transaction {
+// NewCoinBaseTX 的奖励为区块补贴加上手续费 fees，ScriptSig 压入高度保证不同区块的 coinbase 不同
+func NewCoinBaseTX(to, data string, height, fees int) *Transaction {
 	if data == "" {
 		data = fmt.Sprintf("Reward to '%s'", to)
 	}
 
-	txIn := TXInput{[]byte{}, -1, nil, []byte(data)}
-	txOut := NewTXOutput(initReward, to)
-	tx := Transaction{nil, []TXInput{txIn}, []TXOutput{*txOut}}
+	txIn := TXInput{[]byte{}, -1, coinbaseScript(height, []byte(data)), SequenceFinal}
+	txOut := NewTXOutput(BlockSubsidy(height)+fees, to)
+	tx := Transaction{nil, encodingVersion, []TXInput{txIn}, []TXOutput{*txOut}, 0}
 	tx.ID = tx.Hash()
 
 	return &tx
 }
 
-type TXOutputs struct {
-	Outputs []TXOutput
+func coinbaseScript(height int, data []byte) []byte {
+	return pushData(pushData(nil, IntToHex(int64(height))), data)
 }
 
-func (outs TXOutputs) Serialize() []byte {
-	var buff bytes.Buffer
-
-	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(outs)
+func coinbaseData(script []byte) (height, data []byte, err error) {
+	pushes, err := scriptPushes(script)
 	if err != nil {
-		log.Panic(err)
+		return nil, nil, err
+	}
+	if len(pushes) != 2 {
+		return nil, nil, fmt.Errorf("coinbase script has %d pushes, expected 2", len(pushes))
 	}
-	return buff.Bytes()
+	return pushes[0], pushes[1], nil
 }
 
-func DeserializeOutputs(data []byte) TXOutputs {
-	var outs TXOutputs
+func FeeRate(fee, size int) int {
+	if size == 0 {
+		return 0
+	}
+	return fee * 1000 / size
+}
+
+// UTXOEntry 是 chainstate 中的一个未花费输出及其区块高度和 coinbase 标记
+type UTXOEntry struct {
+	Output   TXOutput
+	Height   int
+	Coinbase bool
+}
+
+func (entry UTXOEntry) Serialize() []byte {
+	return encodeUTXOEntry(entry)
+}
 
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&outs)
+func DeserializeUTXOEntry(data []byte) UTXOEntry {
+	entry, err := decodeUTXOEntry(data)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	return outs
+	return entry
 }
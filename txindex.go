@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"log"
+)
+
+const txIndexBucket = "txindex"
+
+var errTxNotFound = errors.New("transaction not found")
+
+type TxLocation struct {
+	BlockHash []byte
+	Height    int
+	Offset    int
+}
+
+func encodeTxLocation(loc TxLocation) []byte {
+	e := &encoder{}
+	e.writeBytes(loc.BlockHash)
+	e.writeInt64(int64(loc.Height))
+	e.writeUint32(uint32(loc.Offset))
+	return e.Bytes()
+}
+
+func decodeTxLocation(data []byte) (TxLocation, error) {
+	var loc TxLocation
+	d := &decoder{data: data}
+	loc.BlockHash = d.readBytes()
+	loc.Height = int(d.readInt64())
+	loc.Offset = int(d.readUint32())
+	if err := d.finish(); err != nil {
+		return TxLocation{}, fmt.Errorf("decode tx location: %w", err)
+	}
+	return loc, nil
+}
+
+func indexBlockTxs(tx *bbolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	offsets := blockTxOffsets(block)
+	for i, t := range block.Transactions {
+		loc := TxLocation{block.HeaderHash, block.Height, offsets[i]}
+		if err := b.Put(t.ID, encodeTxLocation(loc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unindexBlockTxs(tx *bbolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	for _, t := range block.Transactions {
+		data := b.Get(t.ID)
+		if data == nil {
+			continue
+		}
+		loc, err := decodeTxLocation(data)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(loc.BlockHash, block.HeaderHash) {
+			if err := b.Delete(t.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (bc *Blockchain) HasTxIndex() bool {
+	enabled := false
+	err := bc.db.View(func(tx *bbolt.Tx) error {
+		enabled = tx.Bucket([]byte(txIndexBucket)) != nil
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return enabled
+}
+
+func (bc *Blockchain) ReIndexTx() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	err := bc.db.Update(func(tx *bbolt.Tx) error {
+		err := tx.DeleteBucket([]byte(txIndexBucket))
+		if err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket([]byte(txIndexBucket)); err != nil {
+			return err
+		}
+
+		heights := tx.Bucket([]byte(heightBucket))
+		blocks := tx.Bucket([]byte(blocksBucket))
+		return heights.ForEach(func(_, hash []byte) error {
+			block, err := decodeBlock(blocks.Get(hash))
+			if err != nil {
+				return err
+			}
+			return indexBlockTxs(tx, block)
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (bc *Blockchain) lookupTx(ID []byte) (t Transaction, loc TxLocation, indexed bool, err error) {
+	err = bc.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(txIndexBucket))
+		if b == nil {
+			return nil
+		}
+		indexed = true
+
+		data := b.Get(ID)
+		if data == nil {
+			return errTxNotFound
+		}
+		loc, err = decodeTxLocation(data)
+		if err != nil {
+			return err
+		}
+		blockData := tx.Bucket([]byte(blocksBucket)).Get(loc.BlockHash)
+		if blockData == nil {
+			return fmt.Errorf("txindex points to missing block %x", loc.BlockHash)
+		}
+		t, err = decodeTransactionAt(blockData, loc.Offset)
+		return err
+	})
+	return t, loc, indexed, err
+}
+
+func (bc *Blockchain) FindTransactionLocation(ID []byte) (Transaction, TxLocation, error) {
+	if t, loc, indexed, err := bc.lookupTx(ID); indexed {
+		return t, loc, err
+	}
+
+	iterator := bc.Iterator()
+	for {
+		block := iterator.Next()
+		offsets := blockTxOffsets(block)
+		for i, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, ID) {
+				return *tx, TxLocation{block.HeaderHash, block.Height, offsets[i]}, nil
+			}
+		}
+		if len(block.PrevBlockHeaderHash) == 0 {
+			break
+		}
+	}
+	return Transaction{}, TxLocation{}, errTxNotFound
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"go.etcd.io/bbolt"
+	"maps"
+	"testing"
+)
+
+func txIndexEntries(t *testing.T, bc *Blockchain) map[string]string {
+	entries := make(map[string]string)
+	err := bc.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(txIndexBucket)).ForEach(func(k, v []byte) error {
+			entries[string(k)] = string(v)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func checkTxIndex(t *testing.T, bc *Blockchain, step string) {
+	count := 0
+	for height := 0; height <= bc.GetBestHeight(); height++ {
+		block, err := bc.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range block.Transactions {
+			count++
+			got, loc, indexed, err := bc.lookupTx(want.ID)
+			if !indexed || err != nil {
+				t.Fatalf("%s: transaction %x: indexed %v, %v", step, want.ID, indexed, err)
+			}
+			if !bytes.Equal(got.ID, want.ID) || !bytes.Equal(loc.BlockHash, block.HeaderHash) || loc.Height != height {
+				t.Errorf("%s: transaction %x found as %x in block %x at height %d", step, want.ID, got.ID, loc.BlockHash, loc.Height)
+			}
+		}
+	}
+	if n := len(txIndexEntries(t, bc)); n != count {
+		t.Errorf("%s: %d index entries, want %d", step, n, count)
+	}
+}
+
+func TestTxIndex(t *testing.T) {
+	bc, w := newTestChain(t, "txindex")
+	defer bc.Close()
+	address := string(w.GetAddress())
+	if _, _, indexed, _ := bc.lookupTx(nil); indexed {
+		t.Fatal("transaction index is enabled by default")
+	}
+	bc.ReIndexTx()
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coin := genesis.Transactions[0]
+	checkTxIndex(t, bc, "genesis")
+
+	spend := testSpend(w, coin, 1)
+	a1 := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "a", 1, 1), spend})
+	b1 := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "b", 1, 0)})
+	b2 := mineTestBlock(bc, b1, []*Transaction{NewCoinBaseTX(address, "b", 2, 0)})
+
+	if _, err := bc.AddBlock(a1); err != nil {
+		t.Fatal(err)
+	}
+	checkTxIndex(t, bc, "connect")
+
+	for _, block := range []*Block{b1, b2} {
+		if _, err := bc.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkTxIndex(t, bc, "disconnect")
+	if _, _, _, err := bc.lookupTx(spend.ID); err != errTxNotFound {
+		t.Errorf("transaction of the disconnected block: got %v, want %v", err, errTxNotFound)
+	}
+
+	entries := txIndexEntries(t, bc)
+	bc.ReIndexTx()
+	if !maps.Equal(txIndexEntries(t, bc), entries) {
+		t.Error("reindexed transaction index differs")
+	}
+	checkTxIndex(t, bc, "reindex")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"go.etcd.io/bbolt"
+	"sort"
+	"sync"
+)
+
+const utxoCacheFlushEntries = 10000
+
+// chainstateBestKey 是数据库中的 chainstate 对应的区块，打开数据库时从这里重放
+const chainstateBestKey = "c"
+
+func outpointUTXOKey(txid []byte, vout int) []byte {
+	key := append([]byte{}, txid...)
+	return binary.BigEndian.AppendUint32(key, uint32(vout))
+}
+
+type cachedUTXO struct {
+	entry *UTXOEntry
+}
+
+// utxoCache 是 chainstate 的写回缓存，写事务中的修改记在 pending，提交后才并入 entries
+type utxoCache struct {
+	mu      sync.RWMutex
+	entries map[string]cachedUTXO
+	pending map[string]cachedUTXO
+	flushed bool
+	// supply 是未花费输出的金额总和，supplyKnown 为 false 时还没有扫描过
+	supply        int
+	supplyKnown   bool
+	pendingSupply int
+}
+
+func newUTXOCache() *utxoCache {
+	return &utxoCache{entries: make(map[string]cachedUTXO)}
+}
+
+func (c *utxoCache) get(tx *bbolt.Tx, key []byte) (UTXOEntry, bool) {
+	cached, ok := c.pending[string(key)]
+	if !ok && !c.flushed {
+		cached, ok = c.entries[string(key)]
+	}
+	if ok {
+		if cached.entry == nil {
+			return UTXOEntry{}, false
+		}
+		return *cached.entry, true
+	}
+
+	data := tx.Bucket([]byte(utxoBucket)).Get(key)
+	if data == nil {
+		return UTXOEntry{}, false
+	}
+	return DeserializeUTXOEntry(data), true
+}
+
+func (c *utxoCache) add(key []byte, entry UTXOEntry) {
+	c.pending[string(key)] = cachedUTXO{&entry}
+}
+
+func (c *utxoCache) spend(key []byte) {
+	c.pending[string(key)] = cachedUTXO{nil}
+}
+
+func (c *utxoCache) size() int {
+	if c.flushed {
+		return len(c.pending)
+	}
+	return len(c.entries) + len(c.pending)
+}
+
+func (c *utxoCache) begin() {
+	c.pending = make(map[string]cachedUTXO)
+	c.flushed = false
+}
+
+func (c *utxoCache) commit() {
+	c.supply += c.pendingSupply
+	if c.flushed {
+		c.entries = c.pending
+	} else {
+		for key, cached := range c.pending {
+			c.entries[key] = cached
+		}
+	}
+	c.discard()
+}
+
+func (c *utxoCache) discard() {
+	c.pending = nil
+	c.flushed = false
+	c.pendingSupply = 0
+}
+
+func (c *utxoCache) forEach(tx *bbolt.Tx, fn func(key []byte, entry UTXOEntry)) {
+	var keys []string
+	for key, cached := range c.entries {
+		if cached.entry != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	cur := tx.Bucket([]byte(utxoBucket)).Cursor()
+	k, v := cur.First()
+	for k != nil || len(keys) > 0 {
+		if k == nil || (len(keys) > 0 && keys[0] <= string(k)) {
+			if k != nil && keys[0] == string(k) {
+				k, v = cur.Next()
+			}
+			fn([]byte(keys[0]), *c.entries[keys[0]].entry)
+			keys = keys[1:]
+			continue
+		}
+		if _, ok := c.entries[string(k)]; !ok {
+			fn(k, DeserializeUTXOEntry(v))
+		}
+		k, v = cur.Next()
+	}
+}
+
+func (c *utxoCache) flush(tx *bbolt.Tx, best []byte) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	write := func(entries map[string]cachedUTXO) error {
+		for key, cached := range entries {
+			var err error
+			if cached.entry == nil {
+				err = b.Delete([]byte(key))
+			} else {
+				err = b.Put([]byte(key), cached.entry.Serialize())
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !c.flushed {
+		if err := write(c.entries); err != nil {
+			return err
+		}
+	}
+	if err := write(c.pending); err != nil {
+		return err
+	}
+	c.pending = make(map[string]cachedUTXO)
+	c.flushed = true
+
+	return tx.Bucket([]byte(blocksBucket)).Put([]byte(chainstateBestKey), best)
+}
+
+func (c *utxoCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]cachedUTXO)
+	c.supply, c.supplyKnown = 0, true
+}
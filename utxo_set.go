@@ -1,142 +1,338 @@
 package main
 
 import (
-	"encoding/hex"
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"go.etcd.io/bbolt"
 	"log"
 )
 
 const utxoBucket = "chainstate"
+const undoBucket = "undo"
+
+const reindexBatchBlocks = 500
 
 type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
 func (set UTXOSet) ReIndex() {
-	db := set.Blockchain.db
-	bucketName := []byte(utxoBucket)
+	bc := set.Blockchain
+	bc.utxo.reset()
 
-	err := db.Update(func(tx *bbolt.Tx) error {
-		err := tx.DeleteBucket(bucketName)
-		if err != nil && err != bbolt.ErrBucketNotFound {
-			log.Panic(err)
+	err := bc.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range []string{utxoBucket, undoBucket} {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != bbolt.ErrBucketNotFound {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
 		}
-		_, err = tx.CreateBucket(bucketName)
-
-		return err
+		return tx.Bucket([]byte(blocksBucket)).Delete([]byte(chainstateBestKey))
 	})
 	if err != nil {
 		log.Panic(err)
 	}
 
-	UTXO := set.Blockchain.FindUTXO()
-
-	err = db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket(bucketName)
+	set.replay(0, bc.GetBestHeight())
+}
 
-		for txID, outs := range UTXO {
-			key, _ := hex.DecodeString(txID)
-			err := b.Put(key, outs.Serialize())
-			if err != nil {
-				log.Panic(err)
+func (set UTXOSet) replay(from, to int) {
+	bc := set.Blockchain
+	for start := from; start <= to; start += reindexBatchBlocks {
+		err := bc.updateChainstate(func(tx *bbolt.Tx) error {
+			for height := start; height <= to && height < start+reindexBatchBlocks; height++ {
+				hash := tx.Bucket([]byte(heightBucket)).Get(heightKey(height))
+				block, err := decodeBlock(tx.Bucket([]byte(blocksBucket)).Get(hash))
+				if err != nil {
+					return err
+				}
+				if err := set.Update(tx, block); err != nil {
+					return err
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			log.Panic(err)
 		}
+	}
+	bc.FlushUTXO()
+}
+
+// Recover 在 chainstate 落后于主链末端时从它对应的区块重放，否则完整重建
+func (set UTXOSet) Recover() {
+	bc := set.Blockchain
+	tip := bc.getTip()
+
+	var best []byte
+	err := bc.db.View(func(tx *bbolt.Tx) error {
+		best = append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get([]byte(chainstateBestKey))...)
 		return nil
 	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if bytes.Equal(best, tip) {
+		return
+	}
+
+	if len(best) > 0 {
+		block, err := bc.findBlock(best)
+		if err == nil {
+			mainHash, err := bc.GetBlockHashByHeight(block.Height)
+			if err == nil && bytes.Equal(mainHash, best) {
+				fmt.Printf("Replaying blocks %d to %d into the UTXO set\n", block.Height+1, bc.GetBestHeight())
+				set.replay(block.Height+1, bc.GetBestHeight())
+				return
+			}
+		}
+	}
+	fmt.Println("Rebuilding the UTXO set")
+	set.ReIndex()
 }
 
-func (set UTXOSet) FindSpendableOutputs(publicKeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOutputs := make(map[string][]int)
-	accumulated := 0
+// TotalValue 只在第一次调用时扫描 chainstate，之后由 Update 和 Rollback 增量维护
+func (set UTXOSet) TotalValue() int {
+	c := set.Blockchain.utxo
+	c.mu.RLock()
+	supply, known := c.supply, c.supplyKnown
+	c.mu.RUnlock()
+	if known {
+		return supply
+	}
 
-	err := set.Blockchain.db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
-
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(publicKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-				}
-			}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.supplyKnown {
+		total := 0
+		err := set.Blockchain.db.View(func(tx *bbolt.Tx) error {
+			c.forEach(tx, func(key []byte, entry UTXOEntry) {
+				total += entry.Output.Value
+			})
+			return nil
+		})
+		if err != nil {
+			log.Panic(err)
 		}
+		c.supply, c.supplyKnown = total, true
+	}
+	return c.supply
+}
+
+func (set UTXOSet) FindOutput(txid []byte, vout int) (TXOutput, bool) {
+	entry, ok := set.GetEntry(txid, vout)
+	return entry.Output, ok
+}
+
+func (set UTXOSet) GetEntry(txid []byte, vout int) (UTXOEntry, bool) {
+	var entry UTXOEntry
+	found := false
+
+	c := set.Blockchain.utxo
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	err := set.Blockchain.db.View(func(tx *bbolt.Tx) error {
+		entry, found = c.get(tx, outpointUTXOKey(txid, vout))
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
-	return accumulated, unspentOutputs
+	return entry, found
 }
 
-func (set UTXOSet) FindUTXO(publicKeyHash []byte) []TXOutput {
+func (set UTXOSet) FindUTXO(addressHash []byte) []TXOutput {
 	var UTXOs []TXOutput
+	set.forEach(func(txid []byte, vout int, entry UTXOEntry) {
+		if bytes.Equal(scriptAddressHash(entry.Output.ScriptPubKey), addressHash) {
+			UTXOs = append(UTXOs, entry.Output)
+		}
+	})
+	return UTXOs
+}
 
-	err := set.Blockchain.db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			outs := DeserializeOutputs(v)
-
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(publicKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
+type UnspentOutput struct {
+	TxID  []byte
+	Vout  int
+	Entry UTXOEntry
+}
+
+func (set UTXOSet) FindSpendableUnspent(script []byte, exclude func(txid []byte, vout int) bool) []UnspentOutput {
+	pubKeyHash, isP2PKH := ExtractPubKeyHash(script)
+	ctx := set.Blockchain.nextLockContext()
+
+	var unspent []UnspentOutput
+	set.forEach(func(txid []byte, vout int, entry UTXOEntry) {
+		if isP2PKH {
+			if !entry.Output.IsLockedWithKey(pubKeyHash) || !spendableAt(entry.Output.ScriptPubKey, entry.Height, ctx) {
+				return
 			}
+		} else if !bytes.Equal(entry.Output.ScriptPubKey, script) {
+			return
+		}
+		if exclude != nil && exclude(txid, vout) {
+			return
 		}
+		unspent = append(unspent, UnspentOutput{txid, vout, entry})
+	})
+	return unspent
+}
+
+// forEach 在释放缓存锁之后调用 fn
+func (set UTXOSet) forEach(fn func(txid []byte, vout int, entry UTXOEntry)) {
+	var unspent []UnspentOutput
+
+	c := set.Blockchain.utxo
+	c.mu.RLock()
+	err := set.Blockchain.db.View(func(tx *bbolt.Tx) error {
+		c.forEach(tx, func(key []byte, entry UTXOEntry) {
+			txid := append([]byte{}, key[:len(key)-4]...)
+			unspent = append(unspent, UnspentOutput{txid, int(binary.BigEndian.Uint32(key[len(key)-4:])), entry})
+		})
 		return nil
 	})
+	c.mu.RUnlock()
 	if err != nil {
 		log.Panic(err)
 	}
-	return UTXOs
+
+	for _, out := range unspent {
+		fn(out.TxID, out.Vout, out.Entry)
+	}
 }
 
-func (set UTXOSet) Update(block *Block) {
-	db := set.Blockchain.db
-
-	err := db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		for _, btx := range block.Transactions {
-			if btx.IsCoinbase() == false {
-				for _, in := range btx.Vin {
-					newOutputs := TXOutputs{}
-					outsBytes := b.Get(in.Txid)
-					outs := DeserializeOutputs(outsBytes)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != in.Vout {
-							newOutputs.Outputs = append(newOutputs.Outputs, out)
-						}
-					}
-					if len(newOutputs.Outputs) == 0 {
-						err := b.Delete(in.Txid)
-						if err != nil {
-							log.Panic(err)
-						}
-					} else {
-						err := b.Put(in.Txid, newOutputs.Serialize())
-						if err != nil {
-							log.Panic(err)
-						}
-					}
+func (set UTXOSet) GetBalance(addressHash []byte) int {
+	if set.Blockchain.HasAddrIndex() {
+		_, balance, err := set.Blockchain.GetAddressHistory(addressHash)
+		if err != nil {
+			log.Panic(err)
+		}
+		return balance
+	}
+
+	balance := 0
+	for _, out := range set.FindUTXO(addressHash) {
+		balance += out.Value
+	}
+	return balance
+}
+
+func (set UTXOSet) Update(tx *bbolt.Tx, block *Block) error {
+	c := set.Blockchain.utxo
+	undo := &BlockUndo{}
+	for _, btx := range block.Transactions {
+		if !btx.IsCoinbase() {
+			for _, in := range btx.Vin {
+				key := outpointUTXOKey(in.Txid, in.Vout)
+				entry, ok := c.get(tx, key)
+				if !ok {
+					return fmt.Errorf("output %x:%d is missing or spent", in.Txid, in.Vout)
 				}
+				undo.Spent = append(undo.Spent, entry)
+				c.spend(key)
+				c.pendingSupply -= entry.Output.Value
 			}
+		}
 
-			newOutputs := TXOutputs{}
-			for _, out := range btx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
-			}
-			err := b.Put(btx.ID, newOutputs.Serialize())
-			if err != nil {
-				log.Panic(err)
+		for outIdx, out := range btx.Vout {
+			c.add(outpointUTXOKey(btx.ID, outIdx), UTXOEntry{out, block.Height, btx.IsCoinbase()})
+			c.pendingSupply += out.Value
+		}
+	}
+
+	err := tx.Bucket([]byte(undoBucket)).Put(block.HeaderHash, undo.Serialize())
+	if err != nil {
+		return err
+	}
+	if c.size() >= utxoCacheFlushEntries {
+		return c.flush(tx, block.HeaderHash)
+	}
+	return nil
+}
+
+func (set UTXOSet) Rollback(tx *bbolt.Tx, block *Block) error {
+	c := set.Blockchain.utxo
+	ub := tx.Bucket([]byte(undoBucket))
+	undoData := ub.Get(block.HeaderHash)
+	if undoData == nil {
+		return fmt.Errorf("no undo data for block %x", block.HeaderHash)
+	}
+	spent := DeserializeBlockUndo(undoData).Spent
+
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		btx := block.Transactions[i]
+		for outIdx, out := range btx.Vout {
+			c.spend(outpointUTXOKey(btx.ID, outIdx))
+			c.pendingSupply -= out.Value
+		}
+		if btx.IsCoinbase() {
+			continue
+		}
+
+		for j := len(btx.Vin) - 1; j >= 0; j-- {
+			if len(spent) == 0 {
+				return fmt.Errorf("undo data for block %x is too short", block.HeaderHash)
 			}
+			in := btx.Vin[j]
+			c.add(outpointUTXOKey(in.Txid, in.Vout), spent[len(spent)-1])
+			c.pendingSupply += spent[len(spent)-1].Output.Value
+			spent = spent[:len(spent)-1]
 		}
-		return nil
+	}
+
+	if err := ub.Delete(block.HeaderHash); err != nil {
+		return err
+	}
+	if c.size() >= utxoCacheFlushEntries {
+		return c.flush(tx, block.PrevBlockHeaderHash)
+	}
+	return nil
+}
+
+func (bc *Blockchain) FlushUTXO() {
+	err := bc.updateChainstate(func(tx *bbolt.Tx) error {
+		tip := append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))...)
+		return bc.utxo.flush(tx, tip)
 	})
 	if err != nil {
 		log.Panic(err)
 	}
 }
+
+// updateChainstate 在写事务中执行 fn，修改在事务提交后才并入缓存
+func (bc *Blockchain) updateChainstate(fn func(tx *bbolt.Tx) error) error {
+	c := bc.utxo
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.begin()
+	defer c.discard()
+	err := bc.db.Update(fn)
+	if err == nil {
+		c.commit()
+	}
+	return err
+}
+
+type BlockUndo struct {
+	Spent []UTXOEntry
+}
+
+func (u *BlockUndo) Serialize() []byte {
+	return encodeBlockUndo(u)
+}
+
+func DeserializeBlockUndo(data []byte) *BlockUndo {
+	if len(data) > 0 && data[0] != encodingVersion {
+		return decodeLegacyBlockUndo(data)
+	}
+	undo, err := decodeBlockUndo(data)
+	if err != nil {
+		log.Panic(err)
+	}
+	return undo
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"go.etcd.io/bbolt"
+	"reflect"
+	"testing"
+)
+
+func TestBlockUndoEncoding(t *testing.T) {
+	undo := &BlockUndo{[]UTXOEntry{
+		{TXOutput{50, []byte{OP_DUP, OP_HASH160}}, 7, true},
+		{TXOutput{3, nil}, 0, false},
+	}}
+
+	data := undo.Serialize()
+	if data[0] != encodingVersion {
+		t.Fatalf("encoding version %d, want %d", data[0], encodingVersion)
+	}
+	got := DeserializeBlockUndo(data)
+	if len(got.Spent) != 2 || got.Spent[0].Height != 7 || !got.Spent[0].Coinbase ||
+		!bytes.Equal(got.Spent[0].Output.ScriptPubKey, undo.Spent[0].Output.ScriptPubKey) ||
+		got.Spent[1].Output.Value != 3 || got.Spent[1].Coinbase {
+		t.Fatalf("round trip: got %+v", got.Spent)
+	}
+
+	empty := DeserializeBlockUndo((&BlockUndo{}).Serialize())
+	if len(empty.Spent) != 0 {
+		t.Fatalf("empty undo decoded %d entries", len(empty.Spent))
+	}
+
+	if _, err := decodeBlockUndo(data[:len(data)-1]); err == nil {
+		t.Fatal("truncated undo data decoded")
+	}
+	if _, err := decodeBlockUndo(append(data, 0)); err == nil {
+		t.Fatal("undo data with trailing bytes decoded")
+	}
+}
+
+func TestBlockUndoLegacyGob(t *testing.T) {
+	undo := &BlockUndo{[]UTXOEntry{{TXOutput{10, []byte{1, 2, 3}}, 4, false}}}
+
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(undo); err != nil {
+		t.Fatal(err)
+	}
+	if got := DeserializeBlockUndo(buff.Bytes()); !reflect.DeepEqual(got, undo) {
+		t.Fatalf("legacy undo: got %+v, want %+v", got, undo)
+	}
+}
+
+func TestChainstateRollback(t *testing.T) {
+	bc, w := newTestChain(t, "chainstate-rollback")
+	defer bc.Close()
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coin := genesis.Transactions[0]
+	spend := testSpend(w, coin, 1)
+	block := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(string(w.GetAddress()), "", 1, 1), spend})
+
+	set := UTXOSet{bc}
+	supply := set.TotalValue()
+	errAbort := errors.New("abort")
+	for _, flush := range []bool{false, true} {
+		err := bc.updateChainstate(func(tx *bbolt.Tx) error {
+			if err := set.Update(tx, block); err != nil {
+				return err
+			}
+			if flush {
+				if err := bc.utxo.flush(tx, block.HeaderHash); err != nil {
+					return err
+				}
+			}
+			return errAbort
+		})
+		if err != errAbort {
+			t.Fatalf("flush %v: got %v", flush, err)
+		}
+		if _, ok := set.FindOutput(coin.ID, 0); !ok {
+			t.Fatalf("flush %v: output spent by an aborted transaction is missing", flush)
+		}
+		if _, ok := set.FindOutput(spend.ID, 0); ok {
+			t.Fatalf("flush %v: output created by an aborted transaction exists", flush)
+		}
+		if got := set.TotalValue(); got != supply {
+			t.Fatalf("flush %v: total value %d after an aborted transaction, want %d", flush, got, supply)
+		}
+	}
+
+	err = bc.updateChainstate(func(tx *bbolt.Tx) error {
+		return set.Update(tx, block)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := set.FindOutput(coin.ID, 0); ok {
+		t.Fatal("spent output still exists after commit")
+	}
+	if _, ok := set.FindOutput(spend.ID, 0); !ok {
+		t.Fatal("created output is missing after commit")
+	}
+}
+
+func scanTotalValue(bc *Blockchain) int {
+	total := 0
+	UTXOSet{bc}.forEach(func(txid []byte, vout int, entry UTXOEntry) {
+		total += entry.Output.Value
+	})
+	return total
+}
+
+func TestTotalValue(t *testing.T) {
+	bc, w := newTestChain(t, "total-value")
+	defer bc.Close()
+	address := string(w.GetAddress())
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coin := genesis.Transactions[0]
+	if got, want := (UTXOSet{bc}).TotalValue(), scanTotalValue(bc); got != want {
+		t.Fatalf("genesis: total value %d, want %d", got, want)
+	}
+
+	a1 := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "a", 1, 0), testSpend(w, coin, 5)})
+	a2 := mineTestBlock(bc, a1, []*Transaction{NewCoinBaseTX(address, "a", 2, 0)})
+	b1 := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "b", 1, 0)})
+	b2 := mineTestBlock(bc, b1, []*Transaction{NewCoinBaseTX(address, "b", 2, 0)})
+	b3 := mineTestBlock(bc, b2, []*Transaction{NewCoinBaseTX(address, "b", 3, 0)})
+
+	for _, block := range []*Block{a1, a2, b1, b2, b3} {
+		if _, err := bc.AddBlock(block); err != nil {
+			t.Fatalf("block %x: %v", block.HeaderHash, err)
+		}
+		if got, want := (UTXOSet{bc}).TotalValue(), scanTotalValue(bc); got != want {
+			t.Errorf("after block %x: total value %d, want %d", block.HeaderHash, got, want)
+		}
+	}
+	if !bytes.Equal(bc.getTip(), b3.HeaderHash) {
+		t.Fatalf("tip %x, want %x", bc.getTip(), b3.HeaderHash)
+	}
+
+	UTXOSet{bc}.ReIndex()
+	if got, want := (UTXOSet{bc}).TotalValue(), IssuedSupply(4); got != want {
+		t.Errorf("reindex: total value %d, want %d", got, want)
+	}
+}
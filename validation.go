@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+type RejectReason int
+
+const (
+	RejectMalformed RejectReason = iota
+	RejectBadPoW
+	RejectBadMerkleRoot
+	RejectMissingParent
+	RejectBadHeight
+	RejectBadCoinbase
+	RejectCoinbaseOverpay
+	RejectMissingInput
+	RejectBadSignature
+	RejectDoubleSpend
+	RejectBadDifficulty
+	RejectBadTimestamp
+	RejectDuplicate
+	RejectMempoolFull
+	RejectNonFinal
+)
+
+var rejectReasonNames = map[RejectReason]string{
+	RejectMalformed:       "malformed",
+	RejectBadPoW:          "bad-pow",
+	RejectBadMerkleRoot:   "bad-merkle-root",
+	RejectMissingParent:   "missing-parent",
+	RejectBadHeight:       "bad-height",
+	RejectBadCoinbase:     "bad-coinbase",
+	RejectCoinbaseOverpay: "coinbase-overpay",
+	RejectMissingInput:    "missing-input",
+	RejectBadSignature:    "bad-signature",
+	RejectDoubleSpend:     "double-spend",
+	RejectBadDifficulty:   "bad-difficulty",
+	RejectBadTimestamp:    "bad-timestamp",
+	RejectDuplicate:       "duplicate",
+	RejectMempoolFull:     "mempool-full",
+	RejectNonFinal:        "non-final",
+}
+
+func (r RejectReason) String() string {
+	if name, ok := rejectReasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("reject(%d)", int(r))
+}
+
+type BlockError struct {
+	Reason RejectReason
+	Detail string
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block rejected (%s): %s", e.Reason, e.Detail)
+}
+
+func rejectBlock(reason RejectReason, format string, args ...interface{}) error {
+	return &BlockError{reason, fmt.Sprintf(format, args...)}
+}
+
+// ValidateBlock 做与 UTXO 无关的共识校验，输入和手续费由 checkBlockConnect 在连接时校验
+func (bc *Blockchain) ValidateBlock(block *Block) error {
+	parent, err := bc.findBlock(block.PrevBlockHeaderHash)
+	if err != nil {
+		return rejectBlock(RejectMissingParent, "previous block %x not found", block.PrevBlockHeaderHash)
+	}
+	if err := checkHeader(block, parent, bc.findBlock); err != nil {
+		return err
+	}
+	if err := checkTransactions(block); err != nil {
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.Version != block.Version {
+			return rejectBlock(RejectMalformed, "transaction %x has version %d in a version %d block", tx.ID, tx.Version, block.Version)
+		}
+	}
+
+	if !block.Transactions[0].IsCoinbase() {
+		return rejectBlock(RejectBadCoinbase, "first transaction is not a coinbase")
+	}
+	for _, tx := range block.Transactions[1:] {
+		if tx.IsCoinbase() {
+			return rejectBlock(RejectBadCoinbase, "more than one coinbase")
+		}
+	}
+	height, _, err := coinbaseData(block.Transactions[0].Vin[0].ScriptSig)
+	if err != nil {
+		return rejectBlock(RejectBadCoinbase, "bad coinbase script: %v", err)
+	}
+	if !bytes.Equal(height, IntToHex(int64(block.Height))) {
+		return rejectBlock(RejectBadCoinbase, "coinbase does not commit to height %d", block.Height)
+	}
+
+	ctx := lockContext{height: block.Height, mtp: bc.MedianTimePast(parent)}
+	for _, tx := range block.Transactions {
+		if !tx.IsFinal(ctx) {
+			return rejectBlock(RejectNonFinal, "transaction %x is locked until %d", tx.ID, tx.LockTime)
+		}
+	}
+
+	return nil
+}
+
+// checkTransactions 也拒绝重复的交易，重复最后一笔交易不改变 Merkle 根
+func checkTransactions(block *Block) error {
+	if len(block.Transactions) == 0 {
+		return rejectBlock(RejectMalformed, "block has no transactions")
+	}
+	seen := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if seen[string(tx.ID)] {
+			return rejectBlock(RejectDuplicate, "transaction %x appears twice", tx.ID)
+		}
+		seen[string(tx.ID)] = true
+	}
+	if !bytes.Equal(block.Root, block.HashTransactions()) {
+		return rejectBlock(RejectBadMerkleRoot, "merkle root %x does not match transactions", block.Root)
+	}
+	return nil
+}
+
+type blockLookup func(hash []byte) (*Block, error)
+
+func checkHeader(block, parent *Block, lookup blockLookup) error {
+	if block.Version == 0 {
+		return rejectBlock(RejectMalformed, "version 0 blocks can only be migrated from a legacy database")
+	}
+	pow := NewPoW(&block.BlockHeader)
+	if !pow.Verify() {
+		return rejectBlock(RejectBadPoW, "hash does not meet target")
+	}
+	if !bytes.Equal(pow.Hash(), block.HeaderHash) {
+		return rejectBlock(RejectBadPoW, "header hash %x does not match contents", block.HeaderHash)
+	}
+
+	if block.Version < parent.Version || block.Version > encodingVersion {
+		return rejectBlock(RejectMalformed, "version %d block after a version %d block", block.Version, parent.Version)
+	}
+	if block.Height != parent.Height+1 {
+		return rejectBlock(RejectBadHeight, "height %d, expected %d", block.Height, parent.Height+1)
+	}
+	if expected := calcNextBits(parent, lookup); block.Bits != expected {
+		return rejectBlock(RejectBadDifficulty, "bits %08x, expected %08x", block.Bits, expected)
+	}
+	if mtp := medianTimePast(parent, lookup); block.Timestamp <= mtp {
+		return rejectBlock(RejectBadTimestamp, "timestamp %d is not after median time past %d", block.Timestamp, mtp)
+	}
+	if maxTime := time.Now().Unix() + params.MaxFutureBlockTime; block.Timestamp > maxTime {
+		return rejectBlock(RejectBadTimestamp, "timestamp %d is too far in the future", block.Timestamp)
+	}
+	return nil
+}
+
+func (bc *Blockchain) checkBlockConnect(block *Block) error {
+	fees, err := bc.checkBlockInputs(block)
+	if err != nil {
+		return err
+	}
+
+	reward := 0
+	for _, out := range block.Transactions[0].Vout {
+		if reward, err = checkMoneyRange(reward, out.Value); err != nil {
+			return rejectBlock(RejectBadCoinbase, "coinbase output: %v", err)
+		}
+	}
+	if allowed := BlockSubsidy(block.Height) + fees; reward > allowed {
+		return rejectBlock(RejectCoinbaseOverpay, "coinbase pays %d, allowed %d", reward, allowed)
+	}
+
+	return nil
+}
+
+func (bc *Blockchain) checkBlockInputs(block *Block) (int, error) {
+	set := UTXOSet{bc}
+	blockTXs := make(map[string]Transaction)
+	spent := make(map[string]bool)
+	fees := 0
+
+	parent, err := bc.findBlock(block.PrevBlockHeaderHash)
+	if err != nil {
+		return 0, rejectBlock(RejectMissingParent, "previous block %x not found", block.PrevBlockHeaderHash)
+	}
+	ctx := bc.lockContextAfter(parent)
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			blockTXs[hex.EncodeToString(tx.ID)] = *tx
+			continue
+		}
+		if !bytes.Equal(tx.ID, tx.Hash()) {
+			return 0, rejectBlock(RejectMalformed, "transaction %x has wrong id", tx.ID)
+		}
+
+		prevOuts := make([]TXOutput, len(tx.Vin))
+		coinHeights := make([]int, len(tx.Vin))
+		inputSum := 0
+		for i, in := range tx.Vin {
+			txID := hex.EncodeToString(in.Txid)
+			outpoint := fmt.Sprintf("%s:%d", txID, in.Vout)
+			if spent[outpoint] {
+				return 0, rejectBlock(RejectDoubleSpend, "output %s spent twice in block", outpoint)
+			}
+			spent[outpoint] = true
+
+			coinHeights[i] = block.Height
+			if prevTX, inBlock := blockTXs[txID]; inBlock {
+				if in.Vout < 0 || in.Vout >= len(prevTX.Vout) {
+					return 0, rejectBlock(RejectMissingInput, "output %s does not exist", outpoint)
+				}
+				prevOuts[i] = prevTX.Vout[in.Vout]
+			} else {
+				entry, ok := set.GetEntry(in.Txid, in.Vout)
+				if !ok {
+					return 0, rejectBlock(RejectMissingInput, "output %s is missing or spent", outpoint)
+				}
+				coinHeights[i] = entry.Height
+				prevOuts[i] = entry.Output
+			}
+			if inputSum, err = checkMoneyRange(inputSum, prevOuts[i].Value); err != nil {
+				return 0, rejectBlock(RejectMalformed, "transaction %x input: %v", tx.ID, err)
+			}
+		}
+
+		if err := tx.checkLocks(ctx, coinHeights); err != nil {
+			return 0, rejectBlock(RejectNonFinal, "transaction %x: %v", tx.ID, err)
+		}
+		if err := tx.VerifyScripts(prevOuts); err != nil {
+			return 0, rejectBlock(RejectBadSignature, "transaction %x: %v", tx.ID, err)
+		}
+
+		outputSum := 0
+		for _, out := range tx.Vout {
+			if outputSum, err = checkMoneyRange(outputSum, out.Value); err != nil {
+				return 0, rejectBlock(RejectMalformed, "transaction %x output: %v", tx.ID, err)
+			}
+		}
+		if outputSum > inputSum {
+			return 0, rejectBlock(RejectMalformed, "transaction %x spends more than its inputs", tx.ID)
+		}
+		if fees, err = checkMoneyRange(fees, inputSum-outputSum); err != nil {
+			return 0, rejectBlock(RejectMalformed, "block fees: %v", err)
+		}
+
+		blockTXs[hex.EncodeToString(tx.ID)] = *tx
+	}
+
+	return fees, nil
+}
+
+func (bc *Blockchain) findBlock(hash []byte) (*Block, error) {
+	var block *Block
+	err := bc.db.View(func(tx *bbolt.Tx) error {
+		blockData := tx.Bucket([]byte(blocksBucket)).Get(hash)
+		if blockData == nil {
+			return fmt.Errorf("block %x not found", hash)
+		}
+		block = DeserializeBlock(blockData)
+		return nil
+	})
+	return block, err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"testing"
+)
+
+// TestMain 把难度降到几次哈希就能出块，并在临时目录中运行
+func TestMain(m *testing.M) {
+	params.PowLimit = new(big.Int).Lsh(big.NewInt(1), 255)
+	params.GenesisBits = BigToCompact(new(big.Int).Lsh(big.NewInt(1), 252))
+
+	dir, err := os.MkdirTemp("", "ozycoin-test")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestWallet 避开坐标以 0 字节开头的密钥，这样的公钥无法从中间拆开
+func newTestWallet() *Wallet {
+	for {
+		w := NewWallet()
+		if len(w.PublicKey) == 64 {
+			return w
+		}
+	}
+}
+
+func newTestChain(t *testing.T, nodeId string) (*Blockchain, *Wallet) {
+	os.Remove(fmt.Sprintf(dbFile, nodeId))
+	w := newTestWallet()
+	bc := CreateBlockChain(nodeId, string(w.GetAddress()))
+	UTXOSet{bc}.ReIndex()
+	return bc, w
+}
+
+func testSpend(w *Wallet, prev *Transaction, fee int) *Transaction {
+	out := NewTXOutput(prev.Vout[0].Value-fee, string(w.GetAddress()))
+	tx := &Transaction{nil, encodingVersion, []TXInput{{prev.ID, 0, nil, SequenceFinal}}, []TXOutput{*out}, 0}
+	tx.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(prev.ID): *prev})
+	tx.ID = tx.Hash()
+	return tx
+}
+
+func rejectReason(err error) (RejectReason, bool) {
+	var blockErr *BlockError
+	if !errors.As(err, &blockErr) {
+		return 0, false
+	}
+	return blockErr.Reason, true
+}
+
+func mineTestBlock(bc *Blockchain, parent *Block, txs []*Transaction) *Block {
+	return NewBlock(parent.HeaderHash, parent.Height+1, bc.CalcNextBits(parent), bc.NextBlockTime(parent), txs)
+}
+
+func TestValidateBlock(t *testing.T) {
+	bc, w := newTestChain(t, "validate")
+	defer bc.Close()
+	address := string(w.GetAddress())
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coin := genesis.Transactions[0]
+
+	valid := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "", 1, 1), testSpend(w, coin, 1)})
+	if err := bc.ValidateBlock(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		block  func() *Block
+		reason RejectReason
+	}{
+		{"no transactions", func() *Block {
+			return &Block{BlockHeader: BlockHeader{PrevBlockHeaderHash: genesis.HeaderHash}, Height: 1}
+		}, RejectMalformed},
+		{"version 0", func() *Block {
+			block := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "", 1, 0)})
+			block.Version = 0
+			return block
+		}, RejectMalformed},
+		{"proof of work", func() *Block {
+			block := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "", 1, 0)})
+			block.Nonce++
+			return block
+		}, RejectBadPoW},
+		{"merkle root", func() *Block {
+			block := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "", 1, 0)})
+			block.Transactions = []*Transaction{NewCoinBaseTX(address, "other", 1, 0)}
+			return block
+		}, RejectBadMerkleRoot},
+		{"difficulty", func() *Block {
+			return NewBlock(genesis.HeaderHash, 1, params.GenesisBits-1, bc.NextBlockTime(genesis), []*Transaction{NewCoinBaseTX(address, "", 1, 0)})
+		}, RejectBadDifficulty},
+		{"missing parent", func() *Block {
+			return NewBlock(coin.ID, 1, params.GenesisBits, bc.NextBlockTime(genesis), []*Transaction{NewCoinBaseTX(address, "", 1, 0)})
+		}, RejectMissingParent},
+		{"height", func() *Block {
+			block := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "", 1, 0)})
+			block.Height++
+			return block
+		}, RejectBadHeight},
+		{"coinbase height", func() *Block {
+			return mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "", 2, 0)})
+		}, RejectBadCoinbase},
+		{"no coinbase", func() *Block {
+			return mineTestBlock(bc, genesis, []*Transaction{testSpend(w, coin, 0)})
+		}, RejectBadCoinbase},
+		{"two coinbases", func() *Block {
+			return mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "", 1, 0), NewCoinBaseTX(address, "other", 1, 0)})
+		}, RejectBadCoinbase},
+		{"median time past", func() *Block {
+			return NewBlock(genesis.HeaderHash, 1, params.GenesisBits, bc.MedianTimePast(genesis), []*Transaction{NewCoinBaseTX(address, "", 1, 0)})
+		}, RejectBadTimestamp},
+		{"transaction version", func() *Block {
+			coinbase := NewCoinBaseTX(address, "", 1, 0)
+			coinbase.Version = 0
+			return mineTestBlock(bc, genesis, []*Transaction{coinbase})
+		}, RejectMalformed},
+	}
+	for _, tt := range tests {
+		err := bc.ValidateBlock(tt.block())
+		if reason, ok := rejectReason(err); !ok || reason != tt.reason {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.reason)
+		}
+	}
+}
+
+func TestValidateBlockTransactionCount(t *testing.T) {
+	bc, w := newTestChain(t, "merkle")
+	defer bc.Close()
+	address := string(w.GetAddress())
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct{ count, repeat int }{{5, 1}, {6, 2}, {7, 1}, {9, 1}} {
+		txs := []*Transaction{NewCoinBaseTX(address, "", 1, 0)}
+		for i := 1; i < tt.count; i++ {
+			txs = append(txs, testSpend(w, NewCoinBaseTX(address, fmt.Sprint(i), 1, 0), 1))
+		}
+		block := mineTestBlock(bc, genesis, txs)
+		if err := bc.ValidateBlock(block); err != nil {
+			t.Errorf("%d transactions: %v", tt.count, err)
+		}
+
+		mutated := *block
+		mutated.Transactions = append(append([]*Transaction{}, txs...), txs[tt.count-tt.repeat:]...)
+		if !bytes.Equal(mutated.HashTransactions(), block.Root) {
+			t.Fatalf("%d transactions: repeating the last %d changed the merkle root", tt.count, tt.repeat)
+		}
+		if reason, _ := rejectReason(bc.ValidateBlock(&mutated)); reason != RejectDuplicate {
+			t.Errorf("%d transactions with duplicates: got %s, want %s", tt.count, reason, RejectDuplicate)
+		}
+
+		unmined := *block
+		for NewPoW(&unmined.BlockHeader).Verify() {
+			unmined.Nonce++
+		}
+		unmined.HeaderHash = unmined.BlockHeader.Hash()
+		unmined.Transactions = append([]*Transaction{}, txs[:tt.count-1]...)
+		if reason, _ := rejectReason(bc.ValidateBlock(&unmined)); reason != RejectBadPoW {
+			t.Errorf("%d transactions without work: got %s, want %s", tt.count, reason, RejectBadPoW)
+		}
+	}
+}
+
+func TestCheckBlockConnect(t *testing.T) {
+	bc, w := newTestChain(t, "connect")
+	defer bc.Close()
+	address := string(w.GetAddress())
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coin := genesis.Transactions[0]
+
+	spend := testSpend(w, coin, 1)
+	block := mineTestBlock(bc, genesis, []*Transaction{NewCoinBaseTX(address, "", 1, 1), spend})
+	if err := bc.checkBlockConnect(block); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := testSpend(newTestWallet(), coin, 1)
+	forged.Vin[0].ScriptSig = spend.Vin[0].ScriptSig
+	forged.ID = forged.Hash()
+	missing := testSpend(w, NewCoinBaseTX(address, "unknown", 1, 0), 1)
+	negative := NewCoinBaseTX(address, "", 1, 0)
+	negative.Vout[0].Value += 1000
+	negative.Vout = append(negative.Vout, TXOutput{-1000, negative.Vout[0].ScriptPubKey})
+	negative.ID = negative.Hash()
+	overflow := testSpend(w, coin, 1)
+	script := overflow.Vout[0].ScriptPubKey
+	overflow.Vout = []TXOutput{{math.MaxInt, script}, {math.MaxInt, script}, {2, script}}
+	overflow.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(coin.ID): *coin})
+	overflow.ID = overflow.Hash()
+
+	tests := []struct {
+		name   string
+		txs    []*Transaction
+		reason RejectReason
+	}{
+		{"overpay", []*Transaction{NewCoinBaseTX(address, "", 1, 2), spend}, RejectCoinbaseOverpay},
+		{"negative coinbase output", []*Transaction{negative}, RejectBadCoinbase},
+		{"output overflow", []*Transaction{NewCoinBaseTX(address, "", 1, 0), overflow}, RejectMalformed},
+		{"double spend", []*Transaction{NewCoinBaseTX(address, "", 1, 3), spend, testSpend(w, coin, 2)}, RejectDoubleSpend},
+		{"missing input", []*Transaction{NewCoinBaseTX(address, "", 1, 1), missing}, RejectMissingInput},
+		{"signature", []*Transaction{NewCoinBaseTX(address, "", 1, 1), forged}, RejectBadSignature},
+	}
+	for _, tt := range tests {
+		err := bc.checkBlockConnect(mineTestBlock(bc, genesis, tt.txs))
+		if reason, ok := rejectReason(err); !ok || reason != tt.reason {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.reason)
+		}
+	}
+}
@@ -16,6 +16,7 @@ import (
 
 const addressChecksumLen = 4
 const pkhVersion = byte(0x00)
+const scriptHashVersion = byte(0x05)
 const walletFile = "wallet_%s.dat"
 
 type Wallet struct {
@@ -25,6 +26,7 @@ type Wallet struct {
 
 type Wallets struct {
 	Wallets map[string]*Wallet
+	Scripts map[string][]byte
 }
 
 func init() {
@@ -50,9 +52,15 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 }
 
 func (w Wallet) GetAddress() []byte {
-	pubKeyHash := HashPubKey(w.PublicKey)
+	return encodeAddress(pkhVersion, HashPubKey(w.PublicKey))
+}
+
+func NewScriptHashAddress(redeemScript []byte) string {
+	return string(encodeAddress(scriptHashVersion, HashPubKey(redeemScript)))
+}
 
-	versionedPayload := append([]byte{pkhVersion}, pubKeyHash...)
+func encodeAddress(version byte, hash []byte) []byte {
+	versionedPayload := append([]byte{version}, hash...)
 	checksum := checkSum(versionedPayload)
 	fullPayload := append(versionedPayload, checksum...)
 	address := Base58Encode(fullPayload)
@@ -62,14 +70,37 @@ func (w Wallet) GetAddress() []byte {
 
 func ValidateAddress(address string) bool {
 	pubKeyHash := Base58Decode([]byte(address))
+	if len(pubKeyHash) != 1+ripemd160.Size+addressChecksumLen {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
 	version := pubKeyHash[0]
+	if version != pkhVersion && version != scriptHashVersion {
+		return false
+	}
 	pubKeyHash = pubKeyHash[len([]byte{version}) : len(pubKeyHash)-addressChecksumLen]
 	targetChecksum := checkSum(append([]byte{version}, pubKeyHash...))
 
 	return bytes.Compare(actualChecksum, targetChecksum) == 0
 }
 
+func AddressScript(address string) []byte {
+	if Base58Decode([]byte(address))[0] == scriptHashVersion {
+		return newScriptHashScript(GetPublicKeyHash(address))
+	}
+	return NewP2PKHScript(GetPublicKeyHash(address))
+}
+
+func ScriptAddress(script []byte) string {
+	if scriptHash, ok := ExtractScriptHash(script); ok {
+		return string(encodeAddress(scriptHashVersion, scriptHash))
+	}
+	if pubKeyHash, ok := scriptPubKeyHash(script); ok {
+		return string(encodeAddress(pkhVersion, pubKeyHash))
+	}
+	return ""
+}
+
 func HashPubKey(pubKey []byte) []byte {
 	pubKeyHash := sha256.Sum256(pubKey)
 	RIPEMD160Hasher := ripemd160.New()
@@ -97,6 +128,7 @@ func GetPublicKeyHash(address string) []byte {
 func NewWallets(nodeId string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.Scripts = make(map[string][]byte)
 
 	err := wallets.LoadFromFile(nodeId)
 	return &wallets, err
@@ -114,6 +146,15 @@ func (ws Wallets) GetWallet(address string) Wallet {
 	return *ws.Wallets[address]
 }
 
+func findWalletByPubKey(wallets *Wallets, pubKey []byte) *Wallet {
+	for _, wallet := range wallets.Wallets {
+		if bytes.Equal(wallet.PublicKey, pubKey) {
+			return wallet
+		}
+	}
+	return nil
+}
+
 func (ws *Wallets) LoadFromFile(nodeId string) error {
 	path := fmt.Sprintf(walletFile, nodeId)
 	if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -134,6 +175,9 @@ func (ws *Wallets) LoadFromFile(nodeId string) error {
 	}
 
 	ws.Wallets = wallets.Wallets
+	if wallets.Scripts != nil {
+		ws.Scripts = wallets.Scripts
+	}
 
 	return nil
 }
@@ -164,6 +208,12 @@ func (ws *Wallets) CreateWallet() string {
 	return address
 }
 
+func (ws *Wallets) AddScript(redeemScript []byte) string {
+	address := NewScriptHashAddress(redeemScript)
+	ws.Scripts[address] = redeemScript
+	return address
+}
+
 // GobEncode 自定义 Wallet 类型的 Gob 序列化方法
 func (w Wallet) GobEncode() ([]byte, error) {
 	curveName := ""
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBase58LeadingZeros(t *testing.T) {
+	for _, input := range [][]byte{{0}, {0, 0, 1}, {0, 0, 0, 0xff}, {1, 0}} {
+		if got := Base58Decode(Base58Encode(input)); !bytes.Equal(got, input) {
+			t.Errorf("%x decoded as %x", input, got)
+		}
+	}
+	if Base58Decode([]byte("0OIl")) != nil {
+		t.Error("characters outside the alphabet decoded")
+	}
+}
+
+func TestValidateAddress(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xab}, 20)
+	zeroHash := append([]byte{0, 0}, hash[2:]...)
+	address := string(encodeAddress(pkhVersion, hash))
+	corrupted := []byte(address)
+	corrupted[len(corrupted)-1] ^= 1
+
+	tests := []struct {
+		address string
+		valid   bool
+	}{
+		{address, true},
+		{string(encodeAddress(scriptHashVersion, hash)), true},
+		{string(encodeAddress(pkhVersion, zeroHash)), true},
+		{string(encodeAddress(pkhVersion, hash[:19])), false},
+		{string(encodeAddress(pkhVersion, append(hash, 0xab))), false},
+		{string(encodeAddress(scriptHashVersion, hash[:19])), false},
+		{string(encodeAddress(0x01, hash)), false},
+		{string(corrupted), false},
+		{"", false},
+		{"0" + address[1:], false},
+	}
+	for _, tt := range tests {
+		if got := ValidateAddress(tt.address); got != tt.valid {
+			t.Errorf("ValidateAddress(%q) = %v, want %v", tt.address, got, tt.valid)
+		}
+	}
+	if got := GetPublicKeyHash(string(encodeAddress(pkhVersion, zeroHash))); !bytes.Equal(got, zeroHash) {
+		t.Errorf("hash with leading zeros decoded as %x", got)
+	}
+}